@@ -0,0 +1,123 @@
+package main
+
+import "net"
+
+// RFC 7911: Advertisement of Multiple Paths in BGP
+
+// AddPathConfig は address family ごとの ADD-PATH の設定
+type AddPathConfig struct {
+	// 相手から同じ prefix の複数の経路を受け取る
+	Receive bool
+	// 相手に同じ prefix の複数の経路を送る
+	Send bool
+	// 送る経路の最大数 (最適経路から良い順に選ぶ)。0 の場合は全ての経路を送る
+	SendMax int
+}
+
+func (c AddPathConfig) mode() AddPathMode {
+	var m AddPathMode
+	if c.Receive {
+		m |= AddPathModeReceive
+	}
+	if c.Send {
+		m |= AddPathModeSend
+	}
+	return m
+}
+
+// addPathCapability は ADD-PATH を設定している address family の capability を作る (1 つも無ければ false)
+func (p *Peer) addPathCapability() (AddPathCapability, bool) {
+	var c AddPathCapability
+	for _, af := range sortedAddressFamilies(p.AddressFamilies) {
+		if m := p.AddressFamilies[af].AddPath.mode(); m != 0 {
+			c.AddressFamilies = append(c.AddressFamilies, AddPathAddressFamily{AF: af, Mode: m})
+		}
+	}
+	return c, len(c.AddressFamilies) > 0
+}
+
+// sentPath は ADD-PATH で相手に送っている経路
+type sentPath struct {
+	// Loc-RIB の経路の送信元と、送信元が付けた Path Identifier
+	source *Peer
+	pathID uint32
+
+	id    uint32    // 相手に送るときに付けた Path Identifier
+	entry *RIBEntry // 最後に送った Loc-RIB の経路 (nil の場合は次に届いたときに送り直す)
+}
+
+// sendPaths は ADD-PATH で送る address family の prefix について、広報する経路 (全て、または良い方から SendMax 個) を送り、
+// 前に送って選ばれなくなった経路を取り消す。paths は Loc-RIB の prefix の全ての経路 (良い順)
+func (p *Peer) sendPaths(af AddressFamily, prefix *net.IPNet, paths []*RIBEntry) error {
+	max := p.AddressFamilies[af].AddPath.SendMax
+	var selected []*RIBEntry
+	for _, e := range paths {
+		if max > 0 && len(selected) >= max {
+			break
+		}
+		if p.shouldAdvertise(e) {
+			selected = append(selected, e)
+		}
+	}
+
+	// 送り続ける経路には前と同じ Path Identifier を付ける
+	key := prefix.String()
+	prev := p.sentPaths[key]
+	next := make([]sentPath, len(selected))
+	used := make(map[uint32]bool, len(selected))
+	for i, e := range selected {
+		next[i] = sentPath{source: e.Source, pathID: e.PathID, entry: e}
+		for _, s := range prev {
+			if s.source == e.Source && s.pathID == e.PathID {
+				next[i].id = s.id
+				used[s.id] = true
+			}
+		}
+	}
+	// 新しく送る経路には使っていない最小の Path Identifier を付ける
+	id := uint32(1)
+	for i := range next {
+		if next[i].id != 0 {
+			continue
+		}
+		for used[id] {
+			id++
+		}
+		next[i].id = id
+		used[id] = true
+	}
+
+	sent := make(map[uint32]*RIBEntry, len(prev))
+	for _, s := range prev {
+		sent[s.id] = s.entry
+		if !used[s.id] {
+			if err := p.sendWithdrawn(WithdrawnRoute{AF: af, Prefix: prefix, PathID: s.id}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range next {
+		if sent[s.id] == s.entry {
+			continue // 前に送ったものから変わっていない
+		}
+		if err := p.sendUpdate(s.entry, s.id); err != nil {
+			return err
+		}
+	}
+
+	if len(next) == 0 {
+		delete(p.sentPaths, key)
+	} else {
+		p.sentPaths[key] = next
+	}
+	return nil
+}
+
+// invalidateSentPaths は ADD-PATH で送っている経路を、次に Loc-RIB から届いたときに (同じ Path Identifier で) 送り直すようにする
+func (p *Peer) invalidateSentPaths() {
+	for _, s := range p.sentPaths {
+		for i := range s {
+			s[i].entry = nil
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newAddPathTestPeer は IPv4 Unicast で ADD-PATH の送信を合意して、良い方から sendMax 個 (0 なら全て) を送るピアを作る
+func newAddPathTestPeer(t *testing.T, sendMax int) *testPeer {
+	t.Helper()
+	p := newTestPeer(t, "10.0.0.9", 65009, NewRIB(), NegotiatedCapabilities{
+		AddressFamilies: map[AddressFamily]struct{}{IPv4Unicast: {}},
+		FourOctetAS:     true,
+		AddPath:         map[AddressFamily]AddPathMode{IPv4Unicast: AddPathModeSend},
+	})
+	c := p.AddressFamilies[IPv4Unicast]
+	c.AddPath = AddPathConfig{Send: true, SendMax: sendMax}
+	p.AddressFamilies[IPv4Unicast] = c
+	return p
+}
+
+// wantAdvertised は e が Path Identifier id で広報されたことを確認する
+func (p *testPeer) wantAdvertised(t *testing.T, e *RIBEntry, id uint32) {
+	t.Helper()
+	m := p.receiveUpdate(t)
+	if len(m.NLRI) != 1 || m.NLRI[0].String() != e.Prefix.String() || len(m.NLRIPathIDs) != 1 || m.NLRIPathIDs[0] != id {
+		t.Fatalf("received NLRI %v %v, want %v [%d]", m.NLRI, m.NLRIPathIDs, e.Prefix, id)
+	}
+	_, entries, err := UpdateMessageToRIBEntries(m, p.Peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// eBGP なので自分の AS が前に付く
+	if got, want := entries[0].ASPath.String(), NewASPath(p.MyAS).String()+" "+e.ASPath.String(); got != want {
+		t.Errorf("path %d: AS_PATH = %s, want %s", id, got, want)
+	}
+}
+
+// wantWithdrawn は Path Identifier id の経路が取り消されたことを確認する
+func (p *testPeer) wantWithdrawn(t *testing.T, id uint32) {
+	t.Helper()
+	m := p.receiveUpdate(t)
+	if len(m.NLRI) != 0 || len(m.WithdrawnPathIDs) != 1 || m.WithdrawnPathIDs[0] != id {
+		t.Fatalf("received %+v, want withdrawal of path %d", m, id)
+	}
+}
+
+// wantNoMessage は何も送られていないことを確認する
+func (p *testPeer) wantNoMessage(t *testing.T) {
+	t.Helper()
+	select {
+	case m := <-p.received:
+		t.Fatalf("received %+v, want nothing", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testAddPathEntries は別々の送信元から受け取った同じ prefix の経路を作る
+func testAddPathEntries(t *testing.T) []*RIBEntry {
+	prefix := mustParseCIDR(t, "10.10.0.0/16")
+	var entries []*RIBEntry
+	for i, addr := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		as := uint32(65002 + i)
+		entries = append(entries, &RIBEntry{
+			AF:     IPv4Unicast,
+			Prefix: prefix,
+			Origin: OriginAttributeIGP,
+			ASPath: NewASPath(as),
+			Source: NewPeer(PeerConfig{MyAS: 65001, NeighborAddress: addr, RemoteAS: as}),
+		})
+	}
+	return entries
+}
+
+func TestSendPathsAll(t *testing.T) {
+	p := newAddPathTestPeer(t, 0)
+	e := testAddPathEntries(t)
+	prefix := e[0].Prefix
+
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[0], e[1]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[0], 1)
+	p.wantAdvertised(t, e[1], 2)
+
+	// 順番が変わっただけなら送り直さない
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[1], e[0]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantNoMessage(t)
+
+	// 同じ送信元からの経路が変わったら、同じ Path Identifier で送り直す
+	updated := *e[0]
+	updated.ASPath = NewASPath(65002, 65020)
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{&updated, e[1]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, &updated, 1)
+
+	// 無くなった経路を取り消して、空いた Path Identifier を次の経路に使う
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[1]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantWithdrawn(t, 1)
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[1], e[2]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[2], 1)
+
+	if err := p.sendPaths(IPv4Unicast, prefix, nil); err != nil {
+		t.Fatal(err)
+	}
+	p.wantWithdrawn(t, 2)
+	p.wantWithdrawn(t, 1)
+	if _, ok := p.sentPaths[prefix.String()]; ok {
+		t.Errorf("sentPaths has %v", prefix)
+	}
+}
+
+func TestSendPathsBestN(t *testing.T) {
+	p := newAddPathTestPeer(t, 2)
+	e := testAddPathEntries(t)
+	prefix := e[0].Prefix
+
+	// 相手から受け取った経路は送らないので、数えずに次の経路を選ぶ
+	own := &RIBEntry{AF: IPv4Unicast, Prefix: prefix, Origin: OriginAttributeIGP, ASPath: NewASPath(65009), Source: p.Peer}
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{own, e[0], e[1], e[2]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[0], 1)
+	p.wantAdvertised(t, e[1], 2)
+	p.wantNoMessage(t)
+
+	// 上位 2 つから外れた経路は、空いた Path Identifier で新しく入った経路を送って置き換える
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[2], e[0], e[1]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[2], 2)
+	p.wantNoMessage(t)
+
+	// 代わりの経路が無ければ取り消す
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[2]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantWithdrawn(t, 1)
+	p.wantNoMessage(t)
+	if s := p.sentPaths[prefix.String()]; len(s) != 1 || s[0].id != 2 || s[0].entry != e[2] {
+		t.Errorf("sentPaths = %+v, want path 2 only", s)
+	}
+}
+
+func TestInvalidateSentPaths(t *testing.T) {
+	p := newAddPathTestPeer(t, 0)
+	e := testAddPathEntries(t)
+	prefix := e[0].Prefix
+
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[0], e[1]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[0], 1)
+	p.wantAdvertised(t, e[1], 2)
+
+	// 変わっていなくても、同じ Path Identifier で送り直す
+	p.invalidateSentPaths()
+	if err := p.sendPaths(IPv4Unicast, prefix, []*RIBEntry{e[1], e[0]}); err != nil {
+		t.Fatal(err)
+	}
+	p.wantAdvertised(t, e[1], 2)
+	p.wantAdvertised(t, e[0], 1)
+	p.wantNoMessage(t)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 )
 
 type (
@@ -31,6 +32,10 @@ type AddressFamily struct {
 	SAFI SAFI
 }
 
+func (f AddressFamily) Known() bool {
+	return f == IPv4Unicast || f == IPv6Unicast
+}
+
 func (f AddressFamily) AddressBits() int {
 	switch {
 	case f.AFI == AFIIPv4 && f.SAFI == SAFIUnicast:
@@ -53,7 +58,7 @@ func (f AddressFamily) String() string {
 	case IPv6Unicast:
 		return "ipv6-unicast"
 	default:
-		return fmt.Sprint("address-family-%d-%d", f.AFI, f.SAFI)
+		return fmt.Sprintf("address-family-%d-%d", f.AFI, f.SAFI)
 	}
 }
 
@@ -67,3 +72,18 @@ func AddressFamilyFromString(name string) (AddressFamily, bool) {
 		return AddressFamily{}, false
 	}
 }
+
+// sortedAddressFamilies は map の順序に依存しないよう address family を並べる
+func sortedAddressFamilies[V any](m map[AddressFamily]V) []AddressFamily {
+	afs := make([]AddressFamily, 0, len(m))
+	for af := range m {
+		afs = append(afs, af)
+	}
+	sort.Slice(afs, func(i, j int) bool {
+		if afs[i].AFI != afs[j].AFI {
+			return afs[i].AFI < afs[j].AFI
+		}
+		return afs[i].SAFI < afs[j].SAFI
+	})
+	return afs
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// AdjRIB は 1 つのピアの 1 つの address family についての Adj-RIB-In または Adj-RIB-Out
+// Adj-RIB-In には相手から受け取ったままの経路 (ポリシー適用前)、
+// Adj-RIB-Out には相手に実際に広報した経路 (書き換えた後) を入れる
+type AdjRIB struct {
+	mutex   *sync.RWMutex
+	entries map[adjRIBKey]*RIBEntry
+
+	// Enhanced Route Refresh の BoRR から送り直されていない経路
+	stale map[adjRIBKey]struct{}
+}
+
+// adjRIBKey は prefix と ADD-PATH の Path Identifier (使っていなければ 0) の組
+type adjRIBKey struct {
+	prefix string
+	pathID uint32
+}
+
+func NewAdjRIB() *AdjRIB {
+	return &AdjRIB{
+		mutex:   new(sync.RWMutex),
+		entries: make(map[adjRIBKey]*RIBEntry),
+		stale:   make(map[adjRIBKey]struct{}),
+	}
+}
+
+func (rib *AdjRIB) Find(prefix *net.IPNet, pathID uint32) *RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
+
+	return rib.entries[adjRIBKey{prefix.String(), pathID}]
+}
+
+func (rib *AdjRIB) Update(e *RIBEntry) {
+	rib.mutex.Lock()
+	defer rib.mutex.Unlock()
+
+	key := adjRIBKey{e.Prefix.String(), e.PathID}
+	rib.entries[key] = e
+	delete(rib.stale, key)
+}
+
+// Remove は prefix の pathID の経路を取り除き、入っていたかを返す
+func (rib *AdjRIB) Remove(prefix *net.IPNet, pathID uint32) bool {
+	rib.mutex.Lock()
+	defer rib.mutex.Unlock()
+
+	key := adjRIBKey{prefix.String(), pathID}
+	if _, ok := rib.entries[key]; !ok {
+		return false
+	}
+	delete(rib.entries, key)
+	delete(rib.stale, key)
+	return true
+}
+
+func (rib *AdjRIB) Clear() {
+	rib.mutex.Lock()
+	defer rib.mutex.Unlock()
+
+	rib.entries = make(map[adjRIBKey]*RIBEntry)
+	rib.stale = make(map[adjRIBKey]struct{})
+}
+
+// MarkStale は今ある全ての経路を stale にする (Update で送り直されると stale でなくなる)
+func (rib *AdjRIB) MarkStale() {
+	rib.mutex.Lock()
+	defer rib.mutex.Unlock()
+
+	for key := range rib.entries {
+		rib.stale[key] = struct{}{}
+	}
+}
+
+// RemoveStale は stale のままの経路を全て取り除いて返す
+func (rib *AdjRIB) RemoveStale() []*RIBEntry {
+	rib.mutex.Lock()
+	defer rib.mutex.Unlock()
+
+	s := make([]*RIBEntry, 0, len(rib.stale))
+	for key := range rib.stale {
+		s = append(s, rib.entries[key])
+		delete(rib.entries, key)
+	}
+	rib.stale = make(map[adjRIBKey]struct{})
+	return s
+}
+
+func (rib *AdjRIB) Entries() []*RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
+
+	s := make([]*RIBEntry, 0, len(rib.entries))
+	for _, e := range rib.entries {
+		s = append(s, e)
+	}
+	return s
+}
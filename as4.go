@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// RFC 6793: BGP Support for Four-Octet Autonomous System (AS) Number Space
+
+const ASTrans uint32 = 23456
+
+const (
+	AttributeTypeAS4Path       AttributeTypeCode = 17
+	AttributeTypeAS4Aggregator AttributeTypeCode = 18
+)
+
+// twoOctetAS は 2 byte のフィールドに入れる AS 番号を返す (収まらない場合は AS_TRANS)
+func twoOctetAS(as uint32) uint16 {
+	if as > 0xFFFF {
+		return uint16(ASTrans)
+	}
+	return uint16(as)
+}
+
+func AS4PathFromPathAttribute(a PathAttribute) (ASPath, error) {
+	if a.TypeCode != AttributeTypeAS4Path {
+		return ASPath{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
+	}
+	v, err := parseASPath(a.Value, 4)
+	if err != nil {
+		return ASPath{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "%v", err)
+	}
+	return v, nil
+}
+
+func (a ASPath) ToAS4PathAttribute() PathAttribute {
+	return PathAttribute{
+		Flags:    0b11000000, // optional transitive
+		TypeCode: AttributeTypeAS4Path,
+		Value:    a.encode(4),
+	}
+}
+
+// mergeAS4Path は 2-octet AS の相手から受け取った AS_PATH と AS4_PATH から本来の AS_PATH を復元する (RFC 6793 4.2.3)。
+// AS 番号の数は AS_SET を 1 つとして数え、AS_PATH の方が少なければ AS4_PATH を無視する。
+// そうでなければ AS_PATH の先頭から足りない数だけセグメントと AS 番号を取って、AS4_PATH の前に付ける
+func mergeAS4Path(asPath, as4Path ASPath) ASPath {
+	n := asPath.Length() - as4Path.Length()
+	if n < 0 {
+		return asPath
+	}
+	var merged ASPath
+	for _, s := range asPath.Segments {
+		if n == 0 {
+			break
+		}
+		if s.Type == ASPathSegmentSet {
+			merged.Segments = append(merged.Segments, s)
+			n--
+			continue
+		}
+		k := len(s.ASNs)
+		if k > n {
+			k = n
+		}
+		merged.Segments = append(merged.Segments, ASPathSegment{Type: s.Type, ASNs: s.ASNs[:k]})
+		n -= k
+	}
+	for _, s := range as4Path.Segments {
+		if last := len(merged.Segments) - 1; last >= 0 && s.Type == ASPathSegmentSequence && merged.Segments[last].Type == ASPathSegmentSequence {
+			// 間で分かれた AS_SEQUENCE はつなげる
+			asns := append(append([]uint32(nil), merged.Segments[last].ASNs...), s.ASNs...)
+			merged.Segments[last] = ASPathSegment{Type: ASPathSegmentSequence, ASNs: asns}
+			continue
+		}
+		merged.Segments = append(merged.Segments, s)
+	}
+	return merged
+}
+
+type Aggregator struct {
+	AS      uint32
+	Address net.IP
+}
+
+func AggregatorFromPathAttribute(a PathAttribute, fourOctet bool) (Aggregator, error) {
+	if a.TypeCode != AttributeTypeAggregator {
+		return Aggregator{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
+	}
+	asSize := 2
+	if fourOctet {
+		asSize = 4
+	}
+	v, err := parseAggregator(a.Value, asSize)
+	if err != nil {
+		return Aggregator{}, attributeError(ErrorSubcodeAttributeLengthError, a, "%v", err)
+	}
+	return v, nil
+}
+
+func AS4AggregatorFromPathAttribute(a PathAttribute) (Aggregator, error) {
+	if a.TypeCode != AttributeTypeAS4Aggregator {
+		return Aggregator{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
+	}
+	v, err := parseAggregator(a.Value, 4)
+	if err != nil {
+		return Aggregator{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "%v", err)
+	}
+	return v, nil
+}
+
+func parseAggregator(b []byte, asSize int) (Aggregator, error) {
+	if len(b) != asSize+4 {
+		return Aggregator{}, fmt.Errorf("invalid aggregator length: %d", len(b))
+	}
+	var as uint32
+	if asSize == 4 {
+		as = binary.BigEndian.Uint32(b[0:4])
+	} else {
+		as = uint32(binary.BigEndian.Uint16(b[0:2]))
+	}
+	addr := make(net.IP, 4)
+	copy(addr, b[asSize:])
+	return Aggregator{
+		AS:      as,
+		Address: addr,
+	}, nil
+}
+
+func (a Aggregator) ToPathAttribute(fourOctet bool) PathAttribute {
+	var b []byte
+	if fourOctet {
+		b = binary.BigEndian.AppendUint32(nil, a.AS)
+	} else {
+		b = binary.BigEndian.AppendUint16(nil, twoOctetAS(a.AS))
+	}
+	return PathAttribute{
+		Flags:    0b11000000, // optional transitive
+		TypeCode: AttributeTypeAggregator,
+		Value:    append(b, a.Address.To4()...),
+	}
+}
+
+func (a Aggregator) ToAS4AggregatorPathAttribute() PathAttribute {
+	return PathAttribute{
+		Flags:    0b11000000, // optional transitive
+		TypeCode: AttributeTypeAS4Aggregator,
+		Value:    append(binary.BigEndian.AppendUint32(nil, a.AS), a.Address.To4()...),
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestMergeAS4Path(t *testing.T) {
+	seq := func(asns ...uint32) ASPathSegment { return ASPathSegment{Type: ASPathSegmentSequence, ASNs: asns} }
+	set := func(asns ...uint32) ASPathSegment { return ASPathSegment{Type: ASPathSegmentSet, ASNs: asns} }
+	path := func(segments ...ASPathSegment) ASPath { return ASPath{Segments: segments} }
+	trans := ASTrans
+
+	tests := []struct {
+		name            string
+		asPath, as4Path ASPath
+		want            string
+	}{
+		{
+			name:    "same length",
+			asPath:  path(seq(trans, trans)),
+			as4Path: path(seq(65536, 65537)),
+			want:    "65536 65537",
+		},
+		{
+			// AS4_PATH に対応していない AS が後から付けた分は AS_PATH から取る
+			name:    "prepended by old speakers",
+			asPath:  path(seq(65002, 65003, trans)),
+			as4Path: path(seq(65536)),
+			want:    "65002 65003 65536",
+		},
+		{
+			name:    "as set",
+			asPath:  path(seq(65002, trans), set(64512, trans)),
+			as4Path: path(seq(65536), set(64512, 65537)),
+			want:    "65002 65536 {64512,65537}",
+		},
+		{
+			// AS_SET は中の AS 番号の数によらず 1 つとして数える
+			name:    "as set in the leading part",
+			asPath:  path(set(64512, 64513, 64514), seq(trans)),
+			as4Path: path(seq(65536)),
+			want:    "{64512,64513,64514} 65536",
+		},
+		{
+			name:    "split sequence",
+			asPath:  path(seq(65002, 65003), seq(trans, 65004)),
+			as4Path: path(seq(65536, 65004)),
+			want:    "65002 65003 65536 65004",
+		},
+		{
+			// AS_PATH の方が短ければ AS4_PATH を無視する
+			name:    "shorter as path",
+			asPath:  path(seq(trans)),
+			as4Path: path(seq(65536, 65537)),
+			want:    "23456",
+		},
+		{
+			name:    "as set counted as one",
+			asPath:  path(seq(trans), set(64512, 64513)),
+			as4Path: path(seq(65536, 65537, 65538)),
+			want:    "23456 {64512,64513}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeAS4Path(tt.asPath, tt.as4Path)
+			if got.String() != tt.want {
+				t.Errorf("mergeAS4Path() = %q, want %q", got, tt.want)
+			}
+			if got.Length() != tt.asPath.Length() {
+				t.Errorf("Length() = %d, want %d", got.Length(), tt.asPath.Length())
+			}
+		})
+	}
+}
+
+func TestUpdateMessageAS4Path(t *testing.T) {
+	// 2-octet AS の相手に送った AS_PATH と AS4_PATH を受け取ると、元の AS_PATH に戻る
+	p := ASPath{Segments: []ASPathSegment{
+		{Type: ASPathSegmentSequence, ASNs: []uint32{65002, 4200000000}},
+		{Type: ASPathSegmentSet, ASNs: []uint32{64512, 4200000001}},
+	}}
+	asPath, err := parseASPath(p.encode(2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := asPath.String(), "65002 23456 {64512,23456}"; got != want {
+		t.Errorf("AS_PATH = %q, want %q", got, want)
+	}
+	as4Path, err := AS4PathFromPathAttribute(p.ToAS4PathAttribute())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mergeAS4Path(asPath, as4Path); got.String() != p.String() {
+		t.Errorf("mergeAS4Path() = %q, want %q", got, p)
+	}
+}
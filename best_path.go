@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// selectBestPath は候補の経路から最適経路を選ぶ (RFC 4271 9.1.2)
+// MED は同じ AS から受け取った経路同士でしか比べないので順序によって結果が変わりうるが、
+// paths は送信元の順に並んでいるので同じ候補からは常に同じ経路を選ぶ
+func selectBestPath(paths []*RIBEntry) *RIBEntry {
+	var best *RIBEntry
+	for _, e := range paths {
+		if best == nil || betterPath(e, best) {
+			best = e
+		}
+	}
+	return best
+}
+
+// betterPath は a が b より優先されるかを返す
+func betterPath(a, b *RIBEntry) bool {
+	// 1. Weight が大きい
+	if a.Weight != b.Weight {
+		return a.Weight > b.Weight
+	}
+	// 2. LOCAL_PREF が大きい
+	if a.LocalPref != b.LocalPref {
+		return a.LocalPref > b.LocalPref
+	}
+	// 3. 自分で広報している
+	if (a.Source == nil) != (b.Source == nil) {
+		return a.Source == nil
+	}
+	// 4. AS_PATH が短い
+	if la, lb := a.ASPath.Length(), b.ASPath.Length(); la != lb {
+		return la < lb
+	}
+	// 5. ORIGIN が小さい (IGP < EGP < INCOMPLETE)
+	if a.Origin != b.Origin {
+		return a.Origin < b.Origin
+	}
+	// 6. 同じ AS から受け取った経路同士なら MED が小さい (付いていなければ 0)
+	if a.ASPath.NeighborAS() == b.ASPath.NeighborAS() {
+		if ma, mb := a.MED.value(), b.MED.value(); ma != mb {
+			return ma < mb
+		}
+	}
+	// 7. iBGP より eBGP で受け取った経路
+	if ea, eb := isExternalPath(a), isExternalPath(b); ea != eb {
+		return ea
+	}
+	// 8. NEXT_HOP までの IGP のメトリック: IGP と連携していないので全て同じとみなす
+	// 9. 相手の BGP Identifier が小さい
+	if c := bytes.Compare(a.PeerRouterID[:], b.PeerRouterID[:]); c != 0 {
+		return c < 0
+	}
+	// 10. 相手のアドレスが小さい
+	return comparePathSource(a, b) < 0
+}
+
+func isExternalPath(e *RIBEntry) bool {
+	return e.Source != nil && !e.Source.isInternal()
+}
+
+// rankPaths は最適経路を先頭にして、残りを良い順に並べた経路を返す (ADD-PATH で良い方から送るときに使う)
+func rankPaths(paths []*RIBEntry, best *RIBEntry) []*RIBEntry {
+	s := make([]*RIBEntry, 0, len(paths))
+	if best != nil {
+		s = append(s, best)
+	}
+	for _, e := range paths {
+		if e != best {
+			s = append(s, e)
+		}
+	}
+	if len(s) > 1 {
+		rest := s[1:]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return betterPath(rest[i], rest[j])
+		})
+	}
+	return s
+}
+
+// comparePathSource は送信元の順序を返す
+// (自分で広報している経路が先、その後は相手のアドレス順、同じ相手からは Path Identifier 順)
+func comparePathSource(a, b *RIBEntry) int {
+	switch {
+	case a.Source == b.Source:
+		switch {
+		case a.PathID < b.PathID:
+			return -1
+		case a.PathID > b.PathID:
+			return 1
+		}
+		return 0
+	case a.Source == nil:
+		return -1
+	case b.Source == nil:
+		return 1
+	}
+	return bytes.Compare(
+		net.ParseIP(a.Source.NeighborAddress).To16(),
+		net.ParseIP(b.Source.NeighborAddress).To16(),
+	)
+}
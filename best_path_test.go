@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func testBestPathPeer(addr string, remoteAS uint32) *Peer {
+	return NewPeer(PeerConfig{
+		MyAS:            65001,
+		RouterID:        [4]byte{10, 0, 0, 1},
+		NeighborAddress: addr,
+		RemoteAS:        remoteAS,
+	})
+}
+
+func TestBetterPath(t *testing.T) {
+	var (
+		ebgp1  = testBestPathPeer("10.0.0.2", 65002)
+		ebgp2  = testBestPathPeer("10.0.0.3", 65003)
+		ebgp3  = testBestPathPeer("10.0.0.5", 65002) // ebgp1 と同じ AS
+		ibgp   = testBestPathPeer("10.0.0.4", 65001)
+		prefix = mustParseCIDR(t, "10.10.0.0/16")
+	)
+	// route は source から受け取った経路を作る (PeerRouterID は相手のアドレスと同じにする)
+	route := func(source *Peer, asns ...uint32) *RIBEntry {
+		e := &RIBEntry{
+			AF:     IPv4Unicast,
+			Prefix: prefix,
+			Origin: OriginAttributeIGP,
+			ASPath: NewASPath(asns...),
+			Source: source,
+		}
+		if source != nil {
+			copy(e.PeerRouterID[:], net.ParseIP(source.NeighborAddress).To4())
+		}
+		return e
+	}
+	with := func(e *RIBEntry, f func(e *RIBEntry)) *RIBEntry {
+		f(e)
+		return e
+	}
+	med := func(v uint32) *MultiExitDisc {
+		m := MultiExitDisc(v)
+		return &m
+	}
+
+	// 全て a が b より優先される
+	tests := []struct {
+		name string
+		a, b *RIBEntry
+	}{
+		{
+			name: "weight",
+			a:    with(route(ebgp2, 65003, 65010, 65011), func(e *RIBEntry) { e.Weight = 100 }),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.LocalPref = 200 }),
+		},
+		{
+			name: "local preference",
+			a:    with(route(ebgp2, 65003, 65010, 65011), func(e *RIBEntry) { e.LocalPref = 200 }),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.LocalPref = 100 }),
+		},
+		{
+			name: "locally originated",
+			a:    route(nil),
+			b:    route(ebgp1),
+		},
+		{
+			name: "as path length",
+			a:    with(route(ebgp2, 65003, 65010), func(e *RIBEntry) { e.Origin = OriginAttributeIncomplete }),
+			b:    route(ebgp1, 65002, 65010, 65011),
+		},
+		{
+			name: "as set counts as one",
+			a: with(route(ebgp2), func(e *RIBEntry) {
+				e.ASPath = ASPath{Segments: []ASPathSegment{
+					{Type: ASPathSegmentSequence, ASNs: []uint32{65003}},
+					{Type: ASPathSegmentSet, ASNs: []uint32{65010, 65011, 65012}},
+				}}
+			}),
+			b: route(ebgp1, 65002, 65010, 65011),
+		},
+		{
+			name: "origin",
+			a:    with(route(ebgp2, 65003), func(e *RIBEntry) { e.Origin = OriginAttributeEGP }),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.Origin = OriginAttributeIncomplete }),
+		},
+		{
+			name: "med from same neighbor as",
+			a:    with(route(ebgp3, 65002), func(e *RIBEntry) { e.MED = med(10) }),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.MED = med(20) }),
+		},
+		{
+			name: "missing med is zero",
+			a:    route(ebgp3, 65002),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.MED = med(10) }),
+		},
+		{
+			name: "med from different neighbor as",
+			a:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.MED = med(100) }),
+			b:    with(route(ebgp2, 65003), func(e *RIBEntry) { e.MED = med(0) }),
+		},
+		{
+			name: "ebgp over ibgp",
+			a:    route(ebgp3, 65002),
+			b:    route(ibgp, 65002),
+		},
+		{
+			name: "router id",
+			a:    with(route(ebgp2, 65003), func(e *RIBEntry) { e.PeerRouterID = [4]byte{192, 0, 2, 1} }),
+			b:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.PeerRouterID = [4]byte{192, 0, 2, 2} }),
+		},
+		{
+			// 同じルーターと 2 つのセッションを張っている場合
+			name: "peer address",
+			a:    with(route(ebgp1, 65002), func(e *RIBEntry) { e.PeerRouterID = [4]byte{192, 0, 2, 1} }),
+			b:    with(route(ebgp3, 65002), func(e *RIBEntry) { e.PeerRouterID = [4]byte{192, 0, 2, 1} }),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !betterPath(tt.a, tt.b) {
+				t.Errorf("betterPath(a, b) = false, want true")
+			}
+			if betterPath(tt.b, tt.a) {
+				t.Errorf("betterPath(b, a) = true, want false")
+			}
+		})
+	}
+}
+
+func TestBestPathMEDNotComparable(t *testing.T) {
+	var (
+		ebgp1  = testBestPathPeer("10.0.0.2", 65002)
+		ebgp2  = testBestPathPeer("10.0.0.3", 65003)
+		ebgp3  = testBestPathPeer("10.0.0.5", 65002)
+		prefix = mustParseCIDR(t, "10.10.0.0/16")
+	)
+	route := func(source *Peer, id byte, med MultiExitDisc) *RIBEntry {
+		return &RIBEntry{
+			AF:           IPv4Unicast,
+			Prefix:       prefix,
+			Origin:       OriginAttributeIGP,
+			ASPath:       NewASPath(uint32(source.RemoteAS)),
+			MED:          &med,
+			PeerRouterID: [4]byte{192, 0, 2, id},
+			Source:       source,
+		}
+	}
+	// a > b (Router ID)、b > c (Router ID)、c > a (MED) と順序が循環する
+	a := route(ebgp1, 1, 100)
+	b := route(ebgp2, 2, 0)
+	c := route(ebgp3, 3, 50)
+
+	// Loc-RIB は経路を送信元の順に並べて選ぶので、受け取った順によらず同じ経路を同じ順に並べる
+	paths := map[rune]*RIBEntry{'a': a, 'b': b, 'c': c}
+	var wantRanked []*RIBEntry
+	for _, order := range []string{"abc", "acb", "bac", "bca", "cab", "cba"} {
+		rib := NewRIB()
+		for _, r := range order {
+			rib.Update(paths[r])
+		}
+		best := rib.Find(prefix)
+		if best != c {
+			t.Errorf("order %s: best = %v, want %v", order, best.PeerRouterID, c.PeerRouterID)
+		}
+		ranked := rankPaths(rib.Paths(), best)
+		if wantRanked == nil {
+			wantRanked = ranked
+			continue
+		}
+		for i := range ranked {
+			if ranked[i] != wantRanked[i] {
+				t.Errorf("order %s: ranked[%d] = %v, want %v", order, i, ranked[i].PeerRouterID, wantRanked[i].PeerRouterID)
+			}
+		}
+	}
+}
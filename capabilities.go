@@ -1,23 +1,468 @@
 package main
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RFC 5492: Capabilities Advertisement with BGP-4
+
+type CapabilityCode uint8
+
+const (
+	CapabilityCodeMultiprotocolExtensions CapabilityCode = 1
+	CapabilityCodeRouteRefresh            CapabilityCode = 2  // RFC 2918
+	CapabilityCodeExtendedMessage         CapabilityCode = 6  // RFC 8654
+	CapabilityCodeGracefulRestart         CapabilityCode = 64 // RFC 4724
+	CapabilityCodeFourOctetAS             CapabilityCode = 65
+	CapabilityCodeAddPath                 CapabilityCode = 69 // RFC 7911
+	CapabilityCodeEnhancedRouteRefresh    CapabilityCode = 70 // RFC 7313
+)
+
+const optionalParameterTypeCapability = 2
+
+type Capability interface {
+	Code() CapabilityCode
+	Value() []byte
+}
+
+// ParseOptionalParameters は OPEN の Optional Parameters に含まれる capability を全てパースする
+func ParseOptionalParameters(b []byte) ([]Capability, error) {
+	var caps []Capability
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, openMessageError("too short optional parameter: %d", len(b))
+		}
+		paramType, paramLength := b[0], int(b[1])
+		if len(b) < 2+paramLength {
+			return nil, openMessageError("invalid optional parameter length: %d (remaining %d)", paramLength, len(b)-2)
+		}
+		param := b[2 : 2+paramLength]
+		b = b[2+paramLength:]
+
+		if paramType != optionalParameterTypeCapability {
+			return nil, NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeUnsupportedOptionalParameter, nil,
+				"unsupported optional parameter: %d", paramType)
+		}
+		// 1 つの Optional Parameter に複数の capability が入っていることがある
+		for len(param) > 0 {
+			if len(param) < 2 {
+				return nil, openMessageError("too short capability: %d", len(param))
+			}
+			code, length := CapabilityCode(param[0]), int(param[1])
+			if len(param) < 2+length {
+				return nil, openMessageError("invalid capability length: code = %d, length = %d", code, length)
+			}
+			c, err := ParseCapability(code, param[2:2+length])
+			if err != nil {
+				return nil, openMessageError("capability: %v", err)
+			}
+			caps = append(caps, c)
+			param = param[2+length:]
+		}
+	}
+	return caps, nil
+}
+
+func ParseCapability(code CapabilityCode, value []byte) (Capability, error) {
+	switch code {
+	case CapabilityCodeMultiprotocolExtensions:
+		return ParseMultiprotocolExtensionCapability(value)
+	case CapabilityCodeRouteRefresh:
+		return ParseRouteRefreshCapability(value)
+	case CapabilityCodeExtendedMessage:
+		return ParseExtendedMessageCapability(value)
+	case CapabilityCodeGracefulRestart:
+		return ParseGracefulRestartCapability(value)
+	case CapabilityCodeFourOctetAS:
+		return ParseFourOctetASCapability(value)
+	case CapabilityCodeAddPath:
+		return ParseAddPathCapability(value)
+	case CapabilityCodeEnhancedRouteRefresh:
+		return ParseEnhancedRouteRefreshCapability(value)
+	default:
+		v := make([]byte, len(value))
+		copy(v, value)
+		return UnknownCapability{CapabilityCode: code, Data: v}, nil
+	}
+}
+
+// capabilityTuple は Capability Code, Capability Length, Capability Value の組を作る
+func capabilityTuple(c Capability) []byte {
+	v := c.Value()
+	return append([]byte{uint8(c.Code()), uint8(len(v))}, v...)
+}
+
+// CapabilitiesToOptionalParameters は capability を 1 つずつ Optional Parameter にする
+func CapabilitiesToOptionalParameters(caps []Capability) []byte {
+	var b []byte
+	for _, c := range caps {
+		t := capabilityTuple(c)
+		b = append(b, optionalParameterTypeCapability, uint8(len(t)))
+		b = append(b, t...)
+	}
+	return b
+}
+
+type UnknownCapability struct {
+	CapabilityCode CapabilityCode
+	Data           []byte
+}
+
+func (c UnknownCapability) Code() CapabilityCode {
+	return c.CapabilityCode
+}
+
+func (c UnknownCapability) Value() []byte {
+	return c.Data
+}
 
 type MultiprotocolExtensionCapability struct {
 	AddressFamily AddressFamily
 }
 
-func (c MultiprotocolExtensionCapability) ToOptionalParameter() []byte {
+func ParseMultiprotocolExtensionCapability(b []byte) (MultiprotocolExtensionCapability, error) {
+	if len(b) != 4 {
+		return MultiprotocolExtensionCapability{}, fmt.Errorf("invalid multiprotocol extensions capability length: %d", len(b))
+	}
+	return MultiprotocolExtensionCapability{
+		AddressFamily: AddressFamily{
+			AFI:  AFI(binary.BigEndian.Uint16(b[0:2])),
+			SAFI: SAFI(b[3]),
+		},
+	}, nil
+}
+
+func (c MultiprotocolExtensionCapability) Code() CapabilityCode {
+	return CapabilityCodeMultiprotocolExtensions
+}
+
+func (c MultiprotocolExtensionCapability) Value() []byte {
 	b := []byte{
-		2, // 0: Parameter Type: 2 = Capability
-		6, // 1: Parameter Length
-		1, // 2: Capability Code: 1 = Multiprotocol Extensions
-		4, // 3: Capability Length
-		0, // 4: AFI
-		0, // 5: AFI
-		0, // 6: Reserved
-		0, // 7: SAFI
-	}
-	binary.BigEndian.PutUint16(b[4:6], uint16(c.AddressFamily.AFI))
-	b[7] = uint8(c.AddressFamily.SAFI)
+		0, // 0: AFI
+		0, // 1: AFI
+		0, // 2: Reserved
+		0, // 3: SAFI
+	}
+	binary.BigEndian.PutUint16(b[0:2], uint16(c.AddressFamily.AFI))
+	b[3] = uint8(c.AddressFamily.SAFI)
 	return b
 }
+
+type FourOctetASCapability struct {
+	AS uint32
+}
+
+func ParseFourOctetASCapability(b []byte) (FourOctetASCapability, error) {
+	if len(b) != 4 {
+		return FourOctetASCapability{}, fmt.Errorf("invalid 4-octet AS capability length: %d", len(b))
+	}
+	return FourOctetASCapability{AS: binary.BigEndian.Uint32(b)}, nil
+}
+
+func (c FourOctetASCapability) Code() CapabilityCode {
+	return CapabilityCodeFourOctetAS
+}
+
+func (c FourOctetASCapability) Value() []byte {
+	return binary.BigEndian.AppendUint32(nil, c.AS)
+}
+
+type RouteRefreshCapability struct{}
+
+func ParseRouteRefreshCapability(b []byte) (RouteRefreshCapability, error) {
+	if len(b) != 0 {
+		return RouteRefreshCapability{}, fmt.Errorf("invalid route refresh capability length: %d", len(b))
+	}
+	return RouteRefreshCapability{}, nil
+}
+
+func (c RouteRefreshCapability) Code() CapabilityCode {
+	return CapabilityCodeRouteRefresh
+}
+
+func (c RouteRefreshCapability) Value() []byte {
+	return nil
+}
+
+type EnhancedRouteRefreshCapability struct{}
+
+func ParseEnhancedRouteRefreshCapability(b []byte) (EnhancedRouteRefreshCapability, error) {
+	if len(b) != 0 {
+		return EnhancedRouteRefreshCapability{}, fmt.Errorf("invalid enhanced route refresh capability length: %d", len(b))
+	}
+	return EnhancedRouteRefreshCapability{}, nil
+}
+
+func (c EnhancedRouteRefreshCapability) Code() CapabilityCode {
+	return CapabilityCodeEnhancedRouteRefresh
+}
+
+func (c EnhancedRouteRefreshCapability) Value() []byte {
+	return nil
+}
+
+// ExtendedMessageCapability は OPEN と KEEPALIVE 以外のメッセージを 65535 byte まで受け取れることを示す
+type ExtendedMessageCapability struct{}
+
+func ParseExtendedMessageCapability(b []byte) (ExtendedMessageCapability, error) {
+	if len(b) != 0 {
+		return ExtendedMessageCapability{}, fmt.Errorf("invalid extended message capability length: %d", len(b))
+	}
+	return ExtendedMessageCapability{}, nil
+}
+
+func (c ExtendedMessageCapability) Code() CapabilityCode {
+	return CapabilityCodeExtendedMessage
+}
+
+func (c ExtendedMessageCapability) Value() []byte {
+	return nil
+}
+
+// GracefulRestartCapability は再起動の間も相手に経路を残しておいてもらうための capability (RFC 4724 3)
+type GracefulRestartCapability struct {
+	Restarting      bool   // Restart State (R): 再起動した直後か
+	RestartTime     uint16 // 再起動してからセッションを張り直すまでにかかる時間 (秒, 12 bit)
+	AddressFamilies []GracefulRestartAddressFamily
+}
+
+type GracefulRestartAddressFamily struct {
+	AF                  AddressFamily
+	ForwardingPreserved bool // Forwarding State (F): 再起動の間も転送を続けていたか
+}
+
+func ParseGracefulRestartCapability(b []byte) (GracefulRestartCapability, error) {
+	if len(b) < 2 || (len(b)-2)%4 != 0 {
+		return GracefulRestartCapability{}, fmt.Errorf("invalid graceful restart capability length: %d", len(b))
+	}
+	c := GracefulRestartCapability{
+		Restarting:  b[0]&0x80 != 0,
+		RestartTime: binary.BigEndian.Uint16(b[0:2]) & 0x0FFF,
+	}
+	for b = b[2:]; len(b) > 0; b = b[4:] {
+		c.AddressFamilies = append(c.AddressFamilies, GracefulRestartAddressFamily{
+			AF: AddressFamily{
+				AFI:  AFI(binary.BigEndian.Uint16(b[0:2])),
+				SAFI: SAFI(b[2]),
+			},
+			ForwardingPreserved: b[3]&0x80 != 0,
+		})
+	}
+	return c, nil
+}
+
+func (c GracefulRestartCapability) Code() CapabilityCode {
+	return CapabilityCodeGracefulRestart
+}
+
+func (c GracefulRestartCapability) Value() []byte {
+	flags := c.RestartTime & 0x0FFF
+	if c.Restarting {
+		flags |= 0x8000
+	}
+	b := binary.BigEndian.AppendUint16(nil, flags)
+	for _, f := range c.AddressFamilies {
+		var afFlags uint8
+		if f.ForwardingPreserved {
+			afFlags |= 0x80
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(f.AF.AFI))
+		b = append(b, uint8(f.AF.SAFI), afFlags)
+	}
+	return b
+}
+
+// ForwardingPreserved は af が含まれていて、再起動の間も転送を続けていたかを返す
+func (c GracefulRestartCapability) ForwardingPreserved(af AddressFamily) bool {
+	for _, f := range c.AddressFamilies {
+		if f.AF == af {
+			return f.ForwardingPreserved
+		}
+	}
+	return false
+}
+
+// AddPathMode は ADD-PATH で同じ prefix の複数の経路を受け取るか、送るか (RFC 7911 4)
+type AddPathMode uint8
+
+const (
+	AddPathModeReceive AddPathMode = 1
+	AddPathModeSend    AddPathMode = 2
+	AddPathModeBoth    AddPathMode = AddPathModeReceive | AddPathModeSend
+)
+
+// AddPathCapability は address family ごとに、NLRI に Path Identifier を付けて複数の経路を送受信できることを示す
+type AddPathCapability struct {
+	AddressFamilies []AddPathAddressFamily
+}
+
+type AddPathAddressFamily struct {
+	AF   AddressFamily
+	Mode AddPathMode
+}
+
+func ParseAddPathCapability(b []byte) (AddPathCapability, error) {
+	if len(b)%4 != 0 {
+		return AddPathCapability{}, fmt.Errorf("invalid add-path capability length: %d", len(b))
+	}
+	var c AddPathCapability
+	for ; len(b) > 0; b = b[4:] {
+		c.AddressFamilies = append(c.AddressFamilies, AddPathAddressFamily{
+			AF: AddressFamily{
+				AFI:  AFI(binary.BigEndian.Uint16(b[0:2])),
+				SAFI: SAFI(b[2]),
+			},
+			Mode: AddPathMode(b[3]),
+		})
+	}
+	return c, nil
+}
+
+func (c AddPathCapability) Code() CapabilityCode {
+	return CapabilityCodeAddPath
+}
+
+func (c AddPathCapability) Value() []byte {
+	var b []byte
+	for _, f := range c.AddressFamilies {
+		b = binary.BigEndian.AppendUint16(b, uint16(f.AF.AFI))
+		b = append(b, uint8(f.AF.SAFI), uint8(f.Mode))
+	}
+	return b
+}
+
+// Mode は af の Send/Receive を返す (含まれていなければ 0)
+func (c AddPathCapability) Mode(af AddressFamily) AddPathMode {
+	for _, f := range c.AddressFamilies {
+		// 1 ~ 3 以外の値は知らないものとして無視する (RFC 7911 4)
+		if f.AF == af && f.Mode >= AddPathModeReceive && f.Mode <= AddPathModeBoth {
+			return f.Mode
+		}
+	}
+	return 0
+}
+
+// NegotiatedCapabilities は自分と相手の両方が広報した capability から決まる、セッションで使う機能
+type NegotiatedCapabilities struct {
+	AddressFamilies map[AddressFamily]struct{}
+	FourOctetAS     bool
+
+	// ROUTE-REFRESH を送ってよいか (相手も Enhanced Route Refresh に対応していれば BoRR, EoRR も使う)
+	RouteRefresh         bool
+	EnhancedRouteRefresh bool
+
+	// 4096 byte より大きいメッセージを送受信してよいか (両方が Extended Message capability を広報した)
+	ExtendedMessage bool
+
+	// 両方が Graceful Restart capability を広報したか (RemoteGracefulRestart は相手の capability)
+	GracefulRestart       bool
+	RemoteGracefulRestart GracefulRestartCapability
+
+	// ADD-PATH で Path Identifier を付けて受け取る (Receive)、付けて送る (Send) address family
+	AddPath map[AddressFamily]AddPathMode
+}
+
+func NegotiateCapabilities(local, remote []Capability) NegotiatedCapabilities {
+	localAFs := capabilityAddressFamilies(local)
+	remoteAFs := capabilityAddressFamilies(remote)
+	n := NegotiatedCapabilities{
+		AddressFamilies: make(map[AddressFamily]struct{}),
+	}
+	for af := range localAFs {
+		if _, ok := remoteAFs[af]; ok {
+			n.AddressFamilies[af] = struct{}{}
+		}
+	}
+	_, localAS4 := findCapability(local, CapabilityCodeFourOctetAS)
+	_, remoteAS4 := findCapability(remote, CapabilityCodeFourOctetAS)
+	n.FourOctetAS = localAS4 && remoteAS4
+	_, localRR := findCapability(local, CapabilityCodeRouteRefresh)
+	_, remoteRR := findCapability(remote, CapabilityCodeRouteRefresh)
+	n.RouteRefresh = localRR && remoteRR
+	_, localERR := findCapability(local, CapabilityCodeEnhancedRouteRefresh)
+	_, remoteERR := findCapability(remote, CapabilityCodeEnhancedRouteRefresh)
+	n.EnhancedRouteRefresh = n.RouteRefresh && localERR && remoteERR
+	_, localEM := findCapability(local, CapabilityCodeExtendedMessage)
+	_, remoteEM := findCapability(remote, CapabilityCodeExtendedMessage)
+	n.ExtendedMessage = localEM && remoteEM
+	_, localGR := findCapability(local, CapabilityCodeGracefulRestart)
+	remoteGR, ok := findCapability(remote, CapabilityCodeGracefulRestart)
+	if localGR && ok {
+		n.GracefulRestart = true
+		n.RemoteGracefulRestart = remoteGR.(GracefulRestartCapability)
+	}
+	localAddPath, localOK := findCapability(local, CapabilityCodeAddPath)
+	remoteAddPath, remoteOK := findCapability(remote, CapabilityCodeAddPath)
+	if localOK && remoteOK {
+		// 自分が受け取れて相手が送れる方向と、自分が送れて相手が受け取れる方向だけを使う (RFC 7911 4)
+		n.AddPath = make(map[AddressFamily]AddPathMode)
+		for af := range n.AddressFamilies {
+			l, r := localAddPath.(AddPathCapability).Mode(af), remoteAddPath.(AddPathCapability).Mode(af)
+			var m AddPathMode
+			if l&AddPathModeReceive != 0 && r&AddPathModeSend != 0 {
+				m |= AddPathModeReceive
+			}
+			if l&AddPathModeSend != 0 && r&AddPathModeReceive != 0 {
+				m |= AddPathModeSend
+			}
+			if m != 0 {
+				n.AddPath[af] = m
+			}
+		}
+	}
+	return n
+}
+
+// capabilityAddressFamilies は Multiprotocol Extensions capability に含まれる address family を返す
+func capabilityAddressFamilies(caps []Capability) map[AddressFamily]struct{} {
+	afs := make(map[AddressFamily]struct{})
+	for _, c := range caps {
+		if c, ok := c.(MultiprotocolExtensionCapability); ok {
+			afs[c.AddressFamily] = struct{}{}
+		}
+	}
+	if len(afs) == 0 {
+		// Multiprotocol Extensions capability が無い場合は IPv4 Unicast のみとみなす (RFC 4760 8)
+		afs[IPv4Unicast] = struct{}{}
+	}
+	return afs
+}
+
+func findCapability(caps []Capability, code CapabilityCode) (Capability, bool) {
+	for _, c := range caps {
+		if c.Code() == code {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func (n NegotiatedCapabilities) HasAddressFamily(af AddressFamily) bool {
+	_, ok := n.AddressFamilies[af]
+	return ok
+}
+
+// AddPathReceive は af で相手が Path Identifier を付けて送ってくるかを返す
+func (n NegotiatedCapabilities) AddPathReceive(af AddressFamily) bool {
+	return n.AddPath[af]&AddPathModeReceive != 0
+}
+
+// AddPathSend は af で Path Identifier を付けて送るかを返す
+func (n NegotiatedCapabilities) AddPathSend(af AddressFamily) bool {
+	return n.AddPath[af]&AddPathModeSend != 0
+}
+
+// ReadOptions は相手から受け取るメッセージの読み方を返す
+func (n NegotiatedCapabilities) ReadOptions() ReadOptions {
+	opts := ReadOptions{
+		AddPath:         make(map[AddressFamily]bool),
+		ExtendedMessage: n.ExtendedMessage,
+	}
+	for af := range n.AddPath {
+		if n.AddPathReceive(af) {
+			opts.AddPath[af] = true
+		}
+	}
+	return opts
+}
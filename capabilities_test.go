@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	mp := func(afs ...AddressFamily) []Capability {
+		var caps []Capability
+		for _, af := range afs {
+			caps = append(caps, MultiprotocolExtensionCapability{af})
+		}
+		return caps
+	}
+	afSet := func(afs ...AddressFamily) map[AddressFamily]struct{} {
+		m := make(map[AddressFamily]struct{})
+		for _, af := range afs {
+			m[af] = struct{}{}
+		}
+		return m
+	}
+	ipv4Multicast := AddressFamily{AFI: AFIIPv4, SAFI: 2} // 自分は対応していない address family
+	addPath := func(afs ...AddPathAddressFamily) Capability {
+		return AddPathCapability{AddressFamilies: afs}
+	}
+
+	tests := []struct {
+		name          string
+		local, remote []Capability
+		want          NegotiatedCapabilities
+	}{
+		{
+			name:   "address families in common",
+			local:  mp(IPv4Unicast, IPv6Unicast),
+			remote: mp(IPv6Unicast),
+			want:   NegotiatedCapabilities{AddressFamilies: afSet(IPv6Unicast)},
+		},
+		{
+			// Multiprotocol Extensions capability が無ければ IPv4 Unicast のみ
+			name:   "no multiprotocol extensions",
+			local:  mp(IPv4Unicast, IPv6Unicast),
+			remote: []Capability{FourOctetASCapability{65002}},
+			want:   NegotiatedCapabilities{AddressFamilies: afSet(IPv4Unicast)},
+		},
+		{
+			name:   "no address family in common",
+			local:  mp(IPv6Unicast),
+			remote: mp(IPv4Unicast),
+			want:   NegotiatedCapabilities{AddressFamilies: afSet()},
+		},
+		{
+			name:   "both sides",
+			local:  append(mp(IPv4Unicast), FourOctetASCapability{65001}, RouteRefreshCapability{}, EnhancedRouteRefreshCapability{}, ExtendedMessageCapability{}),
+			remote: append(mp(IPv4Unicast), FourOctetASCapability{65002}, RouteRefreshCapability{}, EnhancedRouteRefreshCapability{}, ExtendedMessageCapability{}),
+			want: NegotiatedCapabilities{
+				AddressFamilies:      afSet(IPv4Unicast),
+				FourOctetAS:          true,
+				RouteRefresh:         true,
+				EnhancedRouteRefresh: true,
+				ExtendedMessage:      true,
+			},
+		},
+		{
+			name:   "one side",
+			local:  append(mp(IPv4Unicast), FourOctetASCapability{65001}, RouteRefreshCapability{}, ExtendedMessageCapability{}),
+			remote: append(mp(IPv4Unicast), EnhancedRouteRefreshCapability{}),
+			want:   NegotiatedCapabilities{AddressFamilies: afSet(IPv4Unicast)},
+		},
+		{
+			// 相手が送れる方向と受け取れる方向だけを、共通の address family で使う
+			name: "add-path",
+			local: append(mp(IPv4Unicast, IPv6Unicast), addPath(
+				AddPathAddressFamily{AF: IPv4Unicast, Mode: AddPathModeBoth},
+				AddPathAddressFamily{AF: IPv6Unicast, Mode: AddPathModeSend},
+			)),
+			remote: append(mp(IPv4Unicast, IPv6Unicast, ipv4Multicast), addPath(
+				AddPathAddressFamily{AF: IPv4Unicast, Mode: AddPathModeSend},
+				AddPathAddressFamily{AF: IPv6Unicast, Mode: AddPathModeSend},
+				AddPathAddressFamily{AF: ipv4Multicast, Mode: AddPathModeBoth},
+			)),
+			want: NegotiatedCapabilities{
+				AddressFamilies: afSet(IPv4Unicast, IPv6Unicast),
+				AddPath:         map[AddressFamily]AddPathMode{IPv4Unicast: AddPathModeReceive},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateCapabilities(tt.local, tt.remote); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NegotiateCapabilities() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenNoAddressFamilyInCommon(t *testing.T) {
+	p := NewPeer(PeerConfig{
+		MyAS:            65001,
+		RouterID:        [4]byte{10, 0, 0, 1},
+		NeighborAddress: "10.0.0.2",
+		RemoteAS:        65002,
+		AddressFamilies: map[AddressFamily]AddressFamilyConfig{
+			IPv6Unicast: {SelfNextHop: net.ParseIP("2001:db8::1"), LocalRIB: NewRIB()},
+		},
+		HoldTime: 90,
+	})
+	p.setState(StateOpenSent)
+
+	err := (OpenMessageEvent{OpenMessage{
+		Version:      4,
+		MyAS:         65002,
+		HoldTime:     90,
+		BGPID:        [4]byte{10, 0, 0, 2},
+		Capabilities: []Capability{MultiprotocolExtensionCapability{IPv4Unicast}, FourOctetASCapability{65002}},
+	}}).Do(p)
+	var nerr *NotificationError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("Do() error = %v, want NotificationError", err)
+	}
+	if nerr.ErrorCode != ErrorCodeOpenMessage || nerr.ErrorSubcode != ErrorSubcodeUnsupportedCapability {
+		t.Errorf("error code = %d, subcode = %d, want Unsupported Capability", nerr.ErrorCode, nerr.ErrorSubcode)
+	}
+	// Data には自分が必要とする Multiprotocol Extensions capability を入れる
+	if want := capabilityTuple(MultiprotocolExtensionCapability{IPv6Unicast}); !bytes.Equal(nerr.Data, want) {
+		t.Errorf("Data = %x, want %x", nerr.Data, want)
+	}
+	if p.State != StateOpenSent {
+		t.Errorf("State = %v, want %v", p.State, StateOpenSent)
+	}
+}
+
+func TestParseOptionalParametersUnknownCapability(t *testing.T) {
+	b := []byte{
+		2, 6, // Capability
+		65, 4, 0, 0, 0xfd, 0xea, // 4-octet AS: 65002
+		2, 8, // 1 つの Optional Parameter に 2 つの capability
+		200, 3, 1, 2, 3, // 未知の capability
+		201, 1, 4, // 未知の capability
+	}
+	caps, err := ParseOptionalParameters(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Capability{
+		FourOctetASCapability{65002},
+		UnknownCapability{CapabilityCode: 200, Data: []byte{1, 2, 3}},
+		UnknownCapability{CapabilityCode: 201, Data: []byte{4}},
+	}
+	if !reflect.DeepEqual(caps, want) {
+		t.Fatalf("ParseOptionalParameters() = %+v, want %+v", caps, want)
+	}
+	// 読んだ値は元のバッファとは別に持つ
+	b[12] = 0
+	if caps[1].Value()[0] != 1 {
+		t.Errorf("unknown capability shares the buffer")
+	}
+
+	// 未知の capability も同じ Code と Value で送り直せる
+	encoded := CapabilitiesToOptionalParameters(caps)
+	got, err := ParseOptionalParameters(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseOptionalParameters(%x) = %+v, want %+v", encoded, got, want)
+	}
+}
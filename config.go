@@ -2,77 +2,439 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type Config struct {
-	Networks []*net.IPNet
-	Peer     PeerConfig
+	MyAS          uint32
+	RouterID      [4]byte
+	Networks      []*net.IPNet
+	ListenAddress string
+	Peers         []PeerConfig
+
+	GracefulRestart GracefulRestartConfig
+}
+
+// configJSON は設定ファイルの形 (YAML, TOML の場合も同じ形にしてから読み込む。
+// yaml, toml のタグは書き出すときに使うので、json のタグと揃える。toml の omitempty は 0 を省略しないので、数値は omitzero にする)
+type configJSON struct {
+	MyAS          uint32           `json:"as" yaml:"as" toml:"as"`
+	RouterID      string           `json:"router_id" yaml:"router_id" toml:"router_id"`
+	Networks      []string         `json:"networks" yaml:"networks" toml:"networks"`
+	ListenAddress *string          `json:"listen_address,omitempty" yaml:"listen_address,omitempty" toml:"listen_address,omitempty"`
+	Neighbors     []neighborConfig `json:"neighbors" yaml:"neighbors" toml:"neighbors"`
+
+	GracefulRestart *gracefulRestartConfig `json:"graceful_restart,omitempty" yaml:"graceful_restart,omitempty" toml:"graceful_restart,omitempty"`
+}
+
+// gracefulRestartConfig は Graceful Restart の設定 (書いてあれば有効にする)
+type gracefulRestartConfig struct {
+	RestartTime     *uint16 `json:"restart_time,omitempty" yaml:"restart_time,omitempty" toml:"restart_time,omitempty"`
+	StaleRoutesTime *uint16 `json:"stale_routes_time,omitempty" yaml:"stale_routes_time,omitempty" toml:"stale_routes_time,omitempty"`
+}
+
+type neighborConfig struct {
+	Address  string  `json:"address" yaml:"address" toml:"address"`
+	RemoteAS uint32  `json:"remote_as" yaml:"remote_as" toml:"remote_as"`
+	Passive  bool    `json:"passive,omitempty" yaml:"passive,omitempty" toml:"passive,omitempty"`
+	Weight   uint32  `json:"weight,omitempty" yaml:"weight,omitempty" toml:"weight,omitzero"`
+	HoldTime *uint16 `json:"hold_time,omitempty" yaml:"hold_time,omitempty" toml:"hold_time,omitempty"`
+
+	ConnectRetryTime *uint16 `json:"connect_retry_time,omitempty" yaml:"connect_retry_time,omitempty" toml:"connect_retry_time,omitempty"`
+
+	AddressFamilies map[string]neighborAddressFamilyConfig `json:"address_families" yaml:"address_families" toml:"address_families"`
+}
+
+type neighborAddressFamilyConfig struct {
+	NextHop string         `json:"next_hop" yaml:"next_hop" toml:"next_hop"`
+	AddPath *addPathConfig `json:"add_path,omitempty" yaml:"add_path,omitempty" toml:"add_path,omitempty"`
+}
+
+// addPathConfig は ADD-PATH の設定
+type addPathConfig struct {
+	Receive bool `json:"receive,omitempty" yaml:"receive,omitempty" toml:"receive,omitempty"`
+	// Send は送る経路: "all" (全て) または "best" (良い方から BestPaths 個)。省略すると ADD-PATH を使わずに最適経路だけを送る
+	Send      string `json:"send,omitempty" yaml:"send,omitempty" toml:"send,omitempty"`
+	BestPaths *uint8 `json:"best_paths,omitempty" yaml:"best_paths,omitempty" toml:"best_paths,omitempty"`
+}
+
+// ConfigError は設定ファイルの全ての問題
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+// ConfigProblem は設定ファイルの 1 つの問題
+type ConfigProblem struct {
+	Path string // JSON での場所 (例: neighbors[0].address_families.ipv6-unicast.next_hop)
+	Err  error
+}
+
+func (p ConfigProblem) String() string {
+	if p.Path == "" {
+		return p.Err.Error()
+	}
+	return p.Path + ": " + p.Err.Error()
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problems in config:", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+func (e *ConfigError) add(path string, format string, a ...interface{}) {
+	e.Problems = append(e.Problems, ConfigProblem{Path: path, Err: fmt.Errorf(format, a...)})
 }
 
-func LoadConfig(r io.Reader, ribs map[AddressFamily]*RIB) (Config, error) {
-	var aux struct {
-		Networks []string `json:"networks"`
-		Peer     struct {
-			MyAS     uint16 `json:"as"`
-			RouterID string `json:"router_id"`
-			Neighbor string `json:"neighbor"`
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
 
-			AddressFamilies map[string]struct {
-				NextHop string `json:"next_hop"`
-			} `json:"address_families"`
-		} `json:"peer"`
+// LoadConfig は format の設定を読み込む。問題があれば全ての問題をまとめた *ConfigError を返す
+func LoadConfig(r io.Reader, format ConfigFormat, ribs map[AddressFamily]*RIB) (Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	if format != ConfigFormatJSON {
+		// 同じ形の JSON にして、同じように確かめる
+		v, err := parseConfigFormat(data, format)
+		if err != nil {
+			return Config{}, &ConfigError{Problems: []ConfigProblem{{Err: err}}}
+		}
+		if data, err = json.Marshal(v); err != nil {
+			// 文字列でないキーや Inf, NaN など、JSON で表せない値
+			return Config{}, &ConfigError{Problems: []ConfigProblem{{Err: fmt.Errorf("unsupported value: %w", err)}}}
+		}
 	}
-	if err := json.NewDecoder(r).Decode(&aux); err != nil {
+
+	var errs ConfigError
+	var aux configJSON
+	err = json.Unmarshal(data, &aux)
+	var typeErr *json.UnmarshalTypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return Config{}, &ConfigError{Problems: []ConfigProblem{{Err: fmt.Errorf("offset %d: %w", syntaxErr.Offset, err)}}}
+		}
 		return Config{}, err
 	}
+	checkConfigFields(data, reflect.TypeOf(aux), "", &errs)
+	if typeErr != nil {
+		// 型が違う場合は値が読めていないので、それ以上は確かめない (型の違いは checkConfigFields で全て追加している)
+		return Config{}, &errs
+	}
+
 	cfg := Config{
-		Networks: make([]*net.IPNet, len(aux.Networks)),
-		Peer: PeerConfig{
-			MyAS:            aux.Peer.MyAS,
-			NeighborAddress: aux.Peer.Neighbor,
-			HoldTime:        180,
-		},
+		MyAS:          aux.MyAS,
+		Networks:      make([]*net.IPNet, 0, len(aux.Networks)),
+		ListenAddress: ":179",
+		Peers:         make([]PeerConfig, 0, len(aux.Neighbors)),
+	}
+	if aux.ListenAddress != nil {
+		// 空文字列の場合は接続を受け付けない
+		cfg.ListenAddress = *aux.ListenAddress
+	}
+	if cfg.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+			errs.add("listen_address", "invalid address: %q", cfg.ListenAddress)
+		}
+	}
+
+	if aux.MyAS == 0 {
+		errs.add("as", "must be specified")
+	}
+	var routerID [4]byte
+	if id := net.ParseIP(aux.RouterID).To4(); id == nil {
+		errs.add("router_id", "invalid router id: %q", aux.RouterID)
+	} else if id.Equal(net.IPv4zero) {
+		errs.add("router_id", "must not be 0.0.0.0")
+	} else {
+		copy(routerID[:], id)
+	}
+	cfg.RouterID = routerID
+
+	if gr := aux.GracefulRestart; gr != nil {
+		cfg.GracefulRestart = GracefulRestartConfig{
+			Enabled:         true,
+			RestartTime:     120,
+			StaleRoutesTime: 360,
+		}
+		if gr.RestartTime != nil {
+			cfg.GracefulRestart.RestartTime = *gr.RestartTime
+		}
+		if cfg.GracefulRestart.RestartTime > 4095 {
+			// capability の Restart Time は 12 bit
+			errs.add("graceful_restart.restart_time", "invalid restart time: %d (must be at most 4095)", cfg.GracefulRestart.RestartTime)
+		}
+		if gr.StaleRoutesTime != nil {
+			cfg.GracefulRestart.StaleRoutesTime = *gr.StaleRoutesTime
+		}
+		if cfg.GracefulRestart.StaleRoutesTime == 0 {
+			errs.add("graceful_restart.stale_routes_time", "invalid stale routes time: %d", cfg.GracefulRestart.StaleRoutesTime)
+		}
+	}
+
+	// 設定されている全てのピアの address family
+	configuredAFs := make(map[AddressFamily]struct{})
+	seen := make(map[string]int, len(aux.Neighbors)) // key: 正規化した相手のアドレス, value: index
+	for i, n := range aux.Neighbors {
+		path := fmt.Sprintf("neighbors[%d]", i)
+		for name := range n.AddressFamilies {
+			if af, ok := AddressFamilyFromString(name); ok {
+				configuredAFs[af] = struct{}{}
+			}
+		}
+		pc, ok := loadNeighborConfig(n, path, ribs, &errs)
+		if !ok {
+			continue
+		}
+		key := normalizeAddress(pc.NeighborAddress)
+		if j, ok := seen[key]; ok {
+			errs.add(path+".address", "duplicated neighbor: %q (same as neighbors[%d])", n.Address, j)
+			continue
+		}
+		seen[key] = i
+		// router_id は自分のアドレスから選ぶことが多いので、同じアドレスのピアは自分自身を指している
+		// (相手の BGP Identifier と同じでないかは OPEN を受け取ったときに確かめる)
+		if net.ParseIP(pc.NeighborAddress).Equal(net.IP(routerID[:])) {
+			errs.add(path+".address", "neighbor address %q must not be the same as router_id", n.Address)
+		}
+
+		pc.MyAS = aux.MyAS
+		pc.RouterID = routerID
+		pc.GracefulRestart = cfg.GracefulRestart
+		cfg.Peers = append(cfg.Peers, pc)
 	}
+
+	seenNetworks := make(map[string]int, len(aux.Networks))
 	for i, s := range aux.Networks {
-		_, r, err := net.ParseCIDR(s)
+		path := fmt.Sprintf("networks[%d]", i)
+		_, n, err := net.ParseCIDR(s)
 		if err != nil {
-			return Config{}, fmt.Errorf("network cidr: %w", err)
+			errs.add(path, "invalid cidr: %q", s)
+			continue
+		}
+		if j, ok := seenNetworks[n.String()]; ok {
+			errs.add(path, "duplicated network: %v (same as networks[%d])", n, j)
+			continue
 		}
-		cfg.Networks[i] = r
+		seenNetworks[n.String()] = i
+		if err := checkNetworkAddressFamily(n, configuredAFs, len(aux.Neighbors) > 0); err != nil {
+			errs.add(path, "%v", err)
+		}
+		cfg.Networks = append(cfg.Networks, n)
+	}
+
+	if len(errs.Problems) > 0 {
+		return Config{}, &errs
+	}
+	return cfg, nil
+}
+
+// loadNeighborConfig は path にある neighbor の設定を読み込む。問題があれば errs に追加して false を返す
+func loadNeighborConfig(n neighborConfig, path string, ribs map[AddressFamily]*RIB, errs *ConfigError) (PeerConfig, bool) {
+	problems := len(errs.Problems)
+	cfg := PeerConfig{
+		NeighborAddress:  n.Address,
+		RemoteAS:         n.RemoteAS,
+		Passive:          n.Passive,
+		Weight:           n.Weight,
+		HoldTime:         180,
+		ConnectRetryTime: 120,
 	}
 
-	id := net.ParseIP(aux.Peer.RouterID).To4()
-	if id == nil || len(id) != 4 {
-		return Config{}, fmt.Errorf("invalid router id: %q", aux.Peer.RouterID)
+	if net.ParseIP(cfg.NeighborAddress) == nil {
+		errs.add(path+".address", "invalid neighbor address: %q", cfg.NeighborAddress)
 	}
-	copy(cfg.Peer.RouterID[:], id)
 
-	cfg.Peer.AddressFamilies = make(map[AddressFamily]AddressFamilyConfig, len(aux.Peer.AddressFamilies))
-	for name, v := range aux.Peer.AddressFamilies {
+	if n.HoldTime != nil {
+		cfg.HoldTime = *n.HoldTime
+	}
+	if cfg.HoldTime == 1 || cfg.HoldTime == 2 {
+		errs.add(path+".hold_time", "invalid hold time: %d (must be 0 or at least 3)", cfg.HoldTime)
+	}
+
+	if n.ConnectRetryTime != nil {
+		cfg.ConnectRetryTime = *n.ConnectRetryTime
+	}
+	if cfg.ConnectRetryTime == 0 {
+		errs.add(path+".connect_retry_time", "invalid connect retry time: %d", cfg.ConnectRetryTime)
+	}
+
+	if cfg.RemoteAS == 0 {
+		errs.add(path+".remote_as", "must be specified")
+	}
+
+	cfg.AddressFamilies = make(map[AddressFamily]AddressFamilyConfig, len(n.AddressFamilies))
+	names := make([]string, 0, len(n.AddressFamilies))
+	for name := range n.AddressFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := n.AddressFamilies[name]
+		afPath := joinConfigPath(path+".address_families", name)
 		af, ok := AddressFamilyFromString(name)
 		if !ok {
-			return Config{}, fmt.Errorf("invalid address family name: %q", name)
+			errs.add(afPath, "invalid address family name: %q", name)
+			continue
 		}
 
+		// NEXT_HOP は address family と同じ種類のアドレスでなければならない
 		nextHop := net.ParseIP(v.NextHop)
-		if af.NextHopSize() == 4 {
-			nextHop = nextHop.To4()
+		switch {
+		case nextHop == nil:
+			errs.add(afPath+".next_hop", "invalid next hop: %q", v.NextHop)
+			continue
+		case af.NextHopSize() == net.IPv4len && nextHop.To4() == nil:
+			errs.add(afPath+".next_hop", "not an IPv4 address: %q", v.NextHop)
+			continue
+		case af.NextHopSize() == net.IPv6len && nextHop.To4() != nil:
+			errs.add(afPath+".next_hop", "not an IPv6 address: %q", v.NextHop)
+			continue
 		}
-		if nextHop == nil {
-			return Config{}, fmt.Errorf("invalid next hop: %q", v.NextHop)
+		if af.NextHopSize() == net.IPv4len {
+			nextHop = nextHop.To4()
 		}
-		if len(nextHop) != af.NextHopSize() {
-			return Config{}, fmt.Errorf("invalid next hop length: %q (%d)", nextHop, len(nextHop))
+
+		addPath, ok := loadAddPathConfig(v.AddPath, afPath+".add_path", errs)
+		if !ok {
+			continue
 		}
 
-		cfg.Peer.AddressFamilies[af] = AddressFamilyConfig{
+		// 全てのピアで address family ごとの RIB を共有する
+		cfg.AddressFamilies[af] = AddressFamilyConfig{
 			SelfNextHop: nextHop,
 			LocalRIB:    ribs[af],
+			AddPath:     addPath,
 		}
 	}
 
-	return cfg, nil
+	return cfg, len(errs.Problems) == problems
+}
+
+// loadAddPathConfig は path にある ADD-PATH の設定を読み込む (無ければ使わない)。問題があれば errs に追加して false を返す
+func loadAddPathConfig(v *addPathConfig, path string, errs *ConfigError) (AddPathConfig, bool) {
+	if v == nil {
+		return AddPathConfig{}, true
+	}
+	problems := len(errs.Problems)
+	cfg := AddPathConfig{Receive: v.Receive}
+	switch v.Send {
+	case "":
+	case "all":
+		cfg.Send = true
+	case "best":
+		cfg.Send = true
+		if v.BestPaths == nil {
+			errs.add(path+".best_paths", "must be specified when send is \"best\"")
+		} else if *v.BestPaths == 0 {
+			errs.add(path+".best_paths", "invalid number of paths: %d", *v.BestPaths)
+		} else {
+			cfg.SendMax = int(*v.BestPaths)
+		}
+	default:
+		errs.add(path+".send", "invalid send mode: %q (must be all or best)", v.Send)
+	}
+	if v.BestPaths != nil && v.Send != "best" {
+		errs.add(path+".best_paths", "only valid when send is \"best\"")
+	}
+	return cfg, len(errs.Problems) == problems
+}
+
+// checkConfigFields は data の中に t の json タグにないキーや、t の型として読めない値があれば、その場所を errs に追加する
+// (json.Decoder の DisallowUnknownFields や json.Unmarshal の型のエラーは最初の 1 つしか分からないので自分で確かめる)
+func checkConfigFields(data []byte, t reflect.Type, path string, errs *ConfigError) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			addConfigTypeError(err, "object", path, errs)
+			return
+		}
+		// encoding/json と同じく大文字小文字は区別しない
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				fields[strings.ToLower(name)] = f.Type
+			}
+		}
+		for _, key := range sortedConfigKeys(m) {
+			ft, ok := fields[strings.ToLower(key)]
+			if !ok {
+				errs.add(joinConfigPath(path, key), "unknown field")
+				continue
+			}
+			checkConfigFields(m[key], ft, joinConfigPath(path, key), errs)
+		}
+	case reflect.Slice:
+		var s []json.RawMessage
+		if err := json.Unmarshal(data, &s); err != nil {
+			addConfigTypeError(err, "array", path, errs)
+			return
+		}
+		for i, v := range s {
+			checkConfigFields(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			addConfigTypeError(err, "object", path, errs)
+			return
+		}
+		for _, key := range sortedConfigKeys(m) {
+			checkConfigFields(m[key], t.Elem(), joinConfigPath(path, key), errs)
+		}
+	default:
+		addConfigTypeError(json.Unmarshal(data, reflect.New(t).Interface()), t.String(), path, errs)
+	}
+}
+
+// addConfigTypeError は err が値の型の違いであれば、その場所を errs に追加する
+func addConfigTypeError(err error, expected, path string, errs *ConfigError) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		errs.add(path, "invalid value: %v (expected %s)", typeErr.Value, expected)
+	}
+}
+
+func sortedConfigKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkNetworkAddressFamily は自分で広報するネットワーク n の address family が、いずれかのピアに設定されているかを確かめる。
+// ピアが無い (後から追加する) 場合は確かめない
+func checkNetworkAddressFamily(n *net.IPNet, configured map[AddressFamily]struct{}, hasPeers bool) error {
+	af := networkAddressFamily(n)
+	if _, ok := configured[af]; !ok && hasPeers {
+		return fmt.Errorf("address family %v is not configured on any neighbor", af)
+	}
+	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFormat は設定ファイルの書式
+type ConfigFormat string
+
+const (
+	ConfigFormatJSON ConfigFormat = "json"
+	ConfigFormatYAML ConfigFormat = "yaml"
+	ConfigFormatTOML ConfigFormat = "toml"
+)
+
+func ParseConfigFormat(s string) (ConfigFormat, error) {
+	switch f := ConfigFormat(strings.ToLower(s)); f {
+	case ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML:
+		return f, nil
+	case "yml":
+		return ConfigFormatYAML, nil
+	default:
+		return "", fmt.Errorf("invalid config format: %q (must be json, yaml or toml)", s)
+	}
+}
+
+// ConfigFormatFromPath はファイルの拡張子から書式を決める (分からなければ JSON)
+func ConfigFormatFromPath(path string) ConfigFormat {
+	if f, err := ParseConfigFormat(strings.TrimPrefix(filepath.Ext(path), ".")); err == nil {
+		return f
+	}
+	return ConfigFormatJSON
+}
+
+// parseConfigFormat は YAML, TOML を JSON と同じ形の値 (map[string]interface{} など) にする
+func parseConfigFormat(data []byte, format ConfigFormat) (interface{}, error) {
+	switch format {
+	case ConfigFormatYAML:
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case ConfigFormatTOML:
+		var v map[string]interface{}
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported config format: %q", format)
+	}
+}
+
+// WriteConfig は cfg を format の設定ファイルとして書き出す (読み込むと同じ設定になる)
+func WriteConfig(w io.Writer, cfg Config, format ConfigFormat) error {
+	v := cfg.toJSON()
+	switch format {
+	case ConfigFormatJSON:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	case ConfigFormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	case ConfigFormatTOML:
+		enc := toml.NewEncoder(w)
+		enc.Indent = ""
+		return enc.Encode(v)
+	default:
+		return fmt.Errorf("unsupported config format: %q", format)
+	}
+}
+
+// toJSON は設定ファイルの形に戻す。既定値のものも省略せずに書く
+func (cfg Config) toJSON() configJSON {
+	listenAddress := cfg.ListenAddress
+	v := configJSON{
+		MyAS:          cfg.MyAS,
+		RouterID:      net.IP(cfg.RouterID[:]).String(),
+		Networks:      make([]string, len(cfg.Networks)),
+		ListenAddress: &listenAddress,
+		Neighbors:     make([]neighborConfig, len(cfg.Peers)),
+	}
+	for i, n := range cfg.Networks {
+		v.Networks[i] = n.String()
+	}
+	if gr := cfg.GracefulRestart; gr.Enabled {
+		v.GracefulRestart = &gracefulRestartConfig{
+			RestartTime:     &gr.RestartTime,
+			StaleRoutesTime: &gr.StaleRoutesTime,
+		}
+	}
+	for i, pc := range cfg.Peers {
+		holdTime, connectRetryTime := pc.HoldTime, pc.ConnectRetryTime
+		n := neighborConfig{
+			Address:          pc.NeighborAddress,
+			RemoteAS:         pc.RemoteAS,
+			Passive:          pc.Passive,
+			Weight:           pc.Weight,
+			HoldTime:         &holdTime,
+			ConnectRetryTime: &connectRetryTime,
+			AddressFamilies:  make(map[string]neighborAddressFamilyConfig, len(pc.AddressFamilies)),
+		}
+		for af, f := range pc.AddressFamilies {
+			n.AddressFamilies[af.String()] = neighborAddressFamilyConfig{
+				NextHop: f.SelfNextHop.String(),
+				AddPath: f.AddPath.toJSON(),
+			}
+		}
+		v.Neighbors[i] = n
+	}
+	return v
+}
+
+// toJSON は ADD-PATH の設定を設定ファイルの形に戻す (使っていなければ nil)
+func (c AddPathConfig) toJSON() *addPathConfig {
+	if !c.Receive && !c.Send {
+		return nil
+	}
+	v := &addPathConfig{Receive: c.Receive}
+	switch {
+	case c.Send && c.SendMax > 0:
+		n := uint8(c.SendMax)
+		v.Send, v.BestPaths = "best", &n
+	case c.Send:
+		v.Send = "all"
+	}
+	return v
+}
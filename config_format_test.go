@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testRIBs() map[AddressFamily]*RIB {
+	return map[AddressFamily]*RIB{
+		IPv4Unicast: NewRIB(),
+		IPv6Unicast: NewRIB(),
+	}
+}
+
+// writeConfigString は cfg を format で書き出す
+func writeConfigString(t *testing.T, cfg Config, format ConfigFormat) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := WriteConfig(&b, cfg, format); err != nil {
+		t.Fatalf("WriteConfig(%s): %v", format, err)
+	}
+	return b.String()
+}
+
+func loadConfigString(t *testing.T, s string, format ConfigFormat) Config {
+	t.Helper()
+	cfg, err := LoadConfig(strings.NewReader(s), format, testRIBs())
+	if err != nil {
+		t.Fatalf("LoadConfig(%s): %v\n%s", format, err, s)
+	}
+	return cfg
+}
+
+const testConfigJSON = `{
+  "as": 65001,
+  "router_id": "10.0.0.1",
+  "networks": ["10.1.0.0/24", "2001:db8:1::/64"],
+  "graceful_restart": {"restart_time": 60},
+  "neighbors": [{
+    "address": "10.0.0.2",
+    "remote_as": 65002,
+    "hold_time": 30,
+    "address_families": {
+      "ipv4-unicast": {"next_hop": "10.0.0.1", "add_path": {"receive": true, "send": "best", "best_paths": 2}},
+      "ipv6-unicast": {"next_hop": "2001:db8::1"}
+    }
+  }, {
+    "address": "10.0.0.3",
+    "remote_as": 65001,
+    "passive": true,
+    "address_families": {"ipv4-unicast": {"next_hop": "10.0.0.1"}}
+  }]
+}`
+
+func TestLoadConfigMatchesJSON(t *testing.T) {
+	// 手で書いた YAML, TOML が JSON と同じ設定になる
+	tests := []struct {
+		format ConfigFormat
+		in     string
+	}{
+		{ConfigFormatYAML, `
+as: 65001
+router_id: 10.0.0.1
+networks: [10.1.0.0/24, "2001:db8:1::/64"]
+graceful_restart: {restart_time: 60}
+neighbors:
+  - address: 10.0.0.2
+    remote_as: 65002
+    hold_time: 30
+    address_families:
+      ipv4-unicast:
+        next_hop: &self 10.0.0.1
+        add_path: {receive: true, send: best, best_paths: 2}
+      ipv6-unicast: {next_hop: "2001:db8::1"}
+  - address: 10.0.0.3
+    remote_as: 65001
+    passive: true
+    address_families:
+      ipv4-unicast: {next_hop: *self}
+`},
+		{ConfigFormatTOML, `
+as = 65001
+router_id = "10.0.0.1"
+networks = ["10.1.0.0/24", "2001:db8:1::/64"]
+graceful_restart = { restart_time = 60 }
+
+[[neighbors]]
+address = """10.0.0.2"""
+remote_as = 65002
+hold_time = 30
+address_families.ipv4-unicast.next_hop = "10.0.0.1"
+address_families.ipv4-unicast.add_path = { receive = true, send = "best", best_paths = 2 }
+
+[neighbors.address_families.ipv6-unicast]
+next_hop = '2001:db8::1'
+
+[[neighbors]]
+address = "10.0.0.3"
+remote_as = 65001
+passive = true
+[neighbors.address_families]
+ipv4-unicast = { next_hop = "10.0.0.1" }
+`},
+	}
+	want := writeConfigString(t, loadConfigString(t, testConfigJSON, ConfigFormatJSON), ConfigFormatJSON)
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			got := writeConfigString(t, loadConfigString(t, tt.in, tt.format), ConfigFormatJSON)
+			if got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigFormatsEquivalent(t *testing.T) {
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{string(data), testConfigJSON} {
+		base := loadConfigString(t, in, ConfigFormatJSON)
+		want := writeConfigString(t, base, ConfigFormatJSON)
+
+		// JSON → YAML → TOML → JSON のように変換しても同じ設定になる
+		for _, formats := range [][]ConfigFormat{
+			{ConfigFormatYAML},
+			{ConfigFormatTOML},
+			{ConfigFormatYAML, ConfigFormatTOML},
+			{ConfigFormatTOML, ConfigFormatYAML},
+		} {
+			cfg := base
+			for _, format := range formats {
+				cfg = loadConfigString(t, writeConfigString(t, cfg, format), format)
+			}
+			if got := writeConfigString(t, cfg, ConfigFormatJSON); got != want {
+				t.Errorf("%v: got\n%s\nwant\n%s", formats, got, want)
+			}
+		}
+	}
+}
+
+func TestLoadConfigFormatErrors(t *testing.T) {
+	tests := []struct {
+		format ConfigFormat
+		in     string
+		want   string // エラーに含まれる文字列
+	}{
+		{ConfigFormatYAML, "as: [1,,2]\n", "yaml:"},
+		{ConfigFormatYAML, "as: 1\nas: 2\n", "already defined"},
+		{ConfigFormatYAML, "router_id: a: b\n", "yaml:"},
+		{ConfigFormatYAML, "as: 65001\nneighbors:\n  - 1: a\n", "neighbors[0].1: unknown field"},
+		{ConfigFormatYAML, "as: .inf\n", "unsupported value"},
+		// 読めても設定の値として正しくなければ、JSON と同じように確かめる
+		{ConfigFormatYAML, "as: 1.5\n", "as: invalid value"},
+		{ConfigFormatYAML, "as: 65001\nfoo: 1\n", "foo: unknown field"},
+		{ConfigFormatTOML, "as = 65001\nas.x = 1\n", "toml:"},
+		{ConfigFormatTOML, "a = b\n", "toml:"},
+		{ConfigFormatTOML, "as = 1.5\n", "as: invalid value"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(strings.NewReader(tt.in), tt.format, testRIBs())
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			t.Errorf("LoadConfig(%q) error = %v, want *ConfigError", tt.in, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadConfig(%q) error = %q, want %q", tt.in, err, tt.want)
+		}
+	}
+}
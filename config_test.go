@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string // 全ての問題 ("場所: エラー")
+	}{
+		{
+			// 型の違う値は最初の 1 つだけでなく全て返す
+			name: "type errors",
+			in: `{
+				"as": "65001",
+				"router_id": "10.0.0.1",
+				"networks": "10.1.0.0/24",
+				"neighbors": [
+					{"address": "10.0.0.2", "remote_as": -1, "address_families": []},
+					{"address": "10.0.0.3", "remote_as": 65003, "hold_time": 65536, "foo": 1}
+				]
+			}`,
+			want: []string{
+				"as: invalid value: string (expected uint32)",
+				"neighbors[0].address_families: invalid value: array (expected object)",
+				"neighbors[0].remote_as: invalid value: number -1 (expected uint32)",
+				"neighbors[1].foo: unknown field",
+				"neighbors[1].hold_time: invalid value: number 65536 (expected uint16)",
+				"networks: invalid value: string (expected array)",
+			},
+		},
+		{
+			name: "neighbor address is router_id",
+			in: `{
+				"as": 65001,
+				"router_id": "10.0.0.1",
+				"neighbors": [{"address": "10.0.0.1", "remote_as": 65002, "address_families": {"ipv4-unicast": {"next_hop": "10.0.0.1"}}}]
+			}`,
+			want: []string{
+				`neighbors[0].address: neighbor address "10.0.0.1" must not be the same as router_id`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(strings.NewReader(tt.in), ConfigFormatJSON, testRIBs())
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("LoadConfig() error = %v, want *ConfigError", err)
+			}
+			var got []string
+			for _, p := range cerr.Problems {
+				got = append(got, fmt.Sprintf("%s: %v", p.Path, p.Err))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Error Code (RFC 4271 4.5, RFC 7313 5)
+const (
+	ErrorCodeMessageHeader uint8 = iota + 1
+	ErrorCodeOpenMessage
+	ErrorCodeUpdateMessage
+	ErrorCodeHoldTimerExpired
+	ErrorCodeFiniteStateMachine
+	ErrorCodeCease
+	ErrorCodeRouteRefreshMessage
+)
+
+// Message Header Error subcodes (RFC 4271 6.1)
+const (
+	ErrorSubcodeConnectionNotSynchronized uint8 = iota + 1
+	ErrorSubcodeBadMessageLength
+	ErrorSubcodeBadMessageType
+)
+
+// OPEN Message Error subcodes (RFC 4271 6.2, RFC 5492 3)
+const (
+	ErrorSubcodeUnsupportedVersionNumber uint8 = iota + 1
+	ErrorSubcodeBadPeerAS
+	ErrorSubcodeBadBGPIdentifier
+	ErrorSubcodeUnsupportedOptionalParameter
+	_ // 5: Deprecated
+	ErrorSubcodeUnacceptableHoldTime
+	ErrorSubcodeUnsupportedCapability
+)
+
+// UPDATE Message Error subcodes (RFC 4271 6.3)
+const (
+	ErrorSubcodeMalformedAttributeList uint8 = iota + 1
+	ErrorSubcodeUnrecognizedWellKnownAttribute
+	ErrorSubcodeMissingWellKnownAttribute
+	ErrorSubcodeAttributeFlagsError
+	ErrorSubcodeAttributeLengthError
+	ErrorSubcodeInvalidOriginAttribute
+	_ // 7: Deprecated
+	ErrorSubcodeInvalidNextHopAttribute
+	ErrorSubcodeOptionalAttributeError
+	ErrorSubcodeInvalidNetworkField
+	ErrorSubcodeMalformedASPath
+)
+
+// Finite State Machine Error subcodes (RFC 6608)
+const (
+	ErrorSubcodeUnexpectedMessageInOpenSent uint8 = iota + 1
+	ErrorSubcodeUnexpectedMessageInOpenConfirm
+	ErrorSubcodeUnexpectedMessageInEstablished
+)
+
+// Cease subcodes (RFC 4486)
+const (
+	ErrorSubcodeMaximumNumberOfPrefixesReached uint8 = iota + 1
+	ErrorSubcodeAdministrativeShutdown
+	ErrorSubcodePeerDeconfigured
+	ErrorSubcodeAdministrativeReset
+	ErrorSubcodeConnectionRejected
+	ErrorSubcodeOtherConfigurationChange
+	ErrorSubcodeConnectionCollisionResolution
+	ErrorSubcodeOutOfResources
+)
+
+// ROUTE-REFRESH Message Error subcodes (RFC 7313 5)
+const (
+	ErrorSubcodeInvalidRouteRefreshMessageLength uint8 = iota + 1
+)
+
+// maxShutdownCommunicationLength は Shutdown Communication の最大のバイト数 (RFC 8203)
+const maxShutdownCommunicationLength = 128
+
+// shutdownCommunicationData は Administrative Shutdown/Reset の NOTIFICATION に載せる
+// Shutdown Communication (長さ 1 バイト + UTF-8 の文字列) を作る。長すぎる場合は文字の途中で切らないように切り詰める
+func shutdownCommunicationData(msg string) []byte {
+	if msg == "" {
+		return nil
+	}
+	for len(msg) > maxShutdownCommunicationLength {
+		_, size := utf8.DecodeLastRuneInString(msg)
+		msg = msg[:len(msg)-size]
+	}
+	return append([]byte{byte(len(msg))}, msg...)
+}
+
+// parseShutdownCommunication は NOTIFICATION の Data から Shutdown Communication を取り出す
+func parseShutdownCommunication(data []byte) (string, bool) {
+	if len(data) < 1 {
+		return "", false
+	}
+	l := int(data[0])
+	if l == 0 || l > maxShutdownCommunicationLength || len(data) < 1+l || !utf8.Valid(data[1:1+l]) {
+		return "", false
+	}
+	return string(data[1 : 1+l]), true
+}
+
+// NotificationError は相手に NOTIFICATION で通知すべきエラー
+// Peer.Run はこのエラーを受け取ると NOTIFICATION を送ってからセッションを終了する
+type NotificationError struct {
+	ErrorCode    uint8
+	ErrorSubcode uint8
+	Data         []byte
+
+	Err error
+}
+
+func NewNotificationError(code, subcode uint8, data []byte, format string, a ...interface{}) *NotificationError {
+	return &NotificationError{
+		ErrorCode:    code,
+		ErrorSubcode: subcode,
+		Data:         data,
+		Err:          fmt.Errorf(format, a...),
+	}
+}
+
+func (e *NotificationError) Error() string {
+	return fmt.Sprintf("%v (error code = %d, subcode = %d)", e.Err, e.ErrorCode, e.ErrorSubcode)
+}
+
+func (e *NotificationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotificationError) Message() NotificationMessage {
+	return NotificationMessage{
+		ErrorCode:    e.ErrorCode,
+		ErrorSubcode: e.ErrorSubcode,
+		Data:         e.Data,
+	}
+}
+
+// openMessageError は subcode を特定できない OPEN Message Error を作る
+func openMessageError(format string, a ...interface{}) *NotificationError {
+	return NewNotificationError(ErrorCodeOpenMessage, 0, nil, format, a...)
+}
+
+// updateMessageError は UPDATE Message Error を作る
+func updateMessageError(subcode uint8, data []byte, format string, a ...interface{}) *NotificationError {
+	return NewNotificationError(ErrorCodeUpdateMessage, subcode, data, format, a...)
+}
+
+// attributeError は問題のあるパス属性そのものを Data に入れた UPDATE Message Error を作る
+func attributeError(subcode uint8, a PathAttribute, format string, args ...interface{}) *NotificationError {
+	buf := new(bytes.Buffer)
+	a.WriteTo(buf)
+	return updateMessageError(subcode, buf.Bytes(), format, args...)
+}
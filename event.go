@@ -1,8 +1,9 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"time"
 )
@@ -12,8 +13,46 @@ type (
 		Do(*Peer) error
 	}
 
-	ManualStartEvent struct{}
-	TcpCRAckedEvent  struct{}
+	ManualStartEvent    struct{}
+	AutomaticStartEvent struct{}
+	// ManualStopEvent は運用者の操作でセッションを止める。
+	// Subcode は送る Cease の subcode (0 の場合は Administrative Shutdown)、
+	// Communication は Administrative Shutdown/Reset で相手に伝える理由 (RFC 8203)
+	// Graceful の場合は Graceful Restart のために NOTIFICATION を送らずにセッションを切り、受け取った経路も残す
+	ManualStopEvent struct {
+		Subcode       uint8
+		Communication string
+		Graceful      bool
+	}
+	// AutomaticStopEvent は設定変更などでセッションを止める。Subcode は送る Cease の subcode
+	AutomaticStopEvent struct {
+		Subcode uint8
+	}
+
+	// ConfigUpdateEvent はセッションを張り直さずに反映できる設定の変更
+	ConfigUpdateEvent struct {
+		Config PeerConfig
+	}
+
+	ConnectRetryTimerExpireEvent struct{}
+
+	// TcpCRAckedEvent は自分から開始した TCP 接続が確立した
+	TcpCRAckedEvent struct {
+		Conn net.Conn
+	}
+	// TcpConnectionConfirmedEvent は相手から TCP 接続を受け付けた
+	TcpConnectionConfirmedEvent struct {
+		Conn net.Conn
+	}
+	TcpConnectionFailsEvent struct {
+		Err error
+	}
+	// CollidingOpenEvent は OpenSent 以降に相手から来た別の接続で OPEN を受け取った (または失敗した)
+	CollidingOpenEvent struct {
+		Conn    net.Conn
+		Message OpenMessage
+		Err     error
+	}
 
 	OpenMessageEvent struct {
 		Message OpenMessage
@@ -24,160 +63,557 @@ type (
 	NotificationMessageEvent struct {
 		Message NotificationMessage
 	}
+	RouteRefreshMessageEvent struct {
+		Message RouteRefreshMessage
+	}
 	KeepaliveMessageEvent struct{}
 
+	// RouteRefreshRequestEvent は運用者の操作で相手に AF の経路を送り直すように求める (送れたかを Result に返す)
+	RouteRefreshRequestEvent struct {
+		AF     AddressFamily
+		Result chan<- error
+	}
+
+	// MessageErrorEvent は受信したメッセージにエラーがあった (BGPHeaderErr, BGPOpenMsgErr, UpdateMsgErr)
+	MessageErrorEvent struct {
+		Err *NotificationError
+	}
+
 	HoldTimerExpireEvent      struct{}
 	KeepaliveTimerExpireEvent struct{}
+	// StaleRoutesTimerExpireEvent は Graceful Restart で残している経路を待つ時間が過ぎた
+	StaleRoutesTimerExpireEvent struct{}
+	// RouteRefreshTimerExpireEvent は AF の BoRR を受け取ってから EoRR を待つ時間が過ぎた
+	RouteRefreshTimerExpireEvent struct {
+		AF AddressFamily
+	}
 
 	LocalRIBUpdateEvent struct {
-		Removed []*net.IPNet
+		Removed []WithdrawnRoute
 		Updated []*RIBEntry
 	}
+	// LocalRIBPathsUpdateEvent は ADD-PATH で送る address family の prefix の経路が変わった。Paths はその prefix の全ての経路 (良い順)
+	LocalRIBPathsUpdateEvent struct {
+		AF     AddressFamily
+		Prefix *net.IPNet
+		Paths  []*RIBEntry
+	}
+	// LocalRIBReplayedEvent は購読を始めたときの AF の Loc-RIB の経路を全て送った
+	LocalRIBReplayedEvent struct {
+		AF AddressFamily
+	}
+)
+
+// errTCPConnectionFails は Established のセッションの TCP 接続が (NOTIFICATION 無しで) 切れた
+var errTCPConnectionFails = errors.New("tcp connection fails")
+
+// RouteRefreshRequestEvent で ROUTE-REFRESH を送れなかった理由
+var (
+	errNotEstablished             = errors.New("session is not established")
+	errRouteRefreshNotNegotiated  = errors.New("neighbor does not support route refresh")
+	errAddressFamilyNotNegotiated = errors.New("address family is not negotiated")
 )
 
+// routeRefreshStaleTime は BoRR を受け取ってから EoRR を待つ時間。
+// 過ぎても EoRR が届かなければ、送り直されなかった経路を消す (RFC 7313 4)
+const routeRefreshStaleTime = 5 * time.Minute
+
 func (e ManualStartEvent) Do(p *Peer) error {
 	if p.State != StateIdle {
-		return fmt.Errorf("unexpected state: %v", p.State)
+		return nil // Idle 以外では無視する
 	}
-	p.setState(StateConnect)
-	var err error
-	if p.conn, err = net.Dial("tcp", net.JoinHostPort(p.NeighborAddress, "179")); err != nil {
-		return err
+	p.automaticStart = true
+	p.connectRetryCounter = 0
+	p.start()
+	return nil
+}
+
+func (e AutomaticStartEvent) Do(p *Peer) error {
+	if p.State != StateIdle || !p.automaticStart {
+		return nil
+	}
+	p.start()
+	return nil
+}
+
+func (e ManualStopEvent) Do(p *Peer) error {
+	p.automaticStart = false
+	if p.idleHoldTimer != nil {
+		p.idleHoldTimer.Stop()
+	}
+	if e.Graceful {
+		if p.State == StateEstablished {
+			// 止めている間に他のピアに取り消しを送らないように、全ての経路を残す
+			for af := range p.AddressFamilies {
+				p.markStale(af)
+			}
+		}
+		p.releaseSession()
+		p.setState(StateIdle)
+		return nil
+	}
+	p.purgeStaleRoutes()
+	if p.State == StateIdle {
+		return nil
+	}
+	subcode := e.Subcode
+	if subcode == 0 {
+		subcode = ErrorSubcodeAdministrativeShutdown
+	}
+	var data []byte
+	if subcode == ErrorSubcodeAdministrativeShutdown || subcode == ErrorSubcodeAdministrativeReset {
+		data = shutdownCommunicationData(e.Communication)
+	}
+	p.stop(subcode, data)
+	p.connectRetryCounter = 0
+	return nil
+}
+
+func (e AutomaticStopEvent) Do(p *Peer) error {
+	p.purgeStaleRoutes()
+	if p.State == StateIdle {
+		return nil
+	}
+	p.stop(e.Subcode, nil)
+	p.connectRetryCounter++
+	p.scheduleAutomaticStart()
+	return nil
+}
+
+func (e ConfigUpdateEvent) Do(p *Peer) error {
+	cfg := e.Config
+	if p.Passive != cfg.Passive {
+		p.Passive = cfg.Passive
+		switch {
+		case p.Passive && p.State == StateConnect:
+			// 接続試行をやめて、相手からの接続を待つ
+			p.releaseSession()
+			p.setState(StateActive)
+		case p.Passive:
+			p.stopConnectRetryTimer()
+		case p.State == StateActive:
+			// ConnectRetryTimer が切れたら自分から接続する
+			p.startConnectRetryTimer()
+		}
+	}
+	p.ConnectRetryTime = cfg.ConnectRetryTime // 次の接続試行から使う
+	p.GracefulRestart.StaleRoutesTime = cfg.GracefulRestart.StaleRoutesTime
+	if p.Weight != cfg.Weight {
+		p.Weight = cfg.Weight
+		p.reapplyAdjRIBIn()
+	}
+	if !sameSelfNextHops(p.AddressFamilies, cfg.AddressFamilies) {
+		p.AddressFamilies = cfg.AddressFamilies
+		if p.State == StateEstablished {
+			// 最初から購読し直して、全ての経路を新しい NEXT_HOP で広報し直す
+			p.unsubscribeLocalRIBs()
+			p.invalidateSentPaths()
+			p.subscribeLocalRIBs()
+		}
 	}
-	p.eventChan <- TcpCRAckedEvent{}
 	return nil
 }
 
+func (e ConnectRetryTimerExpireEvent) Do(p *Peer) error {
+	switch p.State {
+	case StateConnect:
+		// 接続試行をやり直す
+		p.releaseSession()
+		p.connect()
+		p.startConnectRetryTimer()
+		return nil
+	case StateActive:
+		p.connect()
+		p.startConnectRetryTimer()
+		p.setState(StateConnect)
+		return nil
+	default:
+		return p.unexpectedStateError()
+	}
+}
+
 func (e TcpCRAckedEvent) Do(p *Peer) error {
 	if p.State != StateConnect {
-		return fmt.Errorf("unexpected state: %v", p.State)
-	}
-	var opts []byte
-	for af := range p.AddressFamilies {
-		opts = append(opts, MultiprotocolExtensionCapability{af}.ToOptionalParameter()...)
-	}
-	if err := p.sendMessage(OpenMessage{
-		Version:            4,
-		MyAS:               p.MyAS,
-		HoldTime:           p.HoldTime,
-		BGPID:              p.RouterID,
-		OptionalParameters: opts,
-	}); err != nil {
-		return fmt.Errorf("send open message: %w", err)
-	}
-	p.setState(StateOpenSent)
-
-	p.wg.Add(1)
-	go func() {
-		defer p.wg.Done()
-		p.receiveMessages()
-	}()
-	return nil
+		e.Conn.Close()
+		return p.unexpectedStateError()
+	}
+	return p.openSession(e.Conn, true)
+}
+
+func (e TcpConnectionConfirmedEvent) Do(p *Peer) error {
+	switch p.State {
+	case StateConnect, StateActive:
+		return p.openSession(e.Conn, false)
+	case StateOpenSent, StateOpenConfirm:
+		p.logf("connection collision detected: %v", e.Conn.RemoteAddr())
+		p.startCollisionDetection(e.Conn)
+		return nil
+	case StateEstablished:
+		if p.negotiated.GracefulRestart {
+			// 相手が再起動して接続し直してきたので、今のセッションは NOTIFICATION を送らずに閉じ、
+			// 経路を stale として残して新しい接続を使う (RFC 4724 4.2)
+			p.logf("neighbor may have restarted: replace the session with the connection from %v", e.Conn.RemoteAddr())
+			p.retainStaleRoutes()
+			p.releaseSession()
+			p.setState(StateActive)
+			return p.openSession(e.Conn, false)
+		}
+		// 既に確立しているセッションを優先する
+		p.logf("reject incoming connection from %v (already established)", e.Conn.RemoteAddr())
+		p.collidingConns[e.Conn] = struct{}{}
+		p.closeCollidingConn(e.Conn)
+		return nil
+	default:
+		p.logf("reject incoming connection from %v (state = %v)", e.Conn.RemoteAddr(), p.State)
+		e.Conn.Close()
+		return nil
+	}
+}
+
+func (e CollidingOpenEvent) Do(p *Peer) error {
+	if _, ok := p.collidingConns[e.Conn]; !ok {
+		return nil // Run 終了時などに既に閉じている
+	}
+	if e.Err != nil {
+		p.logf("colliding connection from %v fails: %v", e.Conn.RemoteAddr(), e.Err)
+		delete(p.collidingConns, e.Conn)
+		e.Conn.Close()
+		return nil
+	}
+
+	switch p.State {
+	case StateIdle:
+		delete(p.collidingConns, e.Conn)
+		e.Conn.Close()
+		return nil
+	case StateConnect, StateActive:
+		// 元の接続は既に失敗しているので、衝突せずにこちらを使う
+		return p.takeOverCollidingConn(e.Conn, e.Message)
+	case StateOpenSent, StateOpenConfirm:
+		// BGP Identifier が大きい方が開始した接続を残す
+		local := binary.BigEndian.Uint32(p.RouterID[:])
+		remote := binary.BigEndian.Uint32(e.Message.BGPID[:])
+		if local < remote && p.outbound {
+			p.logf("connection collision: close the connection initiated by us")
+			p.notifyError(NewNotificationError(ErrorCodeCease, ErrorSubcodeConnectionCollisionResolution, nil, "connection collision"))
+			p.releaseSession()
+			return p.takeOverCollidingConn(e.Conn, e.Message)
+		}
+		p.logf("connection collision: close the connection initiated by the neighbor")
+		p.closeCollidingConn(e.Conn)
+		return nil
+	default:
+		p.closeCollidingConn(e.Conn)
+		return nil
+	}
+}
+
+func (e TcpConnectionFailsEvent) Do(p *Peer) error {
+	switch p.State {
+	case StateConnect, StateOpenSent:
+		// 相手からの接続を待ちつつ、ConnectRetryTimer が切れたら再度接続する
+		p.logf("tcp connection fails: %v", e.Err)
+		p.releaseSession()
+		p.startConnectRetryTimer()
+		p.setState(StateActive)
+		return nil
+	default:
+		return fmt.Errorf("%w: %v", errTCPConnectionFails, e.Err)
+	}
 }
 
 func (e OpenMessageEvent) Do(p *Peer) error {
 	if p.State != StateOpenSent {
-		return fmt.Errorf("unexpected state: %v", p.State)
+		return p.unexpectedStateError()
+	}
+	m := e.Message
+
+	if m.Version != 4 {
+		// Data にはサポートしているバージョンを入れる
+		return NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeUnsupportedVersionNumber, []byte{0, 4},
+			"unsupported version number: %d", m.Version)
 	}
-	// TODO: 中身ちゃんと見る
+
+	remoteAS := uint32(m.MyAS)
+	if c, ok := findCapability(m.Capabilities, CapabilityCodeFourOctetAS); ok {
+		remoteAS = c.(FourOctetASCapability).AS
+	}
+	if remoteAS != p.RemoteAS {
+		return NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeBadPeerAS, nil,
+			"bad peer AS: expected %d; got %d", p.RemoteAS, remoteAS)
+	}
+
+	// Hold Time は 0 または 3 秒以上でなければならない
+	if m.HoldTime == 1 || m.HoldTime == 2 {
+		return NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeUnacceptableHoldTime, nil,
+			"unacceptable hold time: %d", m.HoldTime)
+	}
+
+	if m.BGPID == [4]byte{} || m.BGPID == p.RouterID {
+		return NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeBadBGPIdentifier, nil,
+			"bad BGP identifier: %v", net.IP(m.BGPID[:]))
+	}
+
+	local := p.localCapabilities()
+	negotiated := NegotiateCapabilities(local, m.Capabilities)
+	if len(negotiated.AddressFamilies) == 0 {
+		// 共通の address family が無いので、こちらが必要とする Multiprotocol Extensions capability を添えて拒否する
+		var data []byte
+		for _, c := range local {
+			if c.Code() == CapabilityCodeMultiprotocolExtensions {
+				data = append(data, capabilityTuple(c)...)
+			}
+		}
+		return NewNotificationError(ErrorCodeOpenMessage, ErrorSubcodeUnsupportedCapability, data,
+			"no address family in common with the neighbor")
+	}
+
+	p.RemoteRouterID = m.BGPID
+	p.remoteCapabilities = m.Capabilities
+	p.negotiated = negotiated
+	p.debugf("negotiated capabilities: %+v", p.negotiated)
+	// 受信する goroutine はヘッダを受け取ってから読み方を読み、相手は KEEPALIVE を受け取るまで UPDATE などを送ってこないので、ここで決めれば間に合う
+	opts := negotiated.ReadOptions()
+	p.readOptions.Store(&opts)
+
+	p.negotiatedHoldTime = p.HoldTime
+	if m.HoldTime < p.negotiatedHoldTime {
+		p.negotiatedHoldTime = m.HoldTime
+	}
+	p.debugf("negotiated hold time: %d", p.negotiatedHoldTime)
+
 	p.setState(StateOpenConfirm)
 	if err := p.sendMessage(KeepaliveMessage{}); err != nil {
 		return fmt.Errorf("send keepalive message: %w", err)
 	}
+	p.startKeepaliveTimer()
+	p.restartHoldTimer()
 	return nil
 }
 
 func (e UpdateMessageEvent) Do(p *Peer) error {
 	if p.State != StateEstablished {
-		return fmt.Errorf("unexpected state: %v", p.State)
+		return p.unexpectedStateError()
+	}
+	p.restartHoldTimer()
+
+	if af, ok := e.Message.EndOfRIB(); ok {
+		if !p.negotiated.HasAddressFamily(af) {
+			p.debugf("ignore end-of-rib for %v (address family is not negotiated)", af)
+			return nil
+		}
+		p.endOfRIBReceived(af)
+		return nil
 	}
+
 	ws, es, err := UpdateMessageToRIBEntries(e.Message, p)
 	if err != nil {
 		return err
 	}
 	for _, r := range ws {
-		rib := p.AddressFamilies[r.AF].LocalRIB
-		e := rib.Find(r.Prefix)
-		if e == nil || e.Source != p {
+		if !p.negotiated.HasAddressFamily(r.AF) {
+			p.debugf("ignore withdrawn route for %v (address family %v is not negotiated)", r.Prefix, r.AF)
 			continue
 		}
-		if err := rib.Remove(e); err != nil {
-			return err
+		if !p.adjRIBIn[r.AF].Remove(r.Prefix, r.PathID) {
+			continue
 		}
+		rib := p.AddressFamilies[r.AF].LocalRIB
+		e := rib.FindPath(r.Prefix, p, r.PathID)
+		if e == nil {
+			continue
+		}
+		rib.Remove(e)
 	}
 	for _, e := range es {
-		rib := p.AddressFamilies[e.AF].LocalRIB
-		curr := rib.Find(e.Prefix)
-		if curr != nil {
-			if len(curr.ASPath.Segments) < len(e.ASPath.Segments) {
-				log.Printf("ignore update for %v (entry in RIB has priority)", e.Prefix)
-				continue
-			}
+		if !p.negotiated.HasAddressFamily(e.AF) {
+			p.debugf("ignore update for %v (address family %v is not negotiated)", e.Prefix, e.AF)
+			continue
 		}
-		if err := rib.Update(e); err != nil {
-			return err
+		p.adjRIBIn[e.AF].Update(e)
+
+		rib := p.AddressFamilies[e.AF].LocalRIB
+		if e.ASPath.Contains(p.MyAS) {
+			// 自分の AS を通ってきた経路はループしているので、取り消しとして扱う (RFC 4271 9.1.2)
+			p.debugf("ignore update for %v (AS loop detected: %v)", e.Prefix, e.ASPath)
+			rib.Remove(e)
+			continue
 		}
+		// 他のピアからの経路と比べて最適経路を選ぶのは RIB が行う
+		rib.Update(e)
 	}
 	return nil
 }
 
 func (e NotificationMessageEvent) Do(p *Peer) error {
-	return fmt.Errorf("notification received: %+v", p)
+	m := e.Message
+	if m.ErrorCode == ErrorCodeCease && (m.ErrorSubcode == ErrorSubcodeAdministrativeShutdown || m.ErrorSubcode == ErrorSubcodeAdministrativeReset) {
+		if msg, ok := parseShutdownCommunication(m.Data); ok {
+			return fmt.Errorf("notification received: %+v (shutdown communication: %q)", m, msg)
+		}
+	}
+	return fmt.Errorf("notification received: %+v", m)
+}
+
+func (e MessageErrorEvent) Do(p *Peer) error {
+	return e.Err
 }
 
 func (e KeepaliveMessageEvent) Do(p *Peer) error {
 	switch p.State {
 	case StateOpenConfirm:
 		p.setState(StateEstablished)
-		p.startTimers()
-		p.registerLocalRIBHandlers()
-
-		log.Printf("sending initial update messages")
-		for af, f := range p.AddressFamilies {
-			for _, e := range f.LocalRIB.Entries() {
-				if e.AF != af {
-					continue // 違う AF が RIB に混ざってても広報しない (共有 RIB になった時対策)
-				}
-				if err := p.sendMessage(CreateUpdateMessage(e, p.MyAS, p.AddressFamilies[e.AF].SelfNextHop)); err != nil {
-					return fmt.Errorf("send update message: %w", err)
-				}
-			}
-		}
+		p.connectRetryCounter = 0
+		p.restartHoldTimer()
+		p.establishGracefulRestart()
+		// 最初に Loc-RIB の全ての経路が LocalRIBUpdateEvent として届く
+		p.subscribeLocalRIBs()
 		return nil
 	case StateEstablished:
-		p.holdTimer.Reset(time.Duration(p.HoldTime) * time.Second)
+		p.restartHoldTimer()
+		return nil
+	default:
+		return p.unexpectedStateError()
+	}
+}
+
+func (e RouteRefreshMessageEvent) Do(p *Peer) error {
+	if p.State != StateEstablished {
+		return p.unexpectedStateError()
+	}
+	p.restartHoldTimer()
+
+	m := e.Message
+	if !p.negotiated.HasAddressFamily(m.AF) {
+		// 合意していない address family は無視する (RFC 2918 4)
+		p.debugf("ignore route refresh for %v (address family is not negotiated)", m.AF)
+		return nil
+	}
+	switch m.Subtype {
+	case RouteRefreshSubtypeNormal:
+		p.logf("route refresh requested: %v", m.AF)
+		return p.resendAdjRIBOut(m.AF)
+	case RouteRefreshSubtypeBoRR:
+		// 送り直されなかった経路を EoRR で消すために、今ある経路に印を付ける (RFC 7313 4)
+		p.adjRIBIn[m.AF].MarkStale()
+		p.startRefreshTimer(m.AF)
 		return nil
+	case RouteRefreshSubtypeEoRR:
+		p.stopRefreshTimer(m.AF)
+		p.removeStaleRoutes(m.AF)
+		return nil
+	default:
+		// 知らない subtype は無視する (RFC 7313 5)
+		p.debugf("ignore route refresh with unknown subtype: %d", m.Subtype)
+		return nil
+	}
+}
+
+func (e RouteRefreshRequestEvent) Do(p *Peer) error {
+	var err error
+	switch {
+	case p.State != StateEstablished:
+		err = errNotEstablished
+	case !p.negotiated.RouteRefresh:
+		err = errRouteRefreshNotNegotiated
+	case !p.negotiated.HasAddressFamily(e.AF):
+		err = errAddressFamilyNotNegotiated
 	default:
-		return fmt.Errorf("unexpected state: %v", p.State)
+		if err = p.sendMessage(RouteRefreshMessage{AF: e.AF}); err != nil {
+			err = fmt.Errorf("send route refresh message: %w", err)
+		}
+		e.Result <- err
+		return err
+	}
+	p.warnf("cannot request route refresh for %v: %v", e.AF, err)
+	e.Result <- err
+	return nil
+}
+
+func (e StaleRoutesTimerExpireEvent) Do(p *Peer) error {
+	if len(p.staleAFs) == 0 || time.Now().Before(p.staleUntil) {
+		return nil // 既に消したか、タイマーを開始し直した
+	}
+	p.logf("stale routes timer expired: remove stale routes")
+	p.purgeStaleRoutes()
+	return nil
+}
+
+func (e RouteRefreshTimerExpireEvent) Do(p *Peer) error {
+	if p.State != StateEstablished {
+		return nil
 	}
+	delete(p.refreshTimers, e.AF)
+	p.warnf("end-of-route-refresh is not received for %v: remove stale routes", e.AF)
+	p.removeStaleRoutes(e.AF)
+	return nil
 }
 
 func (e HoldTimerExpireEvent) Do(p *Peer) error {
-	// TODO: Send notification?
-	return fmt.Errorf("hold timer expired")
+	return NewNotificationError(ErrorCodeHoldTimerExpired, 0, nil, "hold timer expired")
 }
 
 func (e KeepaliveTimerExpireEvent) Do(p *Peer) error {
+	if p.State != StateOpenConfirm && p.State != StateEstablished {
+		return p.unexpectedStateError()
+	}
 	if err := p.sendMessage(KeepaliveMessage{}); err != nil {
 		return fmt.Errorf("send keepalive message: %w", err)
 	}
+	p.startKeepaliveTimer()
 	return nil
 }
 
 func (e LocalRIBUpdateEvent) Do(p *Peer) error {
+	if p.State != StateEstablished {
+		return nil // セッションが切れた後に届いたものは無視する
+	}
 	// Withdrawn
-	if len(e.Removed) > 0 {
-		for _, r := range e.Removed {
-			if err := p.sendMessage(CreateWithdrawnMessage(r)); err != nil {
-				return fmt.Errorf("send withdrawn update message: %w", err)
-			}
+	for _, r := range e.Removed {
+		if !p.negotiated.HasAddressFamily(r.AF) {
+			continue
+		}
+		if err := p.sendWithdrawn(r); err != nil {
+			return fmt.Errorf("send withdrawn update message: %w", err)
 		}
 	}
 	// Update
 	for _, e := range e.Updated {
-		if err := p.sendMessage(CreateUpdateMessage(e, p.MyAS, p.AddressFamilies[e.AF].SelfNextHop)); err != nil {
+		if !p.negotiated.HasAddressFamily(e.AF) {
+			continue
+		}
+		if !p.shouldAdvertise(e) {
+			// 前の最適経路を広報していた場合は取り消す
+			if err := p.sendWithdrawn(WithdrawnRoute{AF: e.AF, Prefix: e.Prefix}); err != nil {
+				return fmt.Errorf("send withdrawn update message: %w", err)
+			}
+			continue
+		}
+		if err := p.sendUpdate(e, 0); err != nil {
 			return fmt.Errorf("send update message: %w", err)
 		}
 	}
 	return nil
 }
+
+func (e LocalRIBPathsUpdateEvent) Do(p *Peer) error {
+	if p.State != StateEstablished {
+		return nil
+	}
+	if err := p.sendPaths(e.AF, e.Prefix, e.Paths); err != nil {
+		return fmt.Errorf("send update message: %w", err)
+	}
+	return nil
+}
+
+func (e LocalRIBReplayedEvent) Do(p *Peer) error {
+	if p.State != StateEstablished {
+		return nil
+	}
+	// Graceful Restart を合意していなくても、最初の経路を送り終わったことを知らせる (RFC 4724 2)
+	if err := p.sendMessage(CreateEndOfRIBMessage(e.AF)); err != nil {
+		return fmt.Errorf("send end-of-rib: %w", err)
+	}
+	p.updateSyncStatus(e.AF, func(s *SyncStatus) { s.EndOfRIBSent = true })
+	return nil
+}
@@ -1,69 +1,254 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"net"
 )
 
-type FIBSyncer struct {
-	RIB *RIB
+// FIB はカーネルの経路表
+type FIB interface {
+	// Apply は ops をまとめて反映し、それぞれの結果を ops と同じ順で返す
+	Apply(ops []FIBOperation) []error
+	// Routes は経路表にある自分が追加した経路を返す (前回の起動時に追加したものも含む)
+	Routes() ([]FIBRoute, error)
+	Close() error
+}
+
+type FIBRoute struct {
+	Prefix  *net.IPNet
+	NextHop net.IP
+}
 
-	managed map[string]struct{}
+// FIBOperation は経路の追加、置き換え、または削除
+type FIBOperation struct {
+	Delete bool
+	// Replace は自分が前に追加した経路を置き換えるか
+	// (false の場合は追加で、他の経路を上書きしないように同じ経路が既にあれば失敗する)
+	Replace bool
+	Prefix  *net.IPNet
+	NextHop net.IP
 }
 
-func (s *FIBSyncer) Register() {
-	s.RIB.OnRemove(s.onRemove)
-	s.RIB.OnUpdate(s.onUpdate)
+// errFIBUnsupported はこの OS では経路表を操作できない
+var errFIBUnsupported = errors.New("FIB programming is only supported on linux")
+
+// dryRunFIB は経路表を変えずに、反映するはずだった操作をログに出す
+type dryRunFIB struct{}
+
+func NewDryRunFIB() FIB {
+	return dryRunFIB{}
 }
 
-func (s *FIBSyncer) delete(e *RIBEntry) error {
-	if _, ok := s.managed[e.Prefix.String()]; !ok {
-		// not managed by us
-		return nil
+func (dryRunFIB) Apply(ops []FIBOperation) []error {
+	for _, op := range ops {
+		switch {
+		case op.Delete:
+			infof("dry-run: delete route %v", op.Prefix)
+		case op.Replace:
+			infof("dry-run: replace route %v via %v", op.Prefix, op.NextHop)
+		default:
+			infof("dry-run: add route %v via %v", op.Prefix, op.NextHop)
+		}
 	}
-	delete(s.managed, e.Prefix.String())
-	return ipRoute("del", e.Prefix.String())
+	return make([]error, len(ops))
 }
 
-func (s *FIBSyncer) add(e *RIBEntry) error {
-	err := ipRoute("add", e.Prefix.String(), "via", net.IP(e.NextHop).String())
-	if err == nil {
-		s.managed[e.Prefix.String()] = struct{}{}
+func (dryRunFIB) Routes() ([]FIBRoute, error) {
+	return nil, nil
+}
+
+func (dryRunFIB) Close() error {
+	return nil
+}
+
+// fibBatchSize は FIB にまとめて反映する変化の最大数
+const fibBatchSize = 1024
+
+// FIBSyncer は 1 つの address family の RIB の最適経路を FIB に反映する
+type FIBSyncer struct {
+	AF  AddressFamily
+	RIB *RIB
+	FIB FIB
+
+	// 自分が追加した経路
+	managed map[fibKey]FIBRoute
+	// 起動時に FIB に残っていた経路のうち、RIB との突き合わせが終わっていないもの
+	stale     map[fibKey]*net.IPNet
+	preserved int
+	// これが閉じられるまで stale な経路を消さない (Graceful Restart で再起動した場合)
+	hold     <-chan struct{}
+	replayed bool
+
+	subscription *RIBSubscription
+	done         chan struct{}
+}
+
+func NewFIBSyncer(af AddressFamily, rib *RIB, fib FIB) *FIBSyncer {
+	return &FIBSyncer{
+		AF:      af,
+		RIB:     rib,
+		FIB:     fib,
+		managed: make(map[fibKey]FIBRoute),
+		stale:   make(map[fibKey]*net.IPNet),
 	}
-	return err
 }
 
-func (s *FIBSyncer) onRemove(e *RIBEntry) error {
-	log.Printf("RIB removed: %v", e)
-	if err := s.delete(e); err != nil {
-		log.Printf("ERROR: %v", err)
+// fibKey は FIB の経路の prefix を見分けるキー。
+// String() では IPv4-mapped な IPv6 の prefix が IPv4 の prefix と同じになるので、バイト列のまま使う
+type fibKey struct {
+	ip, mask string
+}
+
+func newFIBKey(prefix *net.IPNet) fibKey {
+	return fibKey{string(prefix.IP), string(prefix.Mask)}
+}
+
+// HoldStale は Register で読み込んだ経路のうち RIB に無いものを、hold が閉じられるまで消さずに残すようにする。
+// Register の前に呼ぶ
+func (s *FIBSyncer) HoldStale(hold <-chan struct{}) {
+	s.hold = hold
+}
+
+// Register は FIB に残っている自分の経路を読み込んでから RIB の購読を開始する。
+// 購読の最初に届く RIB の全ての最適経路と突き合わせて、変わった経路は置き換え、RIB に無い経路は削除する
+func (s *FIBSyncer) Register() error {
+	routes, err := s.FIB.Routes()
+	if err != nil {
+		return fmt.Errorf("read FIB: %w", err)
+	}
+	for _, r := range routes {
+		if _, bits := r.Prefix.Mask.Size(); bits != s.AF.AddressBits() {
+			continue
+		}
+		key := newFIBKey(r.Prefix)
+		s.managed[key] = r
+		s.stale[key] = r.Prefix
 	}
+	s.preserved = len(s.stale)
+	if s.preserved > 0 {
+		infof("found %d routes in FIB installed previously (%v)", s.preserved, s.AF)
+	}
+
+	s.subscription = s.RIB.Subscribe(true)
+	s.done = make(chan struct{})
+	go s.run()
 	return nil
 }
 
-func (s *FIBSyncer) onUpdate(prev, curr *RIBEntry) error {
-	log.Printf("RIB updated: %v -> %v", prev, curr)
-	if prev != nil {
-		if err := s.delete(prev); err != nil {
-			log.Printf("ERROR: %v", err)
+// PreservedRoutes は Register で読み込んだ、前回の起動で追加した経路の数を返す
+func (s *FIBSyncer) PreservedRoutes() int {
+	return s.preserved
+}
+
+func (s *FIBSyncer) run() {
+	defer close(s.done)
+	for {
+		var c RIBChange
+		select {
+		case <-s.hold:
+			infof("stop keeping stale routes in FIB (%v)", s.AF)
+			s.hold = nil
+			if s.replayed {
+				s.apply(nil) // RIB に無いまま残っている経路を削除する
+			}
+			continue
+		case change, ok := <-s.subscription.C():
+			if !ok {
+				return
+			}
+			c = change
+		}
+
+		// 溜まっている変化をまとめて反映する
+		batch := []RIBChange{c}
+	collect:
+		for len(batch) < fibBatchSize {
+			select {
+			case c, ok := <-s.subscription.C():
+				if !ok {
+					break collect
+				}
+				batch = append(batch, c)
+			default:
+				break collect
+			}
 		}
+		s.apply(batch)
 	}
-	if curr.NextHop == nil {
-		return nil
+}
+
+func (s *FIBSyncer) apply(changes []RIBChange) {
+	ops := make([]FIBOperation, 0, len(changes))
+	for _, c := range changes {
+		if c.EndOfReplay {
+			s.replayed = true
+			continue
+		}
+
+		key := newFIBKey(c.Prefix)
+		delete(s.stale, key)
+		r, managed := s.managed[key]
+		if c.Curr == nil || c.Curr.NextHop == nil {
+			// 取り除かれたか、自分で広報しているネットワークになった
+			if managed {
+				ops = append(ops, FIBOperation{Delete: true, Prefix: c.Prefix})
+			}
+			continue
+		}
+		if managed && r.NextHop.Equal(c.Curr.NextHop) {
+			continue // 既に同じ経路が入っている
+		}
+		ops = append(ops, FIBOperation{Replace: managed, Prefix: c.Prefix, NextHop: c.Curr.NextHop})
 	}
-	if err := s.add(curr); err != nil {
-		log.Printf("ERROR: %v", err)
+	if s.replayed && s.hold == nil && len(s.stale) > 0 {
+		// RIB に無かった古い経路を削除する
+		for _, prefix := range s.stale {
+			ops = append(ops, FIBOperation{Delete: true, Prefix: prefix})
+		}
+		s.stale = make(map[fibKey]*net.IPNet)
+	}
+	if len(ops) == 0 {
+		return
 	}
-	return nil
-}
 
-func (s *FIBSyncer) Cleanup() {
-	for _, e := range s.RIB.Entries() {
-		if e.NextHop == nil {
+	for i, err := range s.FIB.Apply(ops) {
+		op := ops[i]
+		key := newFIBKey(op.Prefix)
+		if err != nil {
+			// 失敗した場合は前の状態のままなので、管理している経路も変えない
+			errorf("FIB: %v", err)
 			continue
 		}
-		if err := s.delete(e); err != nil {
-			log.Printf("cleaning FIB: %v", err)
+		if op.Delete {
+			delete(s.managed, key)
+		} else {
+			s.managed[key] = FIBRoute{Prefix: op.Prefix, NextHop: op.NextHop}
+		}
+	}
+}
+
+// Close は購読を終了する。追加した経路は FIB に残す (Graceful Restart で再起動する場合)
+func (s *FIBSyncer) Close() {
+	s.subscription.Close()
+	<-s.done
+	infof("keep %d routes in FIB (%v)", len(s.managed), s.AF)
+}
+
+// Cleanup は購読を終了して、追加した経路を FIB から削除する
+func (s *FIBSyncer) Cleanup() {
+	s.subscription.Close()
+	<-s.done
+
+	ops := make([]FIBOperation, 0, len(s.managed))
+	for _, r := range s.managed {
+		ops = append(ops, FIBOperation{Delete: true, Prefix: r.Prefix})
+	}
+	for _, err := range s.FIB.Apply(ops) {
+		if err != nil {
+			errorf("cleaning FIB: %v", err)
 		}
 	}
+	s.managed = make(map[fibKey]FIBRoute)
+	infof("removed %d routes from FIB (%v)", len(ops), s.AF)
 }
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func NewFIB() (FIB, error) {
+	return nil, errFIBUnsupported
+}
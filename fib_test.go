@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingFIB は反映された操作を記録する FIB
+type recordingFIB struct {
+	routes []FIBRoute
+
+	mutex sync.Mutex
+	ops   []FIBOperation
+}
+
+func (f *recordingFIB) Apply(ops []FIBOperation) []error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ops = append(f.ops, ops...)
+	return make([]error, len(ops))
+}
+
+// waitOps は n 個以上の操作が反映されるまで待って、反映された操作を返す
+func (f *recordingFIB) waitOps(t *testing.T, n int) []FIBOperation {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mutex.Lock()
+		ops := append([]FIBOperation(nil), f.ops...)
+		f.mutex.Unlock()
+		if len(ops) >= n || time.Now().After(deadline) {
+			return ops
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *recordingFIB) Routes() ([]FIBRoute, error) {
+	return f.routes, nil
+}
+
+func (f *recordingFIB) Close() error {
+	return nil
+}
+
+func TestFIBSyncerApply(t *testing.T) {
+	prefix := mustParseCIDR(t, "10.1.0.0/16")
+	entry := func(nextHop string) *RIBEntry {
+		return &RIBEntry{AF: IPv4Unicast, Prefix: prefix, NextHop: net.ParseIP(nextHop)}
+	}
+	tests := []struct {
+		name    string
+		managed bool // 既に自分が追加した経路があるか
+		change  RIBChange
+		want    []FIBOperation
+	}{
+		{
+			name:   "add new route",
+			change: RIBChange{Prefix: prefix, Curr: entry("192.0.2.1")},
+			want:   []FIBOperation{{Prefix: prefix, NextHop: net.ParseIP("192.0.2.1")}},
+		},
+		{
+			name:    "replace own route",
+			managed: true,
+			change:  RIBChange{Prefix: prefix, Prev: entry("192.0.2.254"), Curr: entry("192.0.2.1")},
+			want:    []FIBOperation{{Replace: true, Prefix: prefix, NextHop: net.ParseIP("192.0.2.1")}},
+		},
+		{
+			name:    "same next hop",
+			managed: true,
+			change:  RIBChange{Prefix: prefix, Prev: entry("192.0.2.254"), Curr: entry("192.0.2.254")},
+		},
+		{
+			name:    "remove own route",
+			managed: true,
+			change:  RIBChange{Prefix: prefix, Prev: entry("192.0.2.254")},
+			want:    []FIBOperation{{Delete: true, Prefix: prefix}},
+		},
+		{
+			name:   "not installed",
+			change: RIBChange{Prefix: prefix, Prev: entry("192.0.2.254")},
+		},
+		{
+			name:    "local network",
+			managed: true,
+			change:  RIBChange{Prefix: prefix, Prev: entry("192.0.2.254"), Curr: &RIBEntry{AF: IPv4Unicast, Prefix: prefix}},
+			want:    []FIBOperation{{Delete: true, Prefix: prefix}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fib := &recordingFIB{}
+			s := NewFIBSyncer(IPv4Unicast, NewRIB(), fib)
+			if tt.managed {
+				s.managed[newFIBKey(prefix)] = FIBRoute{Prefix: prefix, NextHop: net.ParseIP("192.0.2.254")}
+			}
+			s.apply([]RIBChange{tt.change})
+			if len(fib.ops) != len(tt.want) {
+				t.Fatalf("ops = %+v, want %+v", fib.ops, tt.want)
+			}
+			for i, op := range fib.ops {
+				want := tt.want[i]
+				if op.Delete != want.Delete || op.Replace != want.Replace || op.Prefix.String() != want.Prefix.String() || !op.NextHop.Equal(want.NextHop) {
+					t.Errorf("ops[%d] = %+v, want %+v", i, op, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFIBSyncerRegister(t *testing.T) {
+	// 前回の起動で追加した経路は、RIB にあれば置き換え、無ければ削除する
+	fib := &recordingFIB{routes: []FIBRoute{
+		{Prefix: mustParseCIDR(t, "10.1.0.0/16"), NextHop: net.ParseIP("192.0.2.254")},
+		{Prefix: mustParseCIDR(t, "10.2.0.0/16"), NextHop: net.ParseIP("192.0.2.254")},
+		{Prefix: mustParseCIDR(t, "2001:db8::/32"), NextHop: net.ParseIP("2001:db8:ffff::1")},
+	}}
+	rib := NewRIB()
+	rib.Update(&RIBEntry{AF: IPv4Unicast, Prefix: mustParseCIDR(t, "10.1.0.0/16"), NextHop: net.ParseIP("192.0.2.1")})
+	rib.Update(&RIBEntry{AF: IPv4Unicast, Prefix: mustParseCIDR(t, "10.3.0.0/16"), NextHop: net.ParseIP("192.0.2.1")})
+
+	s := NewFIBSyncer(IPv4Unicast, rib, fib)
+	if err := s.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if s.PreservedRoutes() != 2 {
+		t.Errorf("PreservedRoutes() = %d, want 2", s.PreservedRoutes())
+	}
+	ops := fib.waitOps(t, 3)
+	s.Close()
+
+	got := make(map[string]FIBOperation)
+	for _, op := range ops {
+		got[op.Prefix.String()] = op
+	}
+	want := map[string]FIBOperation{
+		"10.1.0.0/16": {Replace: true, NextHop: net.ParseIP("192.0.2.1")},
+		"10.2.0.0/16": {Delete: true},
+		"10.3.0.0/16": {NextHop: net.ParseIP("192.0.2.1")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ops = %+v, want %+v", ops, want)
+	}
+	for key, w := range want {
+		op, ok := got[key]
+		if !ok || op.Delete != w.Delete || op.Replace != w.Replace || !op.NextHop.Equal(w.NextHop) {
+			t.Errorf("op for %s = %+v, want %+v", key, op, w)
+		}
+	}
+}
+
+func TestFIBSyncerIPv4MappedPrefix(t *testing.T) {
+	// IPv4-mapped な IPv6 の prefix は、IPv4 の prefix にせず追加したときのまま削除する
+	isIPv6 := func(p *net.IPNet) bool {
+		_, bits := p.Mask.Size()
+		return len(p.IP) == net.IPv6len && bits == 128
+	}
+	stale := mustParseCIDR(t, "::ffff:10.1.0.0/112")
+	fib := &recordingFIB{routes: []FIBRoute{{Prefix: stale, NextHop: net.ParseIP("2001:db8:ffff::1")}}}
+	rib := NewRIB()
+	installed := mustParseCIDR(t, "::ffff:10.2.0.0/112")
+	rib.Update(&RIBEntry{AF: IPv6Unicast, Prefix: installed, NextHop: net.ParseIP("2001:db8:ffff::2")})
+
+	s := NewFIBSyncer(IPv6Unicast, rib, fib)
+	if err := s.Register(); err != nil {
+		t.Fatal(err)
+	}
+	ops := fib.waitOps(t, 2)
+	if len(ops) != 2 {
+		t.Fatalf("ops = %+v, want 2 operations", ops)
+	}
+	for _, op := range ops {
+		if !isIPv6(op.Prefix) {
+			t.Errorf("op %+v: prefix %v is not IPv6", op, op.Prefix)
+		}
+	}
+
+	s.Cleanup()
+	ops = fib.waitOps(t, 3)
+	if len(ops) != 3 {
+		t.Fatalf("ops = %+v, want 3 operations", ops)
+	}
+	if op := ops[2]; !op.Delete || !isIPv6(op.Prefix) || !op.Prefix.IP.Equal(installed.IP) {
+		t.Errorf("Cleanup() op = %+v, want delete of %v", op, installed)
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/takonomura/takonobgp
 
 go 1.19
+
+require (
+	github.com/BurntSushi/toml v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
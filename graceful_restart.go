@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RFC 4724: Graceful Restart Mechanism for BGP
+
+// GracefulRestartConfig は Graceful Restart の設定 (全てのピアで共通)
+type GracefulRestartConfig struct {
+	Enabled bool
+
+	// 自分が再起動したときに、相手に経路を残しておいてもらう時間 (秒)。
+	// 再起動した後に前回の経路を FIB に残しておく最大の時間にも使う
+	RestartTime uint16
+	// 相手が再起動してセッションを張り直した後、End-of-RIB を待って stale な経路を残しておく時間 (秒)
+	StaleRoutesTime uint16
+
+	// 再起動の間も転送を続けられるか (FIB に経路を入れていて、終了しても残すか)。
+	// 設定ファイルではなく起動オプションで決まるので、Router が設定する
+	ForwardingPreserved bool
+}
+
+// gracefulRestartCapability は自分の Graceful Restart capability を作る
+func (p *Peer) gracefulRestartCapability() GracefulRestartCapability {
+	c := GracefulRestartCapability{
+		Restarting:  p.restarting,
+		RestartTime: p.GracefulRestart.RestartTime,
+	}
+	for _, af := range sortedAddressFamilies(p.AddressFamilies) {
+		// FIB に経路を入れていれば、再起動しても消さないので転送は続けている
+		c.AddressFamilies = append(c.AddressFamilies, GracefulRestartAddressFamily{AF: af, ForwardingPreserved: p.GracefulRestart.ForwardingPreserved})
+	}
+	return c
+}
+
+// retainStaleRoutes は Established のセッションが NOTIFICATION 無しで切れたときに、
+// 相手が Graceful Restart capability に含めた address family の経路を stale として Restart Time の間残す (RFC 4724 4.2)
+func (p *Peer) retainStaleRoutes() {
+	gr := p.negotiated.RemoteGracefulRestart
+	for _, f := range gr.AddressFamilies {
+		if p.negotiated.HasAddressFamily(f.AF) {
+			p.markStale(f.AF)
+		}
+	}
+	if len(p.staleAFs) == 0 {
+		return
+	}
+	d := time.Duration(gr.RestartTime) * time.Second
+	p.logf("neighbor may be restarting: retain routes for %v", d)
+	p.startStaleTimer(d)
+}
+
+func (p *Peer) markStale(af AddressFamily) {
+	p.adjRIBIn[af].MarkStale()
+	p.staleAFs[af] = struct{}{}
+}
+
+// startStaleTimer は d 経過後に stale な経路を消すタイマーを開始する。
+// セッションをまたいで使うので、セッションのイベントではなく staleUntil で古いものを見分ける
+func (p *Peer) startStaleTimer(d time.Duration) {
+	if p.staleTimer != nil {
+		p.staleTimer.Stop()
+	}
+	p.staleUntil = time.Now().Add(d)
+	p.staleTimer = time.AfterFunc(d, func() {
+		p.sendEvent(StaleRoutesTimerExpireEvent{})
+	})
+}
+
+// establishGracefulRestart はセッションが確立したときに、残している経路のうち
+// 相手が転送を続けられなかった (または Graceful Restart をやめた) address family のものを消す (RFC 4724 4.2)
+func (p *Peer) establishGracefulRestart() {
+	p.restarting = false
+	gr := p.negotiated.RemoteGracefulRestart
+	for af := range p.staleAFs {
+		if !p.negotiated.GracefulRestart || !p.negotiated.HasAddressFamily(af) || !gr.ForwardingPreserved(af) {
+			p.logf("neighbor did not preserve forwarding state: remove stale routes (%v)", af)
+			p.removeStaleRoutes(af)
+		}
+	}
+	if len(p.staleAFs) > 0 {
+		// 残りは End-of-RIB を受け取るまで待つ
+		p.startStaleTimer(time.Duration(p.GracefulRestart.StaleRoutesTime) * time.Second)
+	}
+
+	// End-of-RIB が来ない address family は待たない
+	for af := range p.AddressFamilies {
+		if !p.negotiated.GracefulRestart || !p.negotiated.HasAddressFamily(af) {
+			p.restartState.Synchronized(p.NeighborAddress, af)
+		}
+	}
+}
+
+// purgeStaleRoutes は残している stale な経路を全て消す
+func (p *Peer) purgeStaleRoutes() {
+	for af := range p.staleAFs {
+		p.removeStaleRoutes(af)
+	}
+}
+
+// inheritStaleRoutes は異常終了した prev が残した stale な経路を引き継ぐ。
+// 同じ経路を入れてから prev の経路を消すので、最適経路 (と FIB) は変わらない
+func (p *Peer) inheritStaleRoutes(prev *Peer) {
+	for af := range prev.staleAFs {
+		f, ok := p.AddressFamilies[af]
+		for _, e := range prev.adjRIBIn[af].Entries() {
+			old := prev.AddressFamilies[af].LocalRIB.FindPath(e.Prefix, prev, e.PathID)
+			if ok {
+				inherited := *e
+				inherited.Weight = p.Weight
+				inherited.Source = p
+				p.adjRIBIn[af].Update(&inherited)
+				if old != nil {
+					f.LocalRIB.Update(&inherited)
+				}
+			}
+			if old != nil {
+				prev.AddressFamilies[af].LocalRIB.Remove(old)
+			}
+		}
+		prev.adjRIBIn[af].Clear()
+		if ok {
+			p.markStale(af)
+		}
+	}
+	prev.staleAFs = make(map[AddressFamily]struct{})
+	if len(p.staleAFs) > 0 {
+		p.logf("inherited stale routes from the previous session")
+		p.startStaleTimer(time.Until(prev.staleUntil))
+	}
+}
+
+// restartState は自分が FIB に経路を残して再起動した後、全てのピアが最初の経路を送り終わる
+// (End-of-RIB を受け取る) まで、前回の経路を FIB から消すのを待つためのもの (RFC 4724 4.1)
+type restartState struct {
+	mutex   *sync.Mutex
+	waiting map[AddressFamily]map[string]struct{} // key: 正規化した相手のアドレス
+	done    map[AddressFamily]chan struct{}
+}
+
+// newRestartState は peers の全ての address family の経路を待つ restartState を作る。timeout を過ぎたら待つのをやめる
+func newRestartState(afs []AddressFamily, peers []PeerConfig, timeout time.Duration) *restartState {
+	s := &restartState{
+		mutex:   new(sync.Mutex),
+		waiting: make(map[AddressFamily]map[string]struct{}, len(afs)),
+		done:    make(map[AddressFamily]chan struct{}, len(afs)),
+	}
+	for _, af := range afs {
+		s.waiting[af] = make(map[string]struct{})
+		s.done[af] = make(chan struct{})
+	}
+	for _, pc := range peers {
+		for af := range pc.AddressFamilies {
+			if w, ok := s.waiting[af]; ok {
+				w[normalizeAddress(pc.NeighborAddress)] = struct{}{}
+			}
+		}
+	}
+	s.mutex.Lock()
+	for _, af := range afs {
+		s.check(af)
+	}
+	s.mutex.Unlock()
+	time.AfterFunc(timeout, s.expire)
+	return s
+}
+
+// Done は af の全てのピアから経路を受け取り終わると閉じられる
+func (s *restartState) Done(af AddressFamily) <-chan struct{} {
+	return s.done[af]
+}
+
+// Synchronized は addr のピアから af の最初の経路を受け取り終わったことを知らせる (s が nil なら何もしない)
+func (s *restartState) Synchronized(addr string, af AddressFamily) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if w, ok := s.waiting[af]; ok {
+		delete(w, normalizeAddress(addr))
+		s.check(af)
+	}
+}
+
+// RemovePeer は設定から消えた addr のピアを待つのをやめる (s が nil なら何もしない)
+func (s *restartState) RemovePeer(addr string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for af, w := range s.waiting {
+		delete(w, normalizeAddress(addr))
+		s.check(af)
+	}
+}
+
+// Finish は残りのピアを待たずに終わらせる
+func (s *restartState) Finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for af := range s.waiting {
+		close(s.done[af])
+		delete(s.waiting, af)
+	}
+}
+
+func (s *restartState) expire() {
+	s.mutex.Lock()
+	for af, w := range s.waiting {
+		warnf("graceful restart: gave up waiting for %d neighbors (%v)", len(w), af)
+	}
+	s.mutex.Unlock()
+	s.Finish()
+}
+
+func (s *restartState) check(af AddressFamily) {
+	if len(s.waiting[af]) > 0 {
+		return
+	}
+	close(s.done[af])
+	delete(s.waiting, af)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testGracefulRestartPeer(t *testing.T, rib *RIB, forwarding bool) *Peer {
+	t.Helper()
+	return NewPeer(PeerConfig{
+		MyAS:            65001,
+		RouterID:        [4]byte{10, 0, 0, 1},
+		NeighborAddress: "10.0.0.2",
+		RemoteAS:        65002,
+		AddressFamilies: map[AddressFamily]AddressFamilyConfig{
+			IPv4Unicast: {SelfNextHop: net.ParseIP("10.0.0.1").To4(), LocalRIB: rib},
+		},
+		HoldTime: 90,
+		GracefulRestart: GracefulRestartConfig{
+			Enabled:             true,
+			RestartTime:         120,
+			StaleRoutesTime:     360,
+			ForwardingPreserved: forwarding,
+		},
+	})
+}
+
+func TestGracefulRestartCapabilityForwardingState(t *testing.T) {
+	for _, forwarding := range []bool{true, false} {
+		c := testGracefulRestartPeer(t, NewRIB(), forwarding).gracefulRestartCapability()
+		if len(c.AddressFamilies) != 1 {
+			t.Fatalf("forwarding = %v: AddressFamilies = %+v", forwarding, c.AddressFamilies)
+		}
+		// FIB に経路を入れていなければ、再起動の間に転送を続けているとは広報しない
+		if got := c.ForwardingPreserved(IPv4Unicast); got != forwarding {
+			t.Errorf("forwarding = %v: ForwardingPreserved() = %v", forwarding, got)
+		}
+	}
+}
+
+func TestReconnectDuringGracefulRestart(t *testing.T) {
+	rib := NewRIB()
+	p := testGracefulRestartPeer(t, rib, true)
+	p.negotiated = NegotiatedCapabilities{
+		AddressFamilies: map[AddressFamily]struct{}{IPv4Unicast: {}},
+		GracefulRestart: true,
+		RemoteGracefulRestart: GracefulRestartCapability{
+			RestartTime:     120,
+			AddressFamilies: []GracefulRestartAddressFamily{{AF: IPv4Unicast, ForwardingPreserved: true}},
+		},
+	}
+	oldConn, oldRemote := net.Pipe()
+	p.conn = oldConn
+	p.setState(StateEstablished)
+
+	_, prefix, _ := net.ParseCIDR("10.2.0.0/16")
+	e := &RIBEntry{
+		AF:      IPv4Unicast,
+		Prefix:  prefix,
+		Origin:  OriginAttributeIGP,
+		ASPath:  NewASPath(65002),
+		NextHop: net.ParseIP("10.0.0.2").To4(),
+		Source:  p,
+	}
+	p.adjRIBIn[IPv4Unicast].Update(e)
+	rib.Update(e)
+
+	// 相手が再起動して、Established のまま新しい接続が来る
+	conn, remote := net.Pipe()
+	received := make(chan Message, 1)
+	go func() {
+		m, err := ReadPacket(remote, nil)
+		if err != nil {
+			t.Errorf("read open message: %v", err)
+		}
+		received <- m
+	}()
+	if err := (TcpConnectionConfirmedEvent{conn}).Do(p); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		remote.Close()
+		p.releaseSession()
+		if p.staleTimer != nil {
+			p.staleTimer.Stop()
+		}
+		close(p.stopChan)
+		p.wg.Wait()
+	}()
+
+	if _, ok := (<-received).(OpenMessage); !ok {
+		t.Errorf("new connection did not receive OPEN")
+	}
+	if p.State != StateOpenSent {
+		t.Errorf("State = %v, want %v", p.State, StateOpenSent)
+	}
+	// 古いセッションは NOTIFICATION を送らずに閉じる
+	oldRemote.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := oldRemote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("old connection: Read() = %d, %v, want EOF", n, err)
+	}
+	// 経路は stale として Restart Time の間残す
+	if rib.FindPath(prefix, p, 0) == nil {
+		t.Errorf("route was removed from Loc-RIB")
+	}
+	if _, ok := p.staleAFs[IPv4Unicast]; !ok {
+		t.Errorf("routes are not marked stale")
+	}
+	if p.staleTimer == nil {
+		t.Errorf("restart timer is not started")
+	}
+}
@@ -1,42 +1,75 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type HTTPServer struct {
 	AF  AddressFamily
 	RIB *RIB
+
+	// Peers は設定されているピアの一覧 (Listener が持っているものを使う)
+	Peers *Listener
+	// Reload は設定ファイルを読み直して反映する
+	Reload func() (ReloadResult, error)
+	// Config は反映している設定を返す
+	Config func() Config
 }
 
-func (s *HTTPServer) handleRIB(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	rib := s.RIB.Entries()
+type ribEntryJSON struct {
+	Prefix    string         `json:"prefix"`
+	ASPath    []interface{}  `json:"as_path"` // AS 番号の配列 (AS_SET はその中の配列)
+	NextHop   string         `json:"next_hop"`
+	LocalPref LocalPref      `json:"local_pref"`
+	MED       *MultiExitDisc `json:"med,omitempty"`
+	Source    string         `json:"source"`
+	PathID    uint32         `json:"path_id,omitempty"` // ADD-PATH の Path Identifier
+	Best      bool           `json:"best"`
+}
 
-	type aux struct {
-		Prefix  string   `json:"prefix"`
-		ASPath  []uint16 `json:"as_path"`
-		NextHop string   `json:"next_hop"`
+func newRIBEntryJSON(e *RIBEntry) ribEntryJSON {
+	v := ribEntryJSON{
+		Prefix:    e.Prefix.String(),
+		ASPath:    asPathJSON(e.ASPath),
+		NextHop:   net.IP(e.NextHop).String(),
+		LocalPref: e.LocalPref,
+		MED:       e.MED,
+		PathID:    e.PathID,
 	}
-	res := make([]aux, len(rib))
-	for i, e := range rib {
-		res[i] = aux{
-			Prefix:  e.Prefix.String(),
-			ASPath:  e.ASPath.Segments,
-			NextHop: net.IP(e.NextHop).String(),
+	if e.NextHop == nil {
+		v.NextHop = ""
+	}
+	if e.Source != nil {
+		v.Source = e.Source.NeighborAddress
+	}
+	return v
+}
+
+// asPathJSON は AS_PATH を [65002, 65003, [64512, 64513]] のように AS_SET だけを配列にした形にする
+func asPathJSON(p ASPath) []interface{} {
+	v := []interface{}{}
+	for _, s := range p.Segments {
+		if s.Type == ASPathSegmentSet {
+			v = append(v, s.ASNs)
+			continue
 		}
-		if e.NextHop == nil {
-			res[i].NextHop = ""
+		for _, as := range s.ASNs {
+			v = append(v, as)
 		}
 	}
+	return v
+}
 
-	b, err := json.MarshalIndent(res, "", "  ")
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -46,6 +79,197 @@ func (s *HTTPServer) handleRIB(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func (s *HTTPServer) handleRIB(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// 最適経路以外の候補も返す
+	rib := s.RIB.Paths()
+
+	res := make([]ribEntryJSON, len(rib))
+	for i, e := range rib {
+		res[i] = newRIBEntryJSON(e)
+		res[i].Best = s.RIB.IsBest(e)
+	}
+	writeJSON(w, res)
+}
+
+// handleLookup は address クエリで指定したアドレスを最長一致で引いた最適経路を返す
+func (s *HTTPServer) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("address"))
+	if ip == nil {
+		http.Error(w, "bad address value", http.StatusBadRequest)
+		return
+	}
+	e := s.RIB.LongestMatch(ip)
+	if e == nil {
+		http.Error(w, "not found in RIB", http.StatusNotFound)
+		return
+	}
+	res := newRIBEntryJSON(e)
+	res.Best = true
+	writeJSON(w, res)
+}
+
+// handleWatch は最適経路の変化を 1 行 1 つの JSON で流し続ける
+// replay クエリを付けると、最初に現在の全ての最適経路を流す
+func (s *HTTPServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.RIB.Subscribe(r.URL.Query().Has("replay"))
+	defer sub.Close()
+
+	type change struct {
+		Prefix string        `json:"prefix"`
+		Best   *ribEntryJSON `json:"best"` // null の場合は取り除かれた
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case c := <-sub.C():
+			if c.EndOfReplay {
+				continue
+			}
+			v := change{Prefix: c.Prefix.String()}
+			if c.Curr != nil {
+				best := newRIBEntryJSON(c.Curr)
+				best.Best = true
+				v.Best = &best
+			}
+			if err := enc.Encode(v); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type neighborJSON struct {
+	Address string `json:"address"`
+	State   State  `json:"state"`
+	// この address family の最初の経路を送り終わったか、相手から受け取り終わったか
+	EndOfRIBSent     bool `json:"end_of_rib_sent"`
+	EndOfRIBReceived bool `json:"end_of_rib_received"`
+	// 属性が大きすぎて UPDATE に収まらずに広報しなかった回数
+	DroppedRoutes int `json:"dropped_routes"`
+}
+
+// handleNeighbors はこの address family を設定している全てのピアの状態を返す
+func (s *HTTPServer) handleNeighbors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := []neighborJSON{}
+	for _, p := range s.Peers.Peers() {
+		if _, ok := p.adjRIBIn[s.AF]; !ok {
+			continue
+		}
+		status := p.Status()
+		sync := status.Sync[s.AF]
+		res = append(res, neighborJSON{
+			Address:          p.NeighborAddress,
+			State:            status.State,
+			EndOfRIBSent:     sync.EndOfRIBSent,
+			EndOfRIBReceived: sync.EndOfRIBReceived,
+			DroppedRoutes:    status.DroppedRoutes[s.AF],
+		})
+	}
+	writeJSON(w, res)
+}
+
+// handleAdjRIB は neighbor クエリで指定したピアの Adj-RIB-In または Adj-RIB-Out を返す
+func (s *HTTPServer) handleAdjRIB(in bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		addr := r.URL.Query().Get("neighbor")
+		if addr == "" {
+			http.Error(w, "neighbor is not specified", http.StatusBadRequest)
+			return
+		}
+		p := s.Peers.Peer(addr)
+		if p == nil {
+			http.Error(w, "neighbor not found", http.StatusNotFound)
+			return
+		}
+
+		adjRIBs := p.adjRIBOut
+		if in {
+			adjRIBs = p.adjRIBIn
+		}
+		adjRIB, ok := adjRIBs[s.AF]
+		if !ok {
+			http.Error(w, "address family is not configured for the neighbor", http.StatusNotFound)
+			return
+		}
+
+		entries := adjRIB.Entries()
+		res := make([]ribEntryJSON, len(entries))
+		for i, e := range entries {
+			res[i] = newRIBEntryJSON(e)
+			if in {
+				// ループしていて Loc-RIB に入れなかった経路もある
+				if path := s.RIB.FindPath(e.Prefix, p, e.PathID); path != nil {
+					res[i].Best = s.RIB.IsBest(path)
+				}
+			}
+		}
+		writeJSON(w, res)
+	}
+}
+
+// handleSoftResetIn は neighbor クエリで指定したピアに ROUTE-REFRESH を送り、経路を送り直してもらう
+func (s *HTTPServer) handleSoftResetIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("neighbor")
+	if addr == "" {
+		http.Error(w, "neighbor is not specified", http.StatusBadRequest)
+		return
+	}
+	p := s.Peers.Peer(addr)
+	if p == nil {
+		http.Error(w, "neighbor not found", http.StatusNotFound)
+		return
+	}
+	if _, ok := p.adjRIBIn[s.AF]; !ok {
+		http.Error(w, "address family is not configured for the neighbor", http.StatusNotFound)
+		return
+	}
+	if err := p.RequestRouteRefresh(s.AF); err != nil {
+		status := http.StatusConflict // セッションの状態によっては後で送れる
+		if errors.Is(err, errRouteRefreshNotNegotiated) || errors.Is(err, errAddressFamilyNotNegotiated) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (s *HTTPServer) handleNetworkAdd(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -67,24 +291,29 @@ func (s *HTTPServer) handleNetworkAdd(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad prefix value", http.StatusBadRequest)
 		return
 	}
+	if af := networkAddressFamily(prefix); af != s.AF {
+		http.Error(w, fmt.Sprintf("prefix is %v, but this API is for %v", af, s.AF), http.StatusBadRequest)
+		return
+	}
+	cfg := s.Config()
+	configured := make(map[AddressFamily]struct{})
+	for _, pc := range cfg.Peers {
+		for af := range pc.AddressFamilies {
+			configured[af] = struct{}{}
+		}
+	}
+	if err := checkNetworkAddressFamily(prefix, configured, len(cfg.Peers) > 0); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	e := s.RIB.Find(prefix)
+	e := s.RIB.FindPath(prefix, nil, 0)
 	if e != nil {
 		http.Error(w, "network already exists in RIB", http.StatusBadRequest)
 		return
 	}
 
-	if err := s.RIB.Update(&RIBEntry{
-		AF:      s.AF,
-		Prefix:  prefix,
-		Origin:  OriginAttributeIGP,
-		ASPath:  ASPath{Sequence: true, Segments: []uint16{}},
-		NextHop: nil,
-		Source:  nil,
-	}); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	s.RIB.Update(NewLocalRIBEntry(s.AF, prefix))
 
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -106,27 +335,85 @@ func (s *HTTPServer) handleNetworkDelete(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	e := s.RIB.Find(prefix)
+	e := s.RIB.FindPath(prefix, nil, 0)
 	if e == nil {
+		if s.RIB.Find(prefix) != nil {
+			http.Error(w, "the entry is not managed by us", http.StatusForbidden)
+			return
+		}
 		http.Error(w, "not found in RIB", http.StatusNotFound)
 		return
 	}
-	if e.Source != nil {
-		http.Error(w, "the entry is not managed by us", http.StatusForbidden)
+	s.RIB.Remove(e)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *HTTPServer) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if err := s.RIB.Remove(e); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	result, err := s.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	writeJSON(w, result)
+}
 
-	w.WriteHeader(http.StatusAccepted)
+// handleConfig は反映している設定を format (json, yaml, toml) の設定ファイルとして返す
+func (s *HTTPServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	format := ConfigFormatJSON
+	if v := r.URL.Query().Get("format"); v != "" {
+		var err error
+		if format, err = ParseConfigFormat(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var b bytes.Buffer
+	if err := WriteConfig(&b, s.Config(), format); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	b.WriteTo(w)
 }
 
-func (s *HTTPServer) ListenAndServe(addr string) error {
+// httpShutdownTimeout は終了時に処理中のリクエストを待つ時間 (/rib/watch などはこれを過ぎたら切る)
+const httpShutdownTimeout = 5 * time.Second
+
+// ListenAndServe は ctx が終了するまで addr で API を提供する
+func (s *HTTPServer) ListenAndServe(ctx context.Context, addr string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/rib", s.handleRIB)
+	mux.HandleFunc("/rib/lookup", s.handleLookup)
+	mux.HandleFunc("/rib/watch", s.handleWatch)
 	mux.HandleFunc("/network/add", s.handleNetworkAdd)
 	mux.HandleFunc("/network/delete", s.handleNetworkDelete)
-	return http.ListenAndServe(addr, mux)
+	mux.HandleFunc("/neighbors", s.handleNeighbors)
+	mux.HandleFunc("/neighbor/received-routes", s.handleAdjRIB(true))
+	mux.HandleFunc("/neighbor/advertised-routes", s.handleAdjRIB(false))
+	mux.HandleFunc("/neighbor/soft-reset-in", s.handleSoftResetIn)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/config/reload", s.handleConfigReload)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close()
+		}
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
 }
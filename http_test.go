@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSoftResetIn(t *testing.T) {
+	tests := []struct {
+		name        string
+		negotiated  NegotiatedCapabilities
+		state       State
+		wantStatus  int
+		wantRefresh bool
+	}{
+		{
+			name:        "route refresh",
+			negotiated:  NegotiatedCapabilities{AddressFamilies: ipv4Only.AddressFamilies, FourOctetAS: true, RouteRefresh: true},
+			state:       StateEstablished,
+			wantStatus:  http.StatusAccepted,
+			wantRefresh: true,
+		},
+		{
+			name:       "route refresh is not negotiated",
+			negotiated: ipv4Only,
+			state:      StateEstablished,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not established",
+			negotiated: NegotiatedCapabilities{AddressFamilies: ipv4Only.AddressFamilies, FourOctetAS: true, RouteRefresh: true},
+			state:      StateOpenConfirm,
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rib := NewRIB()
+			p := newTestPeer(t, "10.0.0.2", 65002, rib, tt.negotiated)
+			p.setState(tt.state)
+			peers := NewListener()
+			peers.AddPeer(p.Peer)
+			s := &HTTPServer{AF: IPv4Unicast, RIB: rib, Peers: peers}
+
+			// Run の代わりにイベントを 1 つ処理する
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				select {
+				case e := <-p.eventChan:
+					p.handleEvent(e)
+				case <-time.After(time.Second):
+				}
+			}()
+			w := httptest.NewRecorder()
+			s.handleSoftResetIn(w, httptest.NewRequest(http.MethodPost, "/neighbor/soft-reset-in?neighbor=10.0.0.2", nil))
+			<-done
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if !tt.wantRefresh {
+				return
+			}
+			if m, ok := p.receive(t).(RouteRefreshMessage); !ok || m.AF != IPv4Unicast || m.Subtype != RouteRefreshSubtypeNormal {
+				t.Errorf("received %+v, want ROUTE-REFRESH", m)
+			}
+		})
+	}
+}
+
+func TestNetworkAdd(t *testing.T) {
+	peers := func(afs ...AddressFamily) []PeerConfig {
+		pc := PeerConfig{AddressFamilies: make(map[AddressFamily]AddressFamilyConfig)}
+		for _, af := range afs {
+			pc.AddressFamilies[af] = AddressFamilyConfig{}
+		}
+		return []PeerConfig{pc}
+	}
+	tests := []struct {
+		name       string
+		prefix     string
+		peers      []PeerConfig
+		wantStatus int
+	}{
+		{"ipv4", "10.1.0.0/16", peers(IPv4Unicast), http.StatusAccepted},
+		{"no neighbors", "10.1.0.0/16", nil, http.StatusAccepted},
+		{"ipv6 prefix", "2001:db8::/32", peers(IPv4Unicast, IPv6Unicast), http.StatusBadRequest},
+		{"ipv4-mapped prefix", "::ffff:10.1.0.0/112", peers(IPv4Unicast, IPv6Unicast), http.StatusBadRequest},
+		{"not configured on neighbors", "10.1.0.0/16", peers(IPv6Unicast), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rib := NewRIB()
+			s := &HTTPServer{
+				AF:     IPv4Unicast,
+				RIB:    rib,
+				Peers:  NewListener(),
+				Config: func() Config { return Config{Peers: tt.peers} },
+			}
+			w := httptest.NewRecorder()
+			s.handleNetworkAdd(w, httptest.NewRequest(http.MethodPost, "/network/add", strings.NewReader(`{"prefix":"`+tt.prefix+`"}`)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if n := len(rib.Entries()); (n == 1) != (tt.wantStatus == http.StatusAccepted) {
+				t.Errorf("RIB has %d routes", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Listener は相手からの TCP 接続を受け付けて、設定されたピアの FSM に渡す
+type Listener struct {
+	mutex *sync.RWMutex
+	peers map[string]*Peer // key: 正規化した相手のアドレス
+
+	// Serve で接続を受け付けている listener と、Close したか
+	ln     net.Listener
+	closed bool
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		mutex: new(sync.RWMutex),
+		peers: make(map[string]*Peer),
+	}
+}
+
+func normalizeAddress(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	return ip.String()
+}
+
+func (l *Listener) AddPeer(p *Peer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.peers[normalizeAddress(p.NeighborAddress)] = p
+}
+
+func (l *Listener) RemovePeer(p *Peer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := normalizeAddress(p.NeighborAddress)
+	if l.peers[key] == p {
+		delete(l.peers, key)
+	}
+}
+
+// Peers は全てのピアを相手のアドレス順に返す
+func (l *Listener) Peers() []*Peer {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	keys := make([]string, 0, len(l.peers))
+	for key := range l.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	peers := make([]*Peer, len(keys))
+	for i, key := range keys {
+		peers[i] = l.peers[key]
+	}
+	return peers
+}
+
+// Peer は addr のピアを返す (設定されていなければ nil)
+func (l *Listener) Peer(addr string) *Peer {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.peers[normalizeAddress(addr)]
+}
+
+func (l *Listener) findPeer(addr net.Addr) *Peer {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.peers[tcpAddr.IP.String()]
+}
+
+func (l *Listener) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// Serve は ln で相手からの接続を受け付ける。Close で閉じた場合は nil を返す
+func (l *Listener) Serve(ln net.Listener) error {
+	defer ln.Close()
+	l.mutex.Lock()
+	closed := l.closed
+	l.ln = ln
+	l.mutex.Unlock()
+	if closed {
+		return nil
+	}
+
+	infof("listening BGP connections on %v", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := l.findPeer(conn.RemoteAddr())
+		if p == nil {
+			warnf("reject connection from unknown neighbor: %v", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		infof("accepted connection from %v", conn.RemoteAddr())
+		go p.acceptConnection(conn)
+	}
+}
+
+// Close は接続の受け付けをやめて Serve を終了させる
+func (l *Listener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerClose(t *testing.T) {
+	l := NewListener()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Serve(ln)
+	}()
+	// 知らない相手からの接続は閉じられる
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection from unknown neighbor is not closed")
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve() does not return after Close()")
+	}
+	if conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("listener is still accepting connections")
+	}
+}
+
+func TestListenerCloseBeforeServe(t *testing.T) {
+	l := NewListener()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := l.Serve(ln); err != nil {
+		t.Errorf("Serve() = %v, want nil", err)
+	}
+	if conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("listener is still accepting connections")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel はログの重要度。logLevel より低いログは出さない
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevel = LogLevelInfo
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l := LogLevelDebug; l <= LogLevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level: %q", s)
+}
+
+// logAt は level が logLevel 以上の場合にログを出す (info 以外は先頭に重要度を付ける)
+func logAt(level LogLevel, format string, a ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	if level != LogLevelInfo {
+		format = strings.ToUpper(level.String()) + ": " + format
+	}
+	log.Output(3, fmt.Sprintf(format, a...))
+}
+
+func debugf(format string, a ...interface{}) { logAt(LogLevelDebug, format, a...) }
+func infof(format string, a ...interface{})  { logAt(LogLevelInfo, format, a...) }
+func warnf(format string, a ...interface{})  { logAt(LogLevelWarn, format, a...) }
+func errorf(format string, a ...interface{}) { logAt(LogLevelError, format, a...) }
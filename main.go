@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -15,67 +22,290 @@ func getenvOrDefault(name, def string) string {
 	return v
 }
 
-func loadConfigFile(ribs map[AddressFamily]*RIB) (Config, error) {
-	f, err := os.Open("config.json")
+func getenvBoolOrDefault(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %q", name, v)
+	}
+	return b
+}
+
+// options はコマンドラインの引数 (指定されなければ環境変数) で指定する動作
+type options struct {
+	ConfigPath   string
+	ConfigFormat ConfigFormat
+	APIAddress   string // IPv4 の RIB の API (空の場合は提供しない)
+	API6Address  string // IPv6 の RIB の API (空の場合は提供しない)
+	LogLevel     LogLevel
+	FIB          bool
+	DryRun       bool
+	CheckConfig  bool
+	// ExportConfig が空でなければ、設定ファイルをこの書式に変換して出力する
+	ExportConfig ConfigFormat
+}
+
+func parseOptions() options {
+	var opts options
+	flag.StringVar(&opts.ConfigPath, "config", getenvOrDefault("TAKONOBGP_CONFIG", "config.json"),
+		"path to the config file (env TAKONOBGP_CONFIG)")
+	flag.StringVar(&opts.APIAddress, "api-address", getenvOrDefault("TAKONOBGP_API_ADDRESS", "127.0.0.1:8080"),
+		"listen address of the HTTP API for IPv4 routes, or empty to disable (env TAKONOBGP_API_ADDRESS)")
+	flag.StringVar(&opts.API6Address, "api6-address", getenvOrDefault("TAKONOBGP_API6_ADDRESS", "127.0.0.1:8686"),
+		"listen address of the HTTP API for IPv6 routes, or empty to disable (env TAKONOBGP_API6_ADDRESS)")
+	logLevelName := flag.String("log-level", getenvOrDefault("TAKONOBGP_LOG_LEVEL", "info"),
+		"log level: debug, info, warn or error (env TAKONOBGP_LOG_LEVEL)")
+	flag.BoolVar(&opts.FIB, "fib", getenvBoolOrDefault("TAKONOBGP_FIB", true),
+		"install best routes into the kernel routing table (env TAKONOBGP_FIB)")
+	flag.BoolVar(&opts.DryRun, "dry-run", getenvBoolOrDefault("TAKONOBGP_DRY_RUN", false),
+		"log changes to the kernel routing table instead of applying them (env TAKONOBGP_DRY_RUN)")
+	configFormat := flag.String("config-format", os.Getenv("TAKONOBGP_CONFIG_FORMAT"),
+		"format of the config file: json, yaml or toml (default: by file extension) (env TAKONOBGP_CONFIG_FORMAT)")
+	flag.BoolVar(&opts.CheckConfig, "check-config", false,
+		"validate the config file and exit")
+	exportConfig := flag.String("export-config", "",
+		"print the config file converted to `format` (json, yaml or toml) and exit")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "unexpected arguments: %q\n", flag.Args())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	level, err := ParseLogLevel(*logLevelName)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.LogLevel = level
+
+	opts.ConfigFormat = ConfigFormatFromPath(opts.ConfigPath)
+	if *configFormat != "" {
+		if opts.ConfigFormat, err = ParseConfigFormat(*configFormat); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if *exportConfig != "" {
+		if opts.ExportConfig, err = ParseConfigFormat(*exportConfig); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	return opts
+}
+
+func loadConfigFile(path string, format ConfigFormat, ribs map[AddressFamily]*RIB) (Config, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return Config{}, err
 	}
 	defer f.Close()
 
-	return LoadConfig(f, ribs)
+	return LoadConfig(f, format, ribs)
 }
 
-func main() {
-	ribs := map[AddressFamily]*RIB{
+// checkConfig は設定ファイルを読み込めるかだけを確かめる
+func checkConfig(path string, format ConfigFormat) error {
+	cfg, err := loadConfigFile(path, format, map[AddressFamily]*RIB{
 		IPv4Unicast: NewRIB(),
 		IPv6Unicast: NewRIB(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: OK (%d networks, %d neighbors)\n", path, len(cfg.Networks), len(cfg.Peers))
+	return nil
+}
+
+// exportConfig は設定ファイルを読み込んで、to の書式で標準出力に書き出す
+func exportConfig(path string, format, to ConfigFormat) error {
+	cfg, err := loadConfigFile(path, format, map[AddressFamily]*RIB{
+		IPv4Unicast: NewRIB(),
+		IPv6Unicast: NewRIB(),
+	})
+	if err != nil {
+		return err
 	}
-	for _, rib := range ribs {
-		syncer := FIBSyncer{RIB: rib, managed: make(map[string]struct{})}
-		syncer.Register()
-		defer syncer.Cleanup() // XXX: Unreachable
+	return WriteConfig(os.Stdout, cfg, to)
+}
+
+func main() {
+	opts := parseOptions()
+	if opts.CheckConfig {
+		if err := checkConfig(opts.ConfigPath, opts.ConfigFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", opts.ConfigPath, err)
+			os.Exit(1)
+		}
+		return
 	}
+	if opts.ExportConfig != "" {
+		if err := exportConfig(opts.ConfigPath, opts.ConfigFormat, opts.ExportConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", opts.ConfigPath, err)
+			os.Exit(1)
+		}
+		return
+	}
+	logLevel = opts.LogLevel
 
-	cfg, err := loadConfigFile(ribs)
+	ribs := map[AddressFamily]*RIB{
+		IPv4Unicast: NewRIB(),
+		IPv6Unicast: NewRIB(),
+	}
+	cfg, err := loadConfigFile(opts.ConfigPath, opts.ConfigFormat, ribs)
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
 
-	for _, r := range cfg.Networks {
-		var af AddressFamily
-		switch len(r.IP) {
-		case 4:
-			af = IPv4Unicast
-		case 16:
-			af = IPv6Unicast
-		default:
-			log.Fatalf("invalid network: %v", r)
+	// 前回の起動で追加した経路が FIB に残っていれば、RIB と突き合わせて消す。
+	// Graceful Restart の場合は、全てのピアから経路を受け取り終わるまで残しておく
+	var fib FIB
+	var syncers []*FIBSyncer
+	var restart *restartState
+	if opts.FIB && !opts.DryRun {
+		if fib, err = NewFIB(); errors.Is(err, errFIBUnsupported) {
+			// 経路表を操作できない OS でも、経路を入れないだけで BGP スピーカーとしては動かす
+			warnf("fib: %v, routes will not be installed", err)
+			opts.FIB = false
+		} else if err != nil {
+			log.Fatalf("fib: %v", err)
+		}
+	}
+	if opts.FIB {
+		if opts.DryRun {
+			fib = NewDryRunFIB()
+		}
+		if cfg.GracefulRestart.Enabled {
+			restart = newRestartState(sortedAddressFamilies(ribs), cfg.Peers, time.Duration(cfg.GracefulRestart.RestartTime)*time.Second)
+		}
+		preserved := 0
+		for _, af := range sortedAddressFamilies(ribs) {
+			syncer := NewFIBSyncer(af, ribs[af], fib)
+			if restart != nil {
+				syncer.HoldStale(restart.Done(af))
+			}
+			if err := syncer.Register(); err != nil {
+				log.Fatalf("fib: %v", err)
+			}
+			preserved += syncer.PreservedRoutes()
+			syncers = append(syncers, syncer)
+		}
+		if restart != nil && preserved == 0 {
+			// 経路が残っていなければ再起動ではない
+			restart.Finish()
+			restart = nil
+		}
+		if restart != nil {
+			infof("graceful restart: keep routes in FIB until all neighbors send their routes")
+		}
+	}
+
+	// SIGINT, SIGTERM で全てのピアに Cease を送り、API を止めてから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener := NewListener()
+	router := NewRouter(ctx, ribs, listener, restart, opts.FIB && !opts.DryRun)
+	// 設定ファイルを読み直して、今の設定との差分だけを反映する
+	reload := func() (ReloadResult, error) {
+		cfg, err := loadConfigFile(opts.ConfigPath, opts.ConfigFormat, ribs)
+		if err != nil {
+			errorf("reload config: %v", err)
+			return ReloadResult{}, fmt.Errorf("load config: %w", err)
 		}
-		ribs[af].Update(&RIBEntry{
-			AF:      af,
-			Prefix:  r,
-			Origin:  OriginAttributeIGP,
-			ASPath:  ASPath{Sequence: true, Segments: []uint16{}},
-			NextHop: nil,
-		})
-	}
-
-	go (&HTTPServer{
-		AF:  IPv4Unicast,
-		RIB: ribs[IPv4Unicast],
-	}).ListenAndServe("127.0.0.1:8080")
-	go (&HTTPServer{
-		AF:  IPv6Unicast,
-		RIB: ribs[IPv6Unicast],
-	}).ListenAndServe("127.0.0.1:8686")
-
-	for {
-		p := NewPeer(cfg.Peer)
-
-		if err := p.Run(context.TODO()); err != nil {
-			log.Printf("error: %v", err)
+		return router.Apply(cfg), nil
+	}
+
+	var httpWG sync.WaitGroup
+	serveHTTP := func(srv *HTTPServer, addr string) {
+		if addr == "" {
+			return
 		}
+		httpWG.Add(1)
+		go func() {
+			defer httpWG.Done()
+			if err := srv.ListenAndServe(ctx, addr); err != nil {
+				errorf("http: %v", err)
+			}
+		}()
+	}
+	serveHTTP(&HTTPServer{
+		AF:     IPv4Unicast,
+		RIB:    ribs[IPv4Unicast],
+		Peers:  listener,
+		Reload: reload,
+		Config: router.Config,
+	}, opts.APIAddress)
+	serveHTTP(&HTTPServer{
+		AF:     IPv6Unicast,
+		RIB:    ribs[IPv6Unicast],
+		Peers:  listener,
+		Reload: reload,
+		Config: router.Config,
+	}, opts.API6Address)
 
-		time.Sleep(time.Second)
+	listenDone := make(chan struct{})
+	if cfg.ListenAddress != "" {
+		go func() {
+			defer close(listenDone)
+			if err := listener.ListenAndServe(cfg.ListenAddress); err != nil {
+				// 相手からの接続を受け付けられないので、ピアを止めて終了する
+				errorf("listen: %v", err)
+				stop()
+			}
+		}()
+	} else {
+		close(listenDone)
+	}
+
+	// 設定のネットワークを広報して、ピアを動かし始める (失敗しても FSM が自動で再接続する)
+	router.Apply(cfg)
+
+	// SIGHUP で設定を読み直す
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	// SIGUSR1 で Graceful Restart のために、相手と FIB に経路を残したまま終了する
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for ctx.Err() == nil {
+		select {
+		case <-hup:
+			reload()
+		case <-usr1:
+			if !router.Config().GracefulRestart.Enabled {
+				warnf("graceful restart is not configured")
+				continue
+			}
+			infof("shutting down for graceful restart")
+			// ピアの経路が Loc-RIB から消えても FIB に反映しないように、先に止める
+			for _, syncer := range syncers {
+				syncer.Close()
+			}
+			syncers = nil
+			router.Stop(ManualStopEvent{Graceful: true})
+			stop()
+		case <-ctx.Done():
+		}
+	}
+	infof("shutting down")
+	// 止めたピアに新しい接続を渡さないように、最初に接続の受け付けをやめる
+	listener.Close()
+	<-listenDone
+	router.Wait()
+	httpWG.Wait()
+
+	for _, syncer := range syncers {
+		syncer.Cleanup()
+	}
+	if fib != nil {
+		fib.Close()
 	}
 }
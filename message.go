@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,8 +12,32 @@ import (
 const (
 	markerSize = 16
 	headerSize = 19 // marker (16) + length (2) + type (1)
+
+	maxMessageSize = 4096
+	// maxExtendedMessageSize は Extended Message capability を合意した場合の最大の長さ (RFC 8654)
+	maxExtendedMessageSize = 65535
 )
 
+// errMessageTooLong はメッセージが送れる最大の長さを超えている
+var errMessageTooLong = errors.New("message too long")
+
+// maxMessageLength は t のメッセージの最大の長さを返す。extended は Extended Message capability を合意したか
+func maxMessageLength(t MessageType, extended bool) int {
+	// OPEN と KEEPALIVE は合意していても大きくできない (RFC 8654 3)
+	if extended && t != MessageTypeOpen && t != MessageTypeKeepalive {
+		return maxExtendedMessageSize
+	}
+	return maxMessageSize
+}
+
+// checkMessageLength は size byte の t のメッセージを送れるかを確かめる
+func checkMessageLength(t MessageType, size int, extended bool) error {
+	if max := maxMessageLength(t, extended); size > max {
+		return fmt.Errorf("%w: %d bytes (type = %d, max = %d)", errMessageTooLong, size, t, max)
+	}
+	return nil
+}
+
 type MessageType uint8
 
 const (
@@ -20,12 +45,30 @@ const (
 	MessageTypeUpdate
 	MessageTypeNotification
 	MessageTypeKeepalive
+	MessageTypeRouteRefresh
 )
 
+// Message は BGP のメッセージ。
+// WriteTo は長さのフィールドに収まるか (65535 byte まで) しか確かめないので、送るときは writeMessage を使う
 type Message interface {
 	io.WriterTo
 }
 
+// writeMessage は m を w に送る。extended は Extended Message capability を合意したかで、
+// 最大の長さを超える場合は何も送らずに errMessageTooLong を返す
+func writeMessage(w io.Writer, m Message, extended bool) error {
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		return err
+	}
+	t := MessageType(buf.Bytes()[headerSize-1])
+	if err := checkMessageLength(t, buf.Len(), extended); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
 func createHeader(l uint16, t MessageType) [headerSize]byte {
 	var b [headerSize]byte
 	for i := 0; i < markerSize; i++ {
@@ -42,6 +85,9 @@ type UnknownMessage struct {
 }
 
 func (m UnknownMessage) WriteTo(w io.Writer) (int64, error) {
+	if err := checkMessageLength(m.Type, headerSize+len(m.Payload), true); err != nil {
+		return 0, err
+	}
 	buf := bytes.NewBuffer(make([]byte, 0, headerSize+len(m.Payload)))
 	header := createHeader(uint16(headerSize+len(m.Payload)), m.Type)
 	buf.Write(header[:])
@@ -49,7 +95,17 @@ func (m UnknownMessage) WriteTo(w io.Writer) (int64, error) {
 	return buf.WriteTo(w)
 }
 
-func ReadPacket(r io.Reader) (Message, error) {
+// ReadOptions は相手と合意した capability によって変わる、受け取ったメッセージの読み方
+type ReadOptions struct {
+	// AddPath は NLRI に Path Identifier が付いている address family (ADD-PATH で受信を合意したもの)
+	AddPath map[AddressFamily]bool
+	// ExtendedMessage は 4096 byte より大きいメッセージを受け取るか
+	ExtendedMessage bool
+}
+
+// ReadPacket はメッセージを 1 つ読む。
+// 読み方は途中で相手と合意した内容によって変わるので、readOptions (nil なら既定の読み方) はヘッダを受け取ってから呼ぶ
+func ReadPacket(r io.Reader, readOptions func() ReadOptions) (Message, error) {
 	var header [headerSize]byte
 	if _, err := io.ReadFull(r, header[:]); err != nil {
 		return nil, err
@@ -57,13 +113,21 @@ func ReadPacket(r io.Reader) (Message, error) {
 
 	for i := 0; i < markerSize; i++ {
 		if header[i] != 0xFF {
-			return nil, fmt.Errorf("invalid message marker: %x", header[:markerSize])
+			return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeConnectionNotSynchronized, nil,
+				"invalid message marker: %x", header[:markerSize])
 		}
 	}
 
+	var opts ReadOptions
+	if readOptions != nil {
+		opts = readOptions()
+	}
 	size := binary.BigEndian.Uint16(header[markerSize : markerSize+2])
-	if size < headerSize || size > 4096 {
-		return nil, fmt.Errorf("invalid message length: %d", size)
+	t := MessageType(header[headerSize-1])
+	if size < headerSize+t.minimumLength() || int(size) > maxMessageLength(t, opts.ExtendedMessage) {
+		// Data には問題のある Length フィールドを入れる
+		return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeBadMessageLength, header[markerSize:markerSize+2],
+			"invalid message length: %d (type = %d)", size, t)
 	}
 
 	buf := make([]byte, size-headerSize) // TODO: Pool
@@ -71,56 +135,79 @@ func ReadPacket(r io.Reader) (Message, error) {
 		return nil, err
 	}
 
-	t := MessageType(header[headerSize-1])
 	switch t {
 	case MessageTypeOpen:
 		return ParseOpenMessage(buf)
 	case MessageTypeUpdate:
-		return ParseUpdateMessage(buf)
+		return ParseUpdateMessage(buf, opts.AddPath[IPv4Unicast])
 	case MessageTypeNotification:
 		return ParseNotificationMessage(buf)
 	case MessageTypeKeepalive:
 		return ParseKeepaliveMessage(buf)
+	case MessageTypeRouteRefresh:
+		return ParseRouteRefreshMessage(buf)
 	default:
-		payload := make([]byte, len(buf))
-		copy(payload, buf)
-		return &UnknownMessage{
-			Type:    t,
-			Payload: payload,
-		}, nil
+		return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeBadMessageType, []byte{uint8(t)},
+			"unknown message type: %d", t)
+	}
+}
+
+// minimumLength はヘッダを除いたメッセージの最小の長さを返す
+func (t MessageType) minimumLength() uint16 {
+	switch t {
+	case MessageTypeOpen:
+		return 10
+	case MessageTypeUpdate:
+		return 4
+	case MessageTypeNotification:
+		return 2
+	default:
+		return 0
 	}
 }
 
 type OpenMessage struct {
-	Version            uint8
-	MyAS               uint16
-	HoldTime           uint16
-	BGPID              [4]byte
-	OptionalParameters []byte // TODO: Parse
+	Version      uint8
+	MyAS         uint16
+	HoldTime     uint16
+	BGPID        [4]byte
+	Capabilities []Capability
 }
 
 func ParseOpenMessage(buf []byte) (Message, error) {
 	if len(buf) < 10 {
-		return nil, fmt.Errorf("too short open message: len = %d", len(buf))
+		return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeBadMessageLength,
+			binary.BigEndian.AppendUint16(nil, uint16(headerSize+len(buf))),
+			"too short open message: len = %d", len(buf))
 	}
 	if len(buf) != 10+int(buf[9]) {
-		return nil, fmt.Errorf("invalid open message length: expected %d; got %d", 10+buf[10], len(buf))
+		return nil, openMessageError(
+			"invalid open message length: expected %d; got %d", 10+int(buf[9]), len(buf))
 	}
 	var id [4]byte
 	copy(id[:], buf[5:9])
-	opt := make([]byte, buf[9])
-	copy(opt, buf[10:10+buf[9]])
+	caps, err := ParseOptionalParameters(buf[10 : 10+int(buf[9])])
+	if err != nil {
+		return nil, err
+	}
 	return OpenMessage{
-		Version:            buf[0],
-		MyAS:               binary.BigEndian.Uint16(buf[1:3]),
-		HoldTime:           binary.BigEndian.Uint16(buf[3:5]),
-		BGPID:              id,
-		OptionalParameters: opt,
+		Version:      buf[0],
+		MyAS:         binary.BigEndian.Uint16(buf[1:3]),
+		HoldTime:     binary.BigEndian.Uint16(buf[3:5]),
+		BGPID:        id,
+		Capabilities: caps,
 	}, nil
 }
 
 func (m OpenMessage) WriteTo(w io.Writer) (int64, error) {
-	size := headerSize + 10 + len(m.OptionalParameters)
+	opts := CapabilitiesToOptionalParameters(m.Capabilities)
+	if len(opts) > 255 {
+		return 0, fmt.Errorf("too long optional parameters: %d", len(opts))
+	}
+	size := headerSize + 10 + len(opts)
+	if err := checkMessageLength(MessageTypeOpen, size, true); err != nil {
+		return 0, err
+	}
 	buf := bytes.NewBuffer(make([]byte, 0, size))
 
 	header := createHeader(uint16(size), MessageTypeOpen)
@@ -130,8 +217,8 @@ func (m OpenMessage) WriteTo(w io.Writer) (int64, error) {
 	binary.Write(buf, binary.BigEndian, m.MyAS)
 	binary.Write(buf, binary.BigEndian, m.HoldTime)
 	buf.Write(m.BGPID[:])
-	buf.Write([]byte{uint8(len(m.OptionalParameters))})
-	buf.Write(m.OptionalParameters)
+	buf.Write([]byte{uint8(len(opts))})
+	buf.Write(opts)
 
 	return buf.WriteTo(w)
 }
@@ -189,13 +276,22 @@ func (a *PathAttribute) ReadFrom(r io.Reader) (int64, error) {
 	return int64(total) + int64(length), nil
 }
 
+// flags は書き出すときの Attribute Flags を返す (Value が 1 byte の長さに収まらなければ Extended Length を立てる)
+func (a PathAttribute) flags() AttributeFlags {
+	if len(a.Value) > 0xFF {
+		return a.Flags | 0b00010000
+	}
+	return a.Flags
+}
+
 func (a *PathAttribute) WriteTo(w io.Writer) (int64, error) {
-	if n, err := w.Write([]byte{byte(a.Flags), byte(a.TypeCode)}); err != nil {
+	flags := a.flags()
+	if n, err := w.Write([]byte{byte(flags), byte(a.TypeCode)}); err != nil {
 		return int64(n), err
 	}
 	total := 2
 
-	if !a.Flags.ExtendedLength() {
+	if !flags.ExtendedLength() {
 		if n, err := w.Write([]byte{uint8(len(a.Value))}); err != nil {
 			return int64(total + n), fmt.Errorf("path attribute length: %w", err)
 		}
@@ -218,7 +314,7 @@ func (a *PathAttribute) WriteTo(w io.Writer) (int64, error) {
 
 func (a PathAttribute) Len() int {
 	total := 3 + len(a.Value)
-	if a.Flags.ExtendedLength() {
+	if a.flags().ExtendedLength() {
 		total += 1
 	}
 	return total
@@ -234,120 +330,181 @@ func prefixByteLength(maskLength int) int {
 	return (maskLength + 7) / 8
 }
 
-func readIPNet(r *bytes.Reader, bits int) (*net.IPNet, error) {
+// readIPNet は prefix を 1 つ読む。addPath の場合は前に付いている Path Identifier も読む (RFC 7911 3)
+func readIPNet(r *bytes.Reader, bits int, addPath bool) (uint32, *net.IPNet, error) {
+	var pathID uint32
+	if addPath {
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, fmt.Errorf("path identifier: %w", err)
+		}
+		pathID = binary.BigEndian.Uint32(b[:])
+	}
 	var length int
 	if b, err := r.ReadByte(); err != nil {
-		return nil, fmt.Errorf("prefix length: %w", err)
+		return 0, nil, fmt.Errorf("prefix length: %w", err)
 	} else {
 		length = int(b)
 	}
+	if length > bits {
+		return 0, nil, fmt.Errorf("invalid prefix length: %d", length)
+	}
 	mask := net.CIDRMask(length, bits)
 	prefix := make([]byte, bits/8)
 	if _, err := io.ReadFull(r, prefix[:prefixByteLength(length)]); err != nil {
-		return nil, fmt.Errorf("prefix: %w", err)
+		return 0, nil, fmt.Errorf("prefix: %w", err)
 	}
 
-	return &net.IPNet{IP: net.IP(prefix), Mask: mask}, nil
+	// ホスト部のビットが残っていることがあるので、ここで揃えて以降は同じ prefix として扱う
+	return pathID, &net.IPNet{IP: net.IP(prefix).Mask(mask), Mask: mask}, nil
 }
 
-func writeIPNet(w io.Writer, n *net.IPNet) (int, error) {
+// writeIPNet は prefix を 1 つ書く。addPath の場合は前に Path Identifier を付ける
+func writeIPNet(w io.Writer, n *net.IPNet, pathID uint32, addPath bool) (int, error) {
 	length, _ := n.Mask.Size()
-	b := make([]byte, 1+prefixByteLength(length))
-	b[0] = uint8(length)
-	copy(b[1:], n.IP)
+	var b []byte
+	if addPath {
+		b = binary.BigEndian.AppendUint32(b, pathID)
+	}
+	b = append(b, uint8(length))
+	b = append(b, n.IP[:prefixByteLength(length)]...)
 	return w.Write(b)
 }
 
-func ipNetLen(n *net.IPNet) int {
+func ipNetLen(n *net.IPNet, addPath bool) int {
 	length, _ := n.Mask.Size()
+	if addPath {
+		return 4 + 1 + prefixByteLength(length)
+	}
 	return 1 + prefixByteLength(length)
 }
 
+// writeIPNets は routes を順番に書く。pathIDs が nil でなければ同じ順番で Path Identifier を付ける
+func writeIPNets(w io.Writer, routes []*net.IPNet, pathIDs []uint32) {
+	for i, r := range routes {
+		writeIPNet(w, r, pathIDAt(pathIDs, i), pathIDs != nil)
+	}
+}
+
+func ipNetsLen(routes []*net.IPNet, pathIDs []uint32) int {
+	var total int
+	for _, r := range routes {
+		total += ipNetLen(r, pathIDs != nil)
+	}
+	return total
+}
+
+// pathIDAt は pathIDs の i 番目を返す (ADD-PATH を使っていなくて nil なら 0)
+func pathIDAt(pathIDs []uint32, i int) uint32 {
+	if pathIDs == nil {
+		return 0
+	}
+	return pathIDs[i]
+}
+
 type UpdateMessage struct {
 	WirhdrawnRoutes []*net.IPNet
 	PathAttributes  []PathAttribute
 	NLRI            []*net.IPNet
+
+	// ADD-PATH で Path Identifier を付ける場合は、WirhdrawnRoutes, NLRI と同じ順番で入れる (nil なら付けない)
+	WithdrawnPathIDs []uint32
+	NLRIPathIDs      []uint32
 }
 
-func ParseUpdateMessage(buf []byte) (Message, error) {
+// ParseUpdateMessage は UPDATE を読む。addPath は IPv4 Unicast の NLRI に Path Identifier が付いているか
+func ParseUpdateMessage(buf []byte, addPath bool) (Message, error) {
 	r := bytes.NewReader(buf)
 	var b [2]byte
 	var m UpdateMessage
 
 	// Withdrawn Routes
 	if _, err := io.ReadFull(r, b[:]); err != nil {
-		return nil, fmt.Errorf("too short update message: %d", len(buf))
+		return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil, "too short update message: %d", len(buf))
 	}
 	// バイト数であって件数ではないし、かつ variable length なので読んでいかないと何件あるかわからない
 	// r.Len() が残りバイト数なので、これの差分で何バイト読んだかわかる
+	// Withdrawn Routes Length の後ろに Total Path Attribute Length (2 byte) が必要
 	stop := r.Len() - int(binary.BigEndian.Uint16(b[:]))
+	if stop < 2 {
+		return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil,
+			"invalid withdrawn routes length: %d (message length = %d)", binary.BigEndian.Uint16(b[:]), len(buf))
+	}
 	for stop < r.Len() {
-		route, err := readIPNet(r, 32)
+		pathID, route, err := readIPNet(r, 32, addPath)
 		if err != nil {
-			return nil, fmt.Errorf("withdrawn route: %w", err)
+			return nil, updateMessageError(ErrorSubcodeInvalidNetworkField, nil, "withdrawn route: %v", err)
+		}
+		if r.Len() < stop {
+			return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil, "withdrawn route overruns withdrawn routes length: %v", route)
 		}
 		m.WirhdrawnRoutes = append(m.WirhdrawnRoutes, route)
+		if addPath {
+			m.WithdrawnPathIDs = append(m.WithdrawnPathIDs, pathID)
+		}
 	}
 
 	// Path Attributes
-	if _, err := io.ReadFull(r, b[:]); err != nil {
-		return nil, fmt.Errorf("too short update message (no path attributes): %d", len(buf))
-	}
+	io.ReadFull(r, b[:]) // 長さは上でチェック済み
 	stop = r.Len() - int(binary.BigEndian.Uint16(b[:]))
+	if stop < 0 {
+		return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil,
+			"invalid total path attribute length: %d (remaining %d)", binary.BigEndian.Uint16(b[:]), r.Len())
+	}
 	for stop < r.Len() {
 		var a PathAttribute
 		if _, err := a.ReadFrom(r); err != nil {
-			return nil, fmt.Errorf("path attribute: %w", err)
+			return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil, "%v", err)
+		}
+		if r.Len() < stop {
+			return nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil, "path attribute overruns total path attribute length: type = %d", a.TypeCode)
 		}
 		m.PathAttributes = append(m.PathAttributes, a)
 	}
 
 	// NLRI
 	for r.Len() > 0 {
-		route, err := readIPNet(r, 32)
+		pathID, route, err := readIPNet(r, 32, addPath)
 		if err != nil {
-			return nil, fmt.Errorf("nlri: %w", err)
+			return nil, updateMessageError(ErrorSubcodeInvalidNetworkField, nil, "nlri: %v", err)
 		}
 		m.NLRI = append(m.NLRI, route)
+		if addPath {
+			m.NLRIPathIDs = append(m.NLRIPathIDs, pathID)
+		}
 	}
 
 	return m, nil
 }
 
 func (m UpdateMessage) WriteTo(w io.Writer) (int64, error) {
-	var withdrawnLength int
-	for _, r := range m.WirhdrawnRoutes {
-		withdrawnLength += ipNetLen(r)
-	}
+	withdrawnLength := ipNetsLen(m.WirhdrawnRoutes, m.WithdrawnPathIDs)
 	var pathAttributesLength int
 	for _, a := range m.PathAttributes {
 		pathAttributesLength += a.Len()
 	}
-	var nlriLength int
-	for _, r := range m.NLRI {
-		nlriLength += ipNetLen(r)
-	}
+	nlriLength := ipNetsLen(m.NLRI, m.NLRIPathIDs)
 
 	// 4 byte = Withdrawn Routes Length (2 byte) + Path Attributes Length (2 byte)
 	size := headerSize + 4 + withdrawnLength + pathAttributesLength + nlriLength
+	// 相手と合意した最大の長さは送るとき (writeMessage) に確かめる
+	if err := checkMessageLength(MessageTypeUpdate, size, true); err != nil {
+		return 0, err
+	}
 	buf := bytes.NewBuffer(make([]byte, 0, size))
 
 	header := createHeader(uint16(size), MessageTypeUpdate)
 	buf.Write(header[:])
 
 	binary.Write(buf, binary.BigEndian, uint16(withdrawnLength))
-	for _, r := range m.WirhdrawnRoutes {
-		writeIPNet(buf, r)
-	}
+	writeIPNets(buf, m.WirhdrawnRoutes, m.WithdrawnPathIDs)
 
 	binary.Write(buf, binary.BigEndian, uint16(pathAttributesLength))
 	for _, a := range m.PathAttributes {
 		a.WriteTo(buf)
 	}
 
-	for _, r := range m.NLRI {
-		writeIPNet(buf, r)
-	}
+	writeIPNets(buf, m.NLRI, m.NLRIPathIDs)
 
 	return buf.WriteTo(w)
 }
@@ -360,7 +517,9 @@ type NotificationMessage struct {
 
 func ParseNotificationMessage(buf []byte) (Message, error) {
 	if len(buf) < 2 {
-		return nil, fmt.Errorf("too short notification message: %d", len(buf))
+		return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeBadMessageLength,
+			binary.BigEndian.AppendUint16(nil, uint16(headerSize+len(buf))),
+			"too short notification message: %d", len(buf))
 	}
 	data := make([]byte, len(buf)-2)
 	copy(data, buf[2:])
@@ -373,6 +532,9 @@ func ParseNotificationMessage(buf []byte) (Message, error) {
 
 func (m NotificationMessage) WriteTo(w io.Writer) (int64, error) {
 	size := headerSize + 2 + len(m.Data)
+	if err := checkMessageLength(MessageTypeNotification, size, true); err != nil {
+		return 0, err
+	}
 	buf := bytes.NewBuffer(make([]byte, 0, size))
 
 	header := createHeader(uint16(size), MessageTypeNotification)
@@ -388,7 +550,9 @@ type KeepaliveMessage struct {
 
 func ParseKeepaliveMessage(buf []byte) (Message, error) {
 	if len(buf) != 0 {
-		return nil, fmt.Errorf("invalid keepalive message length: %d", len(buf))
+		return nil, NewNotificationError(ErrorCodeMessageHeader, ErrorSubcodeBadMessageLength,
+			binary.BigEndian.AppendUint16(nil, uint16(headerSize+len(buf))),
+			"invalid keepalive message length: %d", len(buf))
 	}
 	return KeepaliveMessage{}, nil
 }
@@ -398,3 +562,48 @@ func (m KeepaliveMessage) WriteTo(w io.Writer) (int64, error) {
 	n, err := w.Write(header[:])
 	return int64(n), err
 }
+
+// RouteRefreshSubtype は ROUTE-REFRESH の Message Subtype (RFC 7313 3.2)
+type RouteRefreshSubtype uint8
+
+const (
+	RouteRefreshSubtypeNormal RouteRefreshSubtype = iota
+	RouteRefreshSubtypeBoRR                       // Beginning of Route Refresh
+	RouteRefreshSubtypeEoRR                       // End of Route Refresh
+)
+
+// RouteRefreshMessage は address family の経路を送り直すように求める (RFC 2918)。
+// Enhanced Route Refresh では送り直す経路の前後にも BoRR, EoRR として送る (RFC 7313)
+type RouteRefreshMessage struct {
+	AF      AddressFamily
+	Subtype RouteRefreshSubtype
+}
+
+func ParseRouteRefreshMessage(buf []byte) (Message, error) {
+	if len(buf) != 4 {
+		// Data には受け取った ROUTE-REFRESH をそのまま入れる (RFC 7313 5)
+		header := createHeader(uint16(headerSize+len(buf)), MessageTypeRouteRefresh)
+		return nil, NewNotificationError(ErrorCodeRouteRefreshMessage, ErrorSubcodeInvalidRouteRefreshMessageLength,
+			append(header[:], buf...),
+			"invalid route refresh message length: %d", len(buf))
+	}
+	return RouteRefreshMessage{
+		AF: AddressFamily{
+			AFI:  AFI(binary.BigEndian.Uint16(buf[0:2])),
+			SAFI: SAFI(buf[3]),
+		},
+		Subtype: RouteRefreshSubtype(buf[2]),
+	}, nil
+}
+
+func (m RouteRefreshMessage) WriteTo(w io.Writer) (int64, error) {
+	size := headerSize + 4
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+
+	header := createHeader(uint16(size), MessageTypeRouteRefresh)
+	buf.Write(header[:])
+	binary.Write(buf, binary.BigEndian, uint16(m.AF.AFI))
+	buf.Write([]byte{uint8(m.Subtype), uint8(m.AF.SAFI)})
+
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        Message
+		extended bool
+		wantErr  bool
+	}{
+		{"update", UnknownMessage{Type: MessageTypeUpdate, Payload: make([]byte, maxMessageSize-headerSize)}, false, false},
+		{"too long update", UnknownMessage{Type: MessageTypeUpdate, Payload: make([]byte, maxMessageSize-headerSize+1)}, false, true},
+		{"extended update", UnknownMessage{Type: MessageTypeUpdate, Payload: make([]byte, maxMessageSize)}, true, false},
+		{"too long extended update", UnknownMessage{Type: MessageTypeUpdate, Payload: make([]byte, maxExtendedMessageSize-headerSize+1)}, true, true},
+		{"extended notification", NotificationMessage{Data: make([]byte, maxMessageSize)}, true, false},
+		{"too long notification", NotificationMessage{Data: make([]byte, maxMessageSize)}, false, true},
+		// OPEN と KEEPALIVE は合意していても大きくできない
+		{"extended open", UnknownMessage{Type: MessageTypeOpen, Payload: make([]byte, maxMessageSize)}, true, true},
+		{"keepalive", KeepaliveMessage{}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := writeMessage(&b, tt.m, tt.extended)
+			if tt.wantErr {
+				if !errors.Is(err, errMessageTooLong) {
+					t.Errorf("writeMessage() error = %v, want errMessageTooLong", err)
+				}
+				if b.Len() != 0 {
+					t.Errorf("writeMessage() wrote %d bytes", b.Len())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := new(bytes.Buffer)
+			tt.m.WriteTo(want)
+			if !bytes.Equal(b.Bytes(), want.Bytes()) {
+				t.Errorf("writeMessage() wrote %x, want %x", b.Bytes(), want.Bytes())
+			}
+		})
+	}
+}
+
+func TestSendUpdateTooLong(t *testing.T) {
+	p := NewPeer(PeerConfig{
+		MyAS:            65001,
+		RouterID:        [4]byte{10, 0, 0, 1},
+		NeighborAddress: "10.0.0.2",
+		RemoteAS:        65002,
+		AddressFamilies: map[AddressFamily]AddressFamilyConfig{
+			IPv4Unicast: {SelfNextHop: net.ParseIP("10.0.0.1").To4(), LocalRIB: NewRIB()},
+		},
+	})
+	p.negotiated = NegotiatedCapabilities{
+		AddressFamilies: map[AddressFamily]struct{}{IPv4Unicast: {}},
+		FourOctetAS:     true,
+	}
+	p.setState(StateEstablished)
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	p.conn = conn
+	received := make(chan Message, 2)
+	go func() {
+		defer remote.Close()
+		for {
+			m, err := ReadPacket(remote, nil)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- m
+		}
+	}()
+
+	_, prefix, _ := net.ParseCIDR("10.2.0.0/16")
+	e := &RIBEntry{
+		AF:     IPv4Unicast,
+		Prefix: prefix,
+		Origin: OriginAttributeIGP,
+		ASPath: NewASPath(65003),
+	}
+	if err := p.sendUpdate(e, 0); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	// 属性が大きくなって UPDATE に収まらなくなったら、前に広報した経路を取り消す
+	large := *e
+	large.OtherAttributes = []PathAttribute{{Flags: 0b11000000, TypeCode: 200, Value: make([]byte, maxMessageSize)}}
+	if err := p.sendUpdate(&large, 0); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := (<-received).(UpdateMessage)
+	if !ok || len(m.WirhdrawnRoutes) != 1 || len(m.NLRI) != 0 {
+		t.Errorf("received %+v, want withdrawal", m)
+	}
+	if got := p.adjRIBOut[IPv4Unicast].Find(prefix, 0); got != nil {
+		t.Errorf("Adj-RIB-Out has %v", got.Prefix)
+	}
+	if got := p.Status().DroppedRoutes[IPv4Unicast]; got != 1 {
+		t.Errorf("DroppedRoutes = %d, want 1", got)
+	}
+}
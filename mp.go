@@ -16,14 +16,16 @@ type MPReachNLRI struct {
 	AF      AddressFamily
 	NextHop []net.IP
 	NLRI    []*net.IPNet
+	// ADD-PATH で Path Identifier を付ける場合は、NLRI と同じ順番で入れる (nil なら付けない)
+	PathIDs []uint32
 }
 
-func MPReachNLRIFromPathAttribute(a PathAttribute) (MPReachNLRI, error) {
+func MPReachNLRIFromPathAttribute(a PathAttribute, opts ReadOptions) (MPReachNLRI, error) {
 	if a.TypeCode != AttributeTypeMPReachNLRI {
 		return MPReachNLRI{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
 	}
-	if len(a.Value) < 4 {
-		return MPReachNLRI{}, fmt.Errorf("invalid length: %d", len(a.Value))
+	if len(a.Value) < 5 {
+		return MPReachNLRI{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "invalid MP_REACH_NLRI length: %d", len(a.Value))
 	}
 
 	v := MPReachNLRI{
@@ -32,21 +34,33 @@ func MPReachNLRIFromPathAttribute(a PathAttribute) (MPReachNLRI, error) {
 			SAFI: SAFI(a.Value[2]),
 		},
 	}
+	if !v.AF.Known() {
+		// 知らない address family は中身を解釈できないので AF だけ返す
+		return v, nil
+	}
 
-	v.NextHop = make([]net.IP, a.Value[3]/byte(v.AF.NextHopSize()))
+	nextHopLength := int(a.Value[3])
+	if len(a.Value) < 5+nextHopLength || nextHopLength == 0 || nextHopLength%v.AF.NextHopSize() != 0 {
+		return MPReachNLRI{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "invalid next hop length: %d", nextHopLength)
+	}
+	v.NextHop = make([]net.IP, nextHopLength/v.AF.NextHopSize())
 	for i := 0; i < len(v.NextHop); i++ {
 		offset := 4 + v.AF.NextHopSize()*i
 		v.NextHop[i] = net.IP(a.Value[offset : offset+v.AF.NextHopSize()])
 	}
 
-	r := bytes.NewReader(a.Value[5+a.Value[3]:])
+	r := bytes.NewReader(a.Value[5+nextHopLength:])
 
+	addPath := opts.AddPath[v.AF]
 	for r.Len() > 0 {
-		route, err := readIPNet(r, v.AF.AddressBits())
+		pathID, route, err := readIPNet(r, v.AF.AddressBits(), addPath)
 		if err != nil {
-			return MPReachNLRI{}, fmt.Errorf("nlri: %w", err)
+			return MPReachNLRI{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "nlri: %v", err)
 		}
 		v.NLRI = append(v.NLRI, route)
+		if addPath {
+			v.PathIDs = append(v.PathIDs, pathID)
+		}
 	}
 
 	return v, nil
@@ -60,9 +74,7 @@ func (a MPReachNLRI) ToPathAttribute() PathAttribute {
 		buf.Write([]byte(a))
 	}
 	buf.Write([]byte{0}) // Reserved
-	for _, r := range a.NLRI {
-		writeIPNet(buf, r)
-	}
+	writeIPNets(buf, a.NLRI, a.PathIDs)
 
 	return PathAttribute{
 		Flags:    0b10000000, // optional non-transitive
@@ -74,14 +86,16 @@ func (a MPReachNLRI) ToPathAttribute() PathAttribute {
 type MPUnreachNLRI struct {
 	AF              AddressFamily
 	WithdrawnRoutes []*net.IPNet
+	// ADD-PATH で Path Identifier を付ける場合は、WithdrawnRoutes と同じ順番で入れる (nil なら付けない)
+	PathIDs []uint32
 }
 
-func MPUnreachNLRIFromPathAttribute(a PathAttribute) (MPUnreachNLRI, error) {
+func MPUnreachNLRIFromPathAttribute(a PathAttribute, opts ReadOptions) (MPUnreachNLRI, error) {
 	if a.TypeCode != AttributeTypeMPUnreachNLRI {
 		return MPUnreachNLRI{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
 	}
 	if len(a.Value) < 3 {
-		return MPUnreachNLRI{}, fmt.Errorf("invalid length: %d", len(a.Value))
+		return MPUnreachNLRI{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "invalid MP_UNREACH_NLRI length: %d", len(a.Value))
 	}
 	v := MPUnreachNLRI{
 		AF: AddressFamily{
@@ -89,14 +103,21 @@ func MPUnreachNLRIFromPathAttribute(a PathAttribute) (MPUnreachNLRI, error) {
 			SAFI: SAFI(a.Value[2]),
 		},
 	}
+	if !v.AF.Known() {
+		return v, nil
+	}
 	r := bytes.NewReader(a.Value[3:])
 
+	addPath := opts.AddPath[v.AF]
 	for r.Len() > 0 {
-		route, err := readIPNet(r, v.AF.AddressBits())
+		pathID, route, err := readIPNet(r, v.AF.AddressBits(), addPath)
 		if err != nil {
-			return MPUnreachNLRI{}, fmt.Errorf("withdrawn: %w", err)
+			return MPUnreachNLRI{}, attributeError(ErrorSubcodeOptionalAttributeError, a, "withdrawn: %v", err)
 		}
 		v.WithdrawnRoutes = append(v.WithdrawnRoutes, route)
+		if addPath {
+			v.PathIDs = append(v.PathIDs, pathID)
+		}
 	}
 
 	return v, nil
@@ -106,9 +127,7 @@ func (a MPUnreachNLRI) ToPathAttribute() PathAttribute {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, uint16(a.AF.AFI))
 	buf.Write([]byte{uint8(a.AF.SAFI)})
-	for _, r := range a.WithdrawnRoutes {
-		writeIPNet(buf, r)
-	}
+	writeIPNets(buf, a.WithdrawnRoutes, a.PathIDs)
 
 	return PathAttribute{
 		Flags:    0b10000000, // optional non-transitive
@@ -0,0 +1,323 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlink で直接カーネルの経路表を操作する (iproute2 の ip route と同じことをする)
+
+const (
+	// fibRouteProtocol は追加する経路の rtm_protocol (他のデーモンが使う RTPROT_BGP などと区別する)
+	fibRouteProtocol uint8 = 200
+	// fibRouteMetric は追加する経路の metric (RTA_PRIORITY)。
+	// 同じ prefix の static, connected, DHCP などの経路を置き換えずに並べて入れ、それらが優先されるように大きくする
+	// (IPv6 の static は 1024、connected は 256)
+	fibRouteMetric uint32 = 2000
+
+	rtTableMain     uint8 = syscall.RT_TABLE_MAIN
+	rtScopeUniverse uint8 = syscall.RT_SCOPE_UNIVERSE
+	rtScopeNowhere  uint8 = syscall.RT_SCOPE_NOWHERE
+	rtnUnicast      uint8 = syscall.RTN_UNICAST
+
+	nlmsgHeaderLength = syscall.NLMSG_HDRLEN
+	rtmsgLength       = syscall.SizeofRtMsg
+
+	// netlinkBatchSize は 1 回の sendto で送るメッセージの数
+	// (ACK が受信バッファに収まらないと ENOBUFS になるので多すぎないようにする)
+	netlinkBatchSize = 128
+)
+
+// nativeEndian は netlink のメッセージで使うホストのバイトオーダー
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+type netlinkFIB struct {
+	mutex *sync.Mutex
+	fd    int
+	seq   uint32
+}
+
+func NewFIB() (FIB, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+	return &netlinkFIB{
+		mutex: new(sync.Mutex),
+		fd:    fd,
+	}, nil
+}
+
+func (f *netlinkFIB) Close() error {
+	return syscall.Close(f.fd)
+}
+
+func (f *netlinkFIB) Apply(ops []FIBOperation) []error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	errs := make([]error, len(ops))
+	for start := 0; start < len(ops); start += netlinkBatchSize {
+		end := start + netlinkBatchSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		f.applyBatch(ops[start:end], errs[start:end])
+	}
+	return errs
+}
+
+// applyBatch は ops をまとめて 1 回で送り、それぞれの ACK を待って結果を errs に入れる
+func (f *netlinkFIB) applyBatch(ops []FIBOperation, errs []error) {
+	var buf []byte
+	pending := make(map[uint32]int, len(ops)) // key: seq, value: ops の index
+	for i, op := range ops {
+		f.seq++
+		b, err := routeMessage(op, f.seq)
+		if err != nil {
+			errs[i] = fmt.Errorf("%v: %w", op.Prefix, err)
+			continue
+		}
+		buf = append(buf, b...)
+		pending[f.seq] = i
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	fail := func(err error) {
+		for _, i := range pending {
+			errs[i] = fmt.Errorf("%v: %w", ops[i].Prefix, err)
+		}
+	}
+	if err := syscall.Sendto(f.fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		fail(fmt.Errorf("netlink send: %w", err))
+		return
+	}
+
+	rb := make([]byte, syscall.Getpagesize()*4)
+	for len(pending) > 0 {
+		n, _, err := syscall.Recvfrom(f.fd, rb, 0)
+		if err != nil {
+			fail(fmt.Errorf("netlink receive: %w", err))
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			fail(fmt.Errorf("netlink parse: %w", err))
+			return
+		}
+		for _, m := range msgs {
+			i, ok := pending[m.Header.Seq]
+			if !ok || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			delete(pending, m.Header.Seq)
+			if len(m.Data) < 4 {
+				errs[i] = fmt.Errorf("%v: too short netlink error message", ops[i].Prefix)
+				continue
+			}
+			errno := -int32(nativeEndian.Uint32(m.Data[0:4]))
+			if errno == 0 || (ops[i].Delete && syscall.Errno(errno) == syscall.ESRCH) {
+				continue // 成功 (削除しようとした経路が既に無い場合も含む)
+			}
+			errs[i] = fmt.Errorf("%v: %w", ops[i].Prefix, syscall.Errno(errno))
+		}
+	}
+}
+
+func (f *netlinkFIB) Routes() ([]FIBRoute, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// 全ての address family の経路を dump して、自分が追加したものだけを返す
+	f.seq++
+	seq := f.seq
+	req := make([]byte, nlmsgHeaderLength+rtmsgLength)
+	nativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:6], syscall.RTM_GETROUTE)
+	nativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(req[8:12], seq)
+	if err := syscall.Sendto(f.fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	var routes []FIBRoute
+	rb := make([]byte, syscall.Getpagesize()*4)
+	for {
+		n, _, err := syscall.Recvfrom(f.fd, rb, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		var done bool
+		if routes, done, err = appendDumpedRoutes(routes, rb[:n], seq); err != nil {
+			return nil, err
+		}
+		if done {
+			return routes, nil
+		}
+	}
+}
+
+// appendDumpedRoutes は 1 回の recvfrom で受け取った dump の結果 b から、自分の追加した経路を routes に加える。
+// dump が終わったかも返す。b は次の受信で上書きされるので、返す経路は b を参照しない
+func appendDumpedRoutes(routes []FIBRoute, b []byte, seq uint32) ([]FIBRoute, bool, error) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, false, fmt.Errorf("netlink parse: %w", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Seq != seq {
+			continue
+		}
+		switch m.Header.Type {
+		case syscall.NLMSG_DONE:
+			return routes, true, nil
+		case syscall.NLMSG_ERROR:
+			if len(m.Data) >= 4 {
+				if errno := -int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, false, fmt.Errorf("netlink dump: %w", syscall.Errno(errno))
+				}
+			}
+			return routes, true, nil
+		case syscall.RTM_NEWROUTE:
+			r, ok, err := parseRouteMessage(&m)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				routes = append(routes, r)
+			}
+		}
+	}
+	return routes, false, nil
+}
+
+// parseRouteMessage は RTM_NEWROUTE メッセージが自分の追加した経路であれば返す
+func parseRouteMessage(m *syscall.NetlinkMessage) (FIBRoute, bool, error) {
+	if len(m.Data) < rtmsgLength {
+		return FIBRoute{}, false, fmt.Errorf("too short route message: %d", len(m.Data))
+	}
+	rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+	if rtm.Protocol != fibRouteProtocol || rtm.Table != rtTableMain {
+		return FIBRoute{}, false, nil
+	}
+	var bits int
+	switch rtm.Family {
+	case syscall.AF_INET:
+		bits = 32
+	case syscall.AF_INET6:
+		bits = 128
+	default:
+		return FIBRoute{}, false, nil
+	}
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return FIBRoute{}, false, fmt.Errorf("parse route attributes: %w", err)
+	}
+	r := FIBRoute{
+		// RTA_DST が無いのはデフォルト経路
+		Prefix: &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(int(rtm.Dst_len), bits)},
+	}
+	// a.Value は受信バッファを指していて次の受信で上書きされるのでコピーする
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case syscall.RTA_DST:
+			r.Prefix.IP = append(net.IP(nil), a.Value...)
+		case syscall.RTA_GATEWAY:
+			r.NextHop = append(net.IP(nil), a.Value...)
+		}
+	}
+	return r, true, nil
+}
+
+// routeMessage は op の RTM_NEWROUTE または RTM_DELROUTE メッセージを作る。
+// 自分の rtm_protocol と metric を指定するので、他の経路を置き換えたり削除したりはしない
+func routeMessage(op FIBOperation, seq uint32) ([]byte, error) {
+	length, bits := op.Prefix.Mask.Size()
+	var family uint8
+	var dst, gw net.IP
+	switch bits {
+	case 32:
+		family = syscall.AF_INET
+		dst = op.Prefix.IP.To4()
+		gw = op.NextHop.To4()
+	case 128:
+		family = syscall.AF_INET6
+		dst = op.Prefix.IP.To16()
+		gw = op.NextHop.To16()
+	default:
+		return nil, fmt.Errorf("invalid prefix: %v", op.Prefix)
+	}
+	if !op.Delete && gw == nil {
+		return nil, fmt.Errorf("invalid next hop: %v", op.NextHop)
+	}
+
+	msgType := uint16(syscall.RTM_NEWROUTE)
+	// 置き換えは同じ metric の経路だけが対象になる。追加では同じ metric の経路が既にあれば EEXIST になる
+	flags := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_EXCL)
+	if op.Replace {
+		flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE
+	}
+	scope, typ := rtScopeUniverse, rtnUnicast
+	if op.Delete {
+		msgType = syscall.RTM_DELROUTE
+		flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+		scope, typ = rtScopeNowhere, 0
+	}
+
+	b := make([]byte, nlmsgHeaderLength+rtmsgLength)
+	// struct rtmsg
+	rtm := b[nlmsgHeaderLength:]
+	rtm[0] = family
+	rtm[1] = uint8(length) // rtm_dst_len
+	rtm[4] = rtTableMain
+	rtm[5] = fibRouteProtocol
+	rtm[6] = scope
+	rtm[7] = typ
+
+	b = appendRouteAttr(b, syscall.RTA_DST, dst.Mask(op.Prefix.Mask))
+	if !op.Delete {
+		b = appendRouteAttr(b, syscall.RTA_GATEWAY, gw)
+		var metric [4]byte
+		nativeEndian.PutUint32(metric[:], fibRouteMetric)
+		b = appendRouteAttr(b, syscall.RTA_PRIORITY, metric[:])
+	}
+
+	// struct nlmsghdr
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], msgType)
+	nativeEndian.PutUint16(b[6:8], flags)
+	nativeEndian.PutUint32(b[8:12], seq)
+	return b, nil
+}
+
+func appendRouteAttr(b []byte, typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, rtaAlign(l))
+	nativeEndian.PutUint16(attr[0:2], uint16(l))
+	nativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestRouteMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       FIBOperation
+		msgType  uint16
+		flags    uint16
+		noFlags  uint16
+		gateway  string
+		priority bool
+	}{
+		{
+			name:     "add",
+			op:       FIBOperation{Prefix: mustParseCIDR(t, "10.1.0.0/16"), NextHop: net.ParseIP("192.0.2.1")},
+			msgType:  syscall.RTM_NEWROUTE,
+			flags:    syscall.NLM_F_CREATE | syscall.NLM_F_EXCL,
+			noFlags:  syscall.NLM_F_REPLACE,
+			gateway:  "192.0.2.1",
+			priority: true,
+		},
+		{
+			name:     "replace",
+			op:       FIBOperation{Replace: true, Prefix: mustParseCIDR(t, "2001:db8::/32"), NextHop: net.ParseIP("2001:db8:ffff::1")},
+			msgType:  syscall.RTM_NEWROUTE,
+			flags:    syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE,
+			noFlags:  syscall.NLM_F_EXCL,
+			gateway:  "2001:db8:ffff::1",
+			priority: true,
+		},
+		{
+			name:    "delete",
+			op:      FIBOperation{Delete: true, Prefix: mustParseCIDR(t, "10.1.0.0/16")},
+			msgType: syscall.RTM_DELROUTE,
+			noFlags: syscall.NLM_F_CREATE | syscall.NLM_F_EXCL | syscall.NLM_F_REPLACE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := routeMessage(tt.op, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := syscall.ParseNetlinkMessage(b)
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("ParseNetlinkMessage() = %d messages, %v", len(msgs), err)
+			}
+			m := msgs[0]
+			if m.Header.Type != tt.msgType {
+				t.Errorf("type = %d, want %d", m.Header.Type, tt.msgType)
+			}
+			if m.Header.Flags&tt.flags != tt.flags || m.Header.Flags&tt.noFlags != 0 {
+				t.Errorf("flags = %#x, want %#x without %#x", m.Header.Flags, tt.flags, tt.noFlags)
+			}
+			rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+			if rtm.Protocol != fibRouteProtocol || rtm.Table != rtTableMain {
+				t.Errorf("protocol = %d, table = %d", rtm.Protocol, rtm.Table)
+			}
+
+			attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gateway net.IP
+			var priority []byte
+			for _, a := range attrs {
+				switch a.Attr.Type {
+				case syscall.RTA_GATEWAY:
+					gateway = net.IP(a.Value)
+				case syscall.RTA_PRIORITY:
+					priority = a.Value
+				}
+			}
+			if tt.gateway != "" && !gateway.Equal(net.ParseIP(tt.gateway)) {
+				t.Errorf("gateway = %v, want %s", gateway, tt.gateway)
+			}
+			if tt.priority && (len(priority) != 4 || nativeEndian.Uint32(priority) != fibRouteMetric) {
+				t.Errorf("priority = %v, want %d", priority, fibRouteMetric)
+			}
+			if !tt.priority && priority != nil {
+				t.Errorf("priority = %v, want none", priority)
+			}
+		})
+	}
+}
+
+// dumpBatch は routes (自分の rtm_protocol) の RTM_NEWROUTE を並べた dump の結果を作る。done の場合は最後に NLMSG_DONE を付ける
+func dumpBatch(t *testing.T, seq uint32, done bool, routes ...FIBRoute) []byte {
+	t.Helper()
+	var b []byte
+	for _, r := range routes {
+		m, err := routeMessage(FIBOperation{Prefix: r.Prefix, NextHop: r.NextHop}, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, m...)
+	}
+	if done {
+		m := make([]byte, nlmsgHeaderLength+4)
+		nativeEndian.PutUint32(m[0:4], uint32(len(m)))
+		nativeEndian.PutUint16(m[4:6], syscall.NLMSG_DONE)
+		nativeEndian.PutUint16(m[6:8], syscall.NLM_F_MULTI)
+		nativeEndian.PutUint32(m[8:12], seq)
+		b = append(b, m...)
+	}
+	return b
+}
+
+func TestAppendDumpedRoutes(t *testing.T) {
+	// 複数回の recvfrom に分かれた dump を、Routes と同じく 1 つの受信バッファで読む
+	batches := [][]FIBRoute{
+		{
+			{Prefix: mustParseCIDR(t, "10.1.0.0/16"), NextHop: net.ParseIP("192.0.2.1")},
+			{Prefix: mustParseCIDR(t, "2001:db8::/32"), NextHop: net.ParseIP("2001:db8:ffff::1")},
+		},
+		{
+			{Prefix: mustParseCIDR(t, "172.16.0.0/12"), NextHop: net.ParseIP("198.51.100.1")},
+			{Prefix: mustParseCIDR(t, "2001:db8:1::/48"), NextHop: net.ParseIP("2001:db8:eeee::1")},
+		},
+	}
+	const seq = 42
+	rb := make([]byte, 4096)
+	var routes []FIBRoute
+	for i, batch := range batches {
+		done := i == len(batches)-1
+		b := dumpBatch(t, seq, done, batch...)
+		for j := range rb {
+			rb[j] = 0xAA // 前の受信の内容を消す
+		}
+		n := copy(rb, b)
+		var gotDone bool
+		var err error
+		routes, gotDone, err = appendDumpedRoutes(routes, rb[:n], seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotDone != done {
+			t.Errorf("batch %d: done = %v, want %v", i, gotDone, done)
+		}
+	}
+
+	var want []FIBRoute
+	for _, batch := range batches {
+		want = append(want, batch...)
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("routes = %v, want %v", routes, want)
+	}
+	for i, r := range routes {
+		if r.Prefix.String() != want[i].Prefix.String() || !r.NextHop.Equal(want[i].NextHop) {
+			t.Errorf("routes[%d] = %v via %v, want %v via %v", i, r.Prefix, r.NextHop, want[i].Prefix, want[i].NextHop)
+		}
+	}
+}
+
+func TestAppendDumpedRoutesIgnoresOtherRoutes(t *testing.T) {
+	const seq = 7
+	b := dumpBatch(t, seq, false, FIBRoute{Prefix: mustParseCIDR(t, "10.1.0.0/16"), NextHop: net.ParseIP("192.0.2.1")})
+	// 他の rtm_protocol の経路と、他の要求への応答
+	other := dumpBatch(t, seq, false, FIBRoute{Prefix: mustParseCIDR(t, "10.2.0.0/16"), NextHop: net.ParseIP("192.0.2.1")})
+	other[nlmsgHeaderLength+5] = syscall.RTPROT_STATIC
+	stray := dumpBatch(t, seq+1, true, FIBRoute{Prefix: mustParseCIDR(t, "10.3.0.0/16"), NextHop: net.ParseIP("192.0.2.1")})
+	b = append(append(b, other...), stray...)
+
+	routes, done, err := appendDumpedRoutes(nil, b, seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(routes) != 1 || routes[0].Prefix.String() != "10.1.0.0/16" {
+		t.Errorf("appendDumpedRoutes() = %v, %v", routes, done)
+	}
+}
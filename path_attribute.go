@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type AttributeTypeCode uint8
@@ -11,6 +13,10 @@ const (
 	AttributeTypeOrigin AttributeTypeCode = iota + 1
 	AttributeTypeASPath
 	AttributeTypeNextHop
+	AttributeTypeMultiExitDisc
+	AttributeTypeLocalPref
+	AttributeTypeAtomicAggregate
+	AttributeTypeAggregator
 	// TODO: Other attributes
 )
 
@@ -27,11 +33,11 @@ func OriginFromPathAttribute(a PathAttribute) (Origin, error) {
 		return 0, fmt.Errorf("invalid type code: %d", a.TypeCode)
 	}
 	if len(a.Value) != 1 {
-		return 0, fmt.Errorf("invalid attribute value length: %d", len(a.Value))
+		return 0, attributeError(ErrorSubcodeAttributeLengthError, a, "invalid attribute value length: %d", len(a.Value))
 	}
 	origin := Origin(a.Value[0])
-	if origin > 3 {
-		return 0, fmt.Errorf("invalid origin value: %v", origin)
+	if origin > OriginAttributeIncomplete {
+		return 0, attributeError(ErrorSubcodeInvalidOriginAttribute, a, "invalid origin value: %v", origin)
 	}
 	return origin, nil
 }
@@ -44,49 +50,182 @@ func (a Origin) ToPathAttribute() PathAttribute {
 	}
 }
 
+// ASPathSegmentType は AS_PATH のセグメントの種類
+type ASPathSegmentType uint8
+
+const (
+	ASPathSegmentSet ASPathSegmentType = iota + 1
+	ASPathSegmentSequence
+)
+
+// maxASPathSegmentLength は 1 つのセグメントに入れられる AS 番号の数 (長さのフィールドが 1 byte)
+const maxASPathSegmentLength = 255
+
+// ASPathSegment は AS_PATH の 1 つのセグメント (AS_SET または AS_SEQUENCE)
+type ASPathSegment struct {
+	Type ASPathSegmentType
+	ASNs []uint32
+}
+
+// ASPath は AS_PATH のセグメントの並び (空の場合は自分の AS 内の経路)
 type ASPath struct {
-	Sequence bool
-	Segments []uint16
+	Segments []ASPathSegment
+}
+
+// NewASPath は ASNs を順に通ってきた AS_SEQUENCE だけの AS_PATH を作る
+func NewASPath(asns ...uint32) ASPath {
+	if len(asns) == 0 {
+		return ASPath{}
+	}
+	return ASPath{Segments: []ASPathSegment{{Type: ASPathSegmentSequence, ASNs: asns}}}
 }
 
-func ASPathFromPathAttribute(a PathAttribute) (ASPath, error) {
+// ASPathFromPathAttribute は AS_PATH をパースする。
+// fourOctet は相手と 4-octet AS を合意しているか (AS 番号が 4 byte でエンコードされているか)
+func ASPathFromPathAttribute(a PathAttribute, fourOctet bool) (ASPath, error) {
 	if a.TypeCode != AttributeTypeASPath {
 		return ASPath{}, fmt.Errorf("invalid type code: %d", a.TypeCode)
 	}
-	if len(a.Value) < 2 {
-		return ASPath{}, fmt.Errorf("too short AS_PATH attribute: %d", len(a.Value))
+	asSize := 2
+	if fourOctet {
+		asSize = 4
 	}
-	length := int(a.Value[1])
-	segments := make([]uint16, length)
-	for i := 0; i < length; i++ {
-		offset := 2 + i*2
-		segments[i] = binary.BigEndian.Uint16(a.Value[offset : offset+2])
+	v, err := parseASPath(a.Value, asSize)
+	if err != nil {
+		return ASPath{}, updateMessageError(ErrorSubcodeMalformedASPath, nil, "%v", err)
 	}
-	return ASPath{
-		Sequence: a.Value[0] == 2,
-		Segments: segments,
-	}, nil
+	return v, nil
 }
 
-func (a ASPath) ToPathAttribute() PathAttribute {
-	b := make([]byte, 2+len(a.Segments)*2)
-	if a.Sequence {
-		b[0] = 2
-	} else {
-		b[0] = 1
+// parseASPath は属性の終わりまで全てのセグメントを読む
+// (空の場合は iBGP で自分の AS から広報された経路など)
+func parseASPath(b []byte, asSize int) (ASPath, error) {
+	var p ASPath
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return ASPath{}, fmt.Errorf("too short AS_PATH segment: %d", len(b))
+		}
+		t, length := ASPathSegmentType(b[0]), int(b[1])
+		if t != ASPathSegmentSet && t != ASPathSegmentSequence {
+			return ASPath{}, fmt.Errorf("invalid AS_PATH segment type: %d", t)
+		}
+		if length == 0 {
+			return ASPath{}, fmt.Errorf("empty AS_PATH segment")
+		}
+		if len(b) < 2+length*asSize {
+			return ASPath{}, fmt.Errorf("invalid AS_PATH segment length: %d (remaining = %d)", length, len(b)-2)
+		}
+		asns := make([]uint32, length)
+		for i := range asns {
+			offset := 2 + i*asSize
+			if asSize == 4 {
+				asns[i] = binary.BigEndian.Uint32(b[offset : offset+4])
+			} else {
+				asns[i] = uint32(binary.BigEndian.Uint16(b[offset : offset+2]))
+			}
+		}
+		p.Segments = append(p.Segments, ASPathSegment{Type: t, ASNs: asns})
+		b = b[2+length*asSize:]
+	}
+	return p, nil
+}
+
+// encode は AS_PATH をエンコードする。255 個より多い AS 番号を持つセグメントは同じ種類のセグメントに分ける
+func (a ASPath) encode(asSize int) []byte {
+	var b []byte
+	for _, s := range a.Segments {
+		for asns := s.ASNs; len(asns) > 0; {
+			n := len(asns)
+			if n > maxASPathSegmentLength {
+				n = maxASPathSegmentLength
+			}
+			b = append(b, byte(s.Type), uint8(n))
+			for _, as := range asns[:n] {
+				if asSize == 4 {
+					b = binary.BigEndian.AppendUint32(b, as)
+				} else {
+					b = binary.BigEndian.AppendUint16(b, twoOctetAS(as))
+				}
+			}
+			asns = asns[n:]
+		}
 	}
-	b[1] = uint8(len(a.Segments))
-	for i, s := range a.Segments {
-		offset := 2 + i*2
-		binary.BigEndian.PutUint16(b[offset:offset+2], s)
+	return b
+}
+
+// ToPathAttribute は AS_PATH を作る。
+// fourOctet でない場合、2 byte に収まらない AS 番号は AS_TRANS に置き換える (本来の値は AS4_PATH で送る)
+func (a ASPath) ToPathAttribute(fourOctet bool) PathAttribute {
+	asSize := 2
+	if fourOctet {
+		asSize = 4
 	}
 	return PathAttribute{
 		Flags:    0b01000000, // well-known transitive
 		TypeCode: AttributeTypeASPath,
-		Value:    b,
+		Value:    a.encode(asSize),
 	}
 }
 
+// HasFourOctetAS は 2 byte に収まらない AS 番号が含まれているかを返す
+func (a ASPath) HasFourOctetAS() bool {
+	for _, s := range a.Segments {
+		for _, as := range s.ASNs {
+			if as > 0xFFFF {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Length は経路選択で使う AS_PATH の長さを返す (AS_SET は中の AS 番号の数によらず 1 つとして数える)
+func (a ASPath) Length() int {
+	n := 0
+	for _, s := range a.Segments {
+		if s.Type == ASPathSegmentSet {
+			n++
+		} else {
+			n += len(s.ASNs)
+		}
+	}
+	return n
+}
+
+// NeighborAS は経路を広報した隣の AS (先頭の AS_SEQUENCE の最初の AS 番号) を返す。
+// 自分の AS 内の経路や AS_SET で始まる場合は 0
+func (a ASPath) NeighborAS() uint32 {
+	if len(a.Segments) == 0 || a.Segments[0].Type != ASPathSegmentSequence {
+		return 0
+	}
+	return a.Segments[0].ASNs[0]
+}
+
+// String は "65002 65003 {64512,64513}" のように AS_SET を {} で囲んだ形にする
+func (a ASPath) String() string {
+	var b strings.Builder
+	for _, s := range a.Segments {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		sep := " "
+		if s.Type == ASPathSegmentSet {
+			b.WriteByte('{')
+			sep = ","
+		}
+		for i, as := range s.ASNs {
+			if i > 0 {
+				b.WriteString(sep)
+			}
+			b.WriteString(strconv.FormatUint(uint64(as), 10))
+		}
+		if s.Type == ASPathSegmentSet {
+			b.WriteByte('}')
+		}
+	}
+	return b.String()
+}
+
 type NextHop []byte
 
 func NextHopFromPathAttribute(a PathAttribute) (NextHop, error) {
@@ -94,7 +233,7 @@ func NextHopFromPathAttribute(a PathAttribute) (NextHop, error) {
 		return nil, fmt.Errorf("invalid type code: %d", a.TypeCode)
 	}
 	if len(a.Value) != 4 {
-		return nil, fmt.Errorf("invalid next hop length: %d", len(a.Value))
+		return nil, attributeError(ErrorSubcodeAttributeLengthError, a, "invalid next hop length: %d", len(a.Value))
 	}
 	return NextHop(a.Value), nil
 }
@@ -106,3 +245,83 @@ func (a NextHop) ToPathAttribute() PathAttribute {
 		Value:    []byte(a),
 	}
 }
+
+type LocalPref uint32
+
+// DefaultLocalPref は LOCAL_PREF が付いていない経路に使う値
+const DefaultLocalPref LocalPref = 100
+
+func LocalPrefFromPathAttribute(a PathAttribute) (LocalPref, error) {
+	if a.TypeCode != AttributeTypeLocalPref {
+		return 0, fmt.Errorf("invalid type code: %d", a.TypeCode)
+	}
+	if len(a.Value) != 4 {
+		return 0, attributeError(ErrorSubcodeAttributeLengthError, a, "invalid local pref length: %d", len(a.Value))
+	}
+	return LocalPref(binary.BigEndian.Uint32(a.Value)), nil
+}
+
+func (a LocalPref) ToPathAttribute() PathAttribute {
+	return PathAttribute{
+		Flags:    0b01000000, // well-known transitive
+		TypeCode: AttributeTypeLocalPref,
+		Value:    binary.BigEndian.AppendUint32(nil, uint32(a)),
+	}
+}
+
+// Contains は AS_PATH のどこかのセグメントに as が含まれているかを返す (AS のループ検出に使う)
+func (a ASPath) Contains(as uint32) bool {
+	for _, s := range a.Segments {
+		for _, v := range s.ASNs {
+			if v == as {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Prepend は先頭に as を追加した AS_PATH を返す (先頭が AS_SET なら AS_SEQUENCE を追加する)
+func (a ASPath) Prepend(as uint32) ASPath {
+	segments := make([]ASPathSegment, 0, len(a.Segments)+1)
+	if len(a.Segments) > 0 && a.Segments[0].Type == ASPathSegmentSequence {
+		first := a.Segments[0]
+		segments = append(segments, ASPathSegment{
+			Type: ASPathSegmentSequence,
+			ASNs: append([]uint32{as}, first.ASNs...),
+		})
+		segments = append(segments, a.Segments[1:]...)
+	} else {
+		segments = append(segments, ASPathSegment{Type: ASPathSegmentSequence, ASNs: []uint32{as}})
+		segments = append(segments, a.Segments...)
+	}
+	return ASPath{Segments: segments}
+}
+
+type MultiExitDisc uint32
+
+func MultiExitDiscFromPathAttribute(a PathAttribute) (MultiExitDisc, error) {
+	if a.TypeCode != AttributeTypeMultiExitDisc {
+		return 0, fmt.Errorf("invalid type code: %d", a.TypeCode)
+	}
+	if len(a.Value) != 4 {
+		return 0, attributeError(ErrorSubcodeAttributeLengthError, a, "invalid multi exit disc length: %d", len(a.Value))
+	}
+	return MultiExitDisc(binary.BigEndian.Uint32(a.Value)), nil
+}
+
+func (a MultiExitDisc) ToPathAttribute() PathAttribute {
+	return PathAttribute{
+		Flags:    0b10000000, // optional non-transitive
+		TypeCode: AttributeTypeMultiExitDisc,
+		Value:    binary.BigEndian.AppendUint32(nil, uint32(a)),
+	}
+}
+
+// value は経路選択で使う値を返す (MED が付いていない場合は 0 として扱う)
+func (a *MultiExitDisc) value() MultiExitDisc {
+	if a == nil {
+		return 0
+	}
+	return *a
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseASPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []byte
+		asSize int
+		want   ASPath
+	}{
+		{"empty", nil, 4, ASPath{}},
+		{
+			name:   "sequence and set",
+			in:     []byte{2, 1, 0xFD, 0xEA, 1, 2, 0xFC, 0x00, 0xFC, 0x01},
+			asSize: 2,
+			want: ASPath{Segments: []ASPathSegment{
+				{Type: ASPathSegmentSequence, ASNs: []uint32{65002}},
+				{Type: ASPathSegmentSet, ASNs: []uint32{64512, 64513}},
+			}},
+		},
+		{
+			name:   "four octet",
+			in:     []byte{2, 2, 0, 1, 0, 0, 0, 0, 0xFD, 0xEA, 2, 1, 0, 0, 0xFD, 0xEB},
+			asSize: 4,
+			want: ASPath{Segments: []ASPathSegment{
+				{Type: ASPathSegmentSequence, ASNs: []uint32{65536, 65002}},
+				{Type: ASPathSegmentSequence, ASNs: []uint32{65003}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseASPath(tt.in, tt.asSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseASPath() = %+v, want %+v", got, tt.want)
+			}
+			if b := got.encode(tt.asSize); !bytes.Equal(b, tt.in) {
+				t.Errorf("encode() = %x, want %x", b, tt.in)
+			}
+		})
+	}
+}
+
+func TestParseASPathErrors(t *testing.T) {
+	for _, in := range [][]byte{
+		{2},                         // セグメントのヘッダが途中で終わっている
+		{2, 2, 0xFD, 0xEA},          // AS 番号が足りない
+		{2, 1, 0xFD, 0xEA, 1},       // 2 つ目のセグメントが途中で終わっている
+		{2, 1, 0xFD, 0xEA, 1, 0},    // 空のセグメント
+		{3, 1, 0xFD, 0xEA},          // AS_CONFED_SEQUENCE には対応していない
+		{2, 1, 0xFD, 0xEA, 0xFD, 0}, // 後ろに余計なものがある
+	} {
+		if v, err := parseASPath(in, 2); err == nil {
+			t.Errorf("parseASPath(%x) = %+v, want error", in, v)
+		}
+	}
+}
+
+func TestASPathEncodeLongSegment(t *testing.T) {
+	asns := make([]uint32, 300)
+	for i := range asns {
+		asns[i] = uint32(64512 + i%2)
+	}
+	p := NewASPath(asns...)
+	b := p.encode(4)
+	if b[0] != 2 || b[1] != 255 || b[2+255*4] != 2 || b[2+255*4+1] != 45 || len(b) != 2+255*4+2+45*4 {
+		t.Fatalf("encode() = %x, want 2 segments of 255 and 45", b)
+	}
+	got, err := parseASPath(b, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Length() != 300 || !reflect.DeepEqual(append(got.Segments[0].ASNs, got.Segments[1].ASNs...), asns) {
+		t.Errorf("parseASPath(encode()) = %v", got)
+	}
+}
+
+func TestASPath(t *testing.T) {
+	p := ASPath{Segments: []ASPathSegment{
+		{Type: ASPathSegmentSequence, ASNs: []uint32{65002, 65003}},
+		{Type: ASPathSegmentSet, ASNs: []uint32{64512, 65001, 64513}},
+	}}
+	// AS_SET は 1 つとして数える
+	if got := p.Length(); got != 3 {
+		t.Errorf("Length() = %d, want 3", got)
+	}
+	if got := p.NeighborAS(); got != 65002 {
+		t.Errorf("NeighborAS() = %d, want 65002", got)
+	}
+	// 後ろのセグメントにある AS もループとして見つける
+	if !p.Contains(65001) || p.Contains(65004) {
+		t.Errorf("Contains() is wrong")
+	}
+	if got := p.String(); got != "65002 65003 {64512,65001,64513}" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := p.Prepend(65001).String(); got != "65001 65002 65003 {64512,65001,64513}" {
+		t.Errorf("Prepend() = %q", got)
+	}
+
+	set := ASPath{Segments: []ASPathSegment{{Type: ASPathSegmentSet, ASNs: []uint32{64512, 64513}}}}
+	if got := set.NeighborAS(); got != 0 {
+		t.Errorf("NeighborAS() = %d, want 0", got)
+	}
+	if got := set.Prepend(65001).String(); got != "65001 {64512,64513}" {
+		t.Errorf("Prepend() = %q", got)
+	}
+	if got := (ASPath{}).Prepend(65001); !reflect.DeepEqual(got, NewASPath(65001)) {
+		t.Errorf("Prepend() = %+v", got)
+	}
+}
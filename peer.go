@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,177 +22,914 @@ const (
 )
 
 type PeerConfig struct {
-	MyAS     uint16
+	MyAS     uint32
 	RouterID [4]byte
 
 	NeighborAddress string
+	RemoteAS        uint32
+	Passive         bool
+	Weight          uint32 // このピアから受け取った経路に付ける Weight
 
 	AddressFamilies map[AddressFamily]AddressFamilyConfig
 
-	HoldTime uint16
+	HoldTime         uint16
+	ConnectRetryTime uint16
+
+	GracefulRestart GracefulRestartConfig
 }
 
 type AddressFamilyConfig struct {
 	SelfNextHop net.IP
 	LocalRIB    *RIB
+	AddPath     AddPathConfig
 }
 
 type Peer struct {
-	MyAS            uint16
+	MyAS            uint32
 	RouterID        [4]byte
 	NeighborAddress string
+	RemoteAS        uint32
+	Passive         bool
+	Weight          uint32
 
 	AddressFamilies map[AddressFamily]AddressFamilyConfig
 
-	HoldTime uint16
+	HoldTime         uint16
+	ConnectRetryTime uint16
+
+	GracefulRestart GracefulRestartConfig
 
 	State State
 	conn  net.Conn
 	wg    *sync.WaitGroup
 
+	// 現在のコネクション (または接続試行) の番号
+	// 閉じたコネクションやタイマーから遅れて届いたイベントを捨てるために使う
+	session    uint64
+	dialCancel context.CancelFunc
+	outbound   bool
+
+	// 衝突解決のために OPEN を交換している最中の、相手から来た別の接続
+	collidingConns map[net.Conn]struct{}
+
+	// エラーで Idle に戻ったときに自動で再開するか (ManualStart から ManualStop まで)
+	automaticStart      bool
+	connectRetryCounter int
+
+	RemoteRouterID [4]byte
+
+	// 相手から受け取った capability と、そこから決まったセッションで使う機能
+	remoteCapabilities []Capability
+	negotiated         NegotiatedCapabilities
+	// 受信する goroutine がメッセージを読むときに使う、negotiated から決まる読み方
+	readOptions atomic.Pointer[ReadOptions]
+
 	stopChan  chan struct{}
 	eventChan chan Event
+	// Stop で Run を終了させるときのイベント
+	stopRequest chan ManualStopEvent
+
+	// 相手の OPEN と自分の HoldTime の小さい方
+	negotiatedHoldTime uint16
 
-	holdTimer      *time.Ticker
-	keepaliveTimer *time.Ticker
+	connectRetryTimer *time.Timer
+	holdTimer         *time.Timer
+	keepaliveTimer    *time.Timer
+	idleHoldTimer     *time.Timer
+	// Enhanced Route Refresh で BoRR を受け取ってから EoRR を待つタイマー
+	refreshTimers map[AddressFamily]*time.Timer
+
+	// Established の間だけ Loc-RIB の変化を購読する
+	ribSubscriptions []*RIBSubscription
+
+	// address family ごとの、相手から受け取った経路と相手に広報した経路
+	adjRIBIn  map[AddressFamily]*AdjRIB
+	adjRIBOut map[AddressFamily]*AdjRIB
+	// ADD-PATH で送っている経路 (key: prefix)
+	sentPaths map[string][]sentPath
+
+	// 相手の再起動の間 Graceful Restart で残している経路の address family
+	staleAFs   map[AddressFamily]struct{}
+	staleUntil time.Time
+	staleTimer *time.Timer
+	// 自分が再起動した直後か (次の OPEN で Graceful Restart capability の Restart State を立てる)
+	restarting bool
+	// 自分が再起動した後の収束を待っている場合に、最初の経路を受け取り終わったことを知らせる先
+	restartState *restartState
+
+	// Status で他の goroutine から読むための状態
+	statusMutex *sync.RWMutex
+	status      PeerStatus
+}
+
+// PeerStatus は API などで他の goroutine から読むためのピアの状態
+type PeerStatus struct {
+	State State
+	// 合意した address family ごとの、最初の経路の交換の状態 (Established の間だけ)
+	Sync map[AddressFamily]SyncStatus
+	// 合意した address family ごとの、属性が大きすぎて UPDATE に収まらずに広報しなかった回数 (Established の間だけ)
+	DroppedRoutes map[AddressFamily]int
+}
 
-	ribOnRemoveID map[*RIB]int
-	ribOnUpdateID map[*RIB]int
+// SyncStatus は 1 つの address family の最初の経路の交換の状態
+type SyncStatus struct {
+	EndOfRIBSent     bool // 最初の経路を全て送った
+	EndOfRIBReceived bool // 相手から最初の経路を全て受け取った (相手が End-of-RIB を送らなければ false のまま)
 }
 
 func NewPeer(cfg PeerConfig) *Peer {
+	adjRIBIn := make(map[AddressFamily]*AdjRIB, len(cfg.AddressFamilies))
+	adjRIBOut := make(map[AddressFamily]*AdjRIB, len(cfg.AddressFamilies))
+	for af := range cfg.AddressFamilies {
+		adjRIBIn[af] = NewAdjRIB()
+		adjRIBOut[af] = NewAdjRIB()
+	}
 	return &Peer{
-		MyAS:            cfg.MyAS,
-		RouterID:        cfg.RouterID,
-		NeighborAddress: cfg.NeighborAddress,
-		AddressFamilies: cfg.AddressFamilies,
-		HoldTime:        cfg.HoldTime,
-		State:           StateIdle,
-		wg:              new(sync.WaitGroup),
-		stopChan:        make(chan struct{}),
-		eventChan:       make(chan Event, 10),
-		ribOnRemoveID:   make(map[*RIB]int),
-		ribOnUpdateID:   make(map[*RIB]int),
+		MyAS:             cfg.MyAS,
+		RouterID:         cfg.RouterID,
+		NeighborAddress:  cfg.NeighborAddress,
+		RemoteAS:         cfg.RemoteAS,
+		Passive:          cfg.Passive,
+		Weight:           cfg.Weight,
+		AddressFamilies:  cfg.AddressFamilies,
+		HoldTime:         cfg.HoldTime,
+		ConnectRetryTime: cfg.ConnectRetryTime,
+		GracefulRestart:  cfg.GracefulRestart,
+		State:            StateIdle,
+		wg:               new(sync.WaitGroup),
+		stopChan:         make(chan struct{}),
+		eventChan:        make(chan Event, 10),
+		stopRequest:      make(chan ManualStopEvent, 1),
+		collidingConns:   make(map[net.Conn]struct{}),
+		adjRIBIn:         adjRIBIn,
+		adjRIBOut:        adjRIBOut,
+		sentPaths:        make(map[string][]sentPath),
+		refreshTimers:    make(map[AddressFamily]*time.Timer),
+		staleAFs:         make(map[AddressFamily]struct{}),
+		statusMutex:      new(sync.RWMutex),
+		status:           PeerStatus{State: StateIdle},
 	}
 }
 
+// shutdownCommunication はプロセスの終了で ctx が終了したときに相手に伝える理由
+const shutdownCommunication = "takonobgp is shutting down"
+
+// Run は ctx が終了するか Stop するまでピアの FSM を動かす。
+// ctx が終了したら Cease (Administrative Shutdown) を送ってセッションを終了してから戻る。
+// panic した場合は、作り直したピアが引き継げるように Graceful Restart で経路を残す
 func (p *Peer) Run(ctx context.Context) error {
 	defer func() {
-		for rib, id := range p.ribOnRemoveID {
-			rib.UnregisterOnRemove(id)
+		r := recover()
+		if r != nil && p.State == StateEstablished && p.negotiated.GracefulRestart {
+			p.retainStaleRoutes()
 		}
-		for rib, id := range p.ribOnUpdateID {
-			rib.UnregisterOnUpdate(id)
+		p.releaseSession()
+		for conn := range p.collidingConns {
+			conn.Close()
 		}
-
-		if p.conn != nil {
-			p.conn.Close()
+		if p.idleHoldTimer != nil {
+			p.idleHoldTimer.Stop()
 		}
-		close(p.stopChan)
-
-		for _, f := range p.AddressFamilies {
-			for _, e := range f.LocalRIB.Entries() {
-				if e.Source == p {
-					f.LocalRIB.Remove(e)
-				}
-			}
+		if p.staleTimer != nil {
+			p.staleTimer.Stop()
 		}
-
+		close(p.stopChan)
 		p.wg.Wait()
+		if r != nil {
+			panic(r)
+		}
 	}()
 
-	p.eventChan <- ManualStartEvent{}
+	p.handleEvent(ManualStartEvent{})
 	for {
 		select {
 		case e := <-p.eventChan:
-			log.Printf("event: %T (%+v)", e, e)
-			if err := e.Do(p); err != nil {
-				return err
-			}
+			p.handleEvent(e)
+		case e := <-p.stopRequest:
+			p.handleEvent(e)
+			return nil
 		case <-ctx.Done():
+			p.handleEvent(ManualStopEvent{Communication: shutdownCommunication})
 			return nil
 		}
 	}
 }
 
+// Stop は e でセッションを止めて Run を終了させる
+func (p *Peer) Stop(e ManualStopEvent) {
+	select {
+	case p.stopRequest <- e:
+	default: // 既に止めている
+	}
+}
+
+// UpdateConfig はセッションを張り直さずに反映できる設定 (Weight, NEXT_HOP など) を反映する
+func (p *Peer) UpdateConfig(cfg PeerConfig) {
+	p.sendEvent(ConfigUpdateEvent{cfg})
+}
+
+// RequestRouteRefresh は af の経路を全て送り直すように相手に求める (soft reset in)。
+// Established でない場合や ROUTE-REFRESH を合意していない場合はエラーを返す
+func (p *Peer) RequestRouteRefresh(af AddressFamily) error {
+	result := make(chan error, 1)
+	p.sendEvent(RouteRefreshRequestEvent{AF: af, Result: result})
+	select {
+	case err := <-result:
+		return err
+	case <-p.stopChan:
+		return errNotEstablished
+	}
+}
+
+// sessionEvent は特定のコネクション (接続試行) に紐付いたイベント
+type sessionEvent struct {
+	session uint64
+	Event
+}
+
+func (p *Peer) handleEvent(e Event) {
+	if se, ok := e.(sessionEvent); ok {
+		if se.session != p.session {
+			p.debugf("drop stale event: %T", se.Event)
+			if e, ok := se.Event.(TcpCRAckedEvent); ok {
+				e.Conn.Close()
+			}
+			return
+		}
+		e = se.Event
+	}
+
+	p.debugf("event: %T (%+v)", e, e)
+	if err := e.Do(p); err != nil {
+		p.warnf("error: %v", err)
+		if p.State == StateEstablished {
+			if p.negotiated.GracefulRestart && errors.Is(err, errTCPConnectionFails) {
+				// 相手が再起動しているかもしれないので、経路を残して再接続を待つ (RFC 4724 4.2)
+				p.retainStaleRoutes()
+			} else {
+				p.purgeStaleRoutes()
+			}
+		}
+		p.notifyError(err)
+		p.releaseSession()
+		p.connectRetryCounter++
+		p.setState(StateIdle)
+		p.scheduleAutomaticStart()
+	}
+}
+
+// エラーで Idle に戻ってから自動で再開するまでの時間
+// 連続で失敗するたびに倍にして、相手の状態が不安定な時に接続を繰り返さないようにする
+const (
+	minIdleHoldTime = time.Second
+	maxIdleHoldTime = 2 * time.Minute
+)
+
+func (p *Peer) idleHoldTime() time.Duration {
+	d := minIdleHoldTime
+	for i := 1; i < p.connectRetryCounter && d < maxIdleHoldTime; i++ {
+		d *= 2
+	}
+	if d > maxIdleHoldTime {
+		d = maxIdleHoldTime
+	}
+	return d
+}
+
+func (p *Peer) scheduleAutomaticStart() {
+	if !p.automaticStart {
+		return
+	}
+	if p.idleHoldTimer != nil {
+		p.idleHoldTimer.Stop()
+	}
+	d := p.idleHoldTime()
+	p.logf("restart after %v", d)
+	p.idleHoldTimer = time.AfterFunc(d, func() {
+		p.sendEvent(AutomaticStartEvent{})
+	})
+}
+
+// start は Idle から接続を開始する
+func (p *Peer) start() {
+	if p.Passive {
+		// 自分からは接続せず、相手からの接続を待つ
+		p.setState(StateActive)
+		return
+	}
+	p.connect()
+	p.startConnectRetryTimer()
+	p.setState(StateConnect)
+}
+
+// acceptConnection は Listener が受け付けた相手からの接続を FSM に渡す
+func (p *Peer) acceptConnection(conn net.Conn) {
+	select {
+	case p.eventChan <- TcpConnectionConfirmedEvent{conn}:
+	case <-p.stopChan:
+		conn.Close()
+	}
+}
+
+// connect は新しい接続試行として相手に TCP 接続を開始する
+func (p *Peer) connect() {
+	p.session++
+	session := p.session
+	ctx, cancel := context.WithCancel(context.Background())
+	p.dialCancel = cancel
+
+	addr := net.JoinHostPort(p.NeighborAddress, "179")
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			p.sendSessionEvent(session, TcpConnectionFailsEvent{err})
+			return
+		}
+		p.sendSessionEvent(session, TcpCRAckedEvent{conn})
+	}()
+}
+
+// openMessage は自分の OPEN メッセージを作る
+func (p *Peer) openMessage() OpenMessage {
+	return OpenMessage{
+		Version:      4,
+		MyAS:         twoOctetAS(p.MyAS),
+		HoldTime:     p.HoldTime,
+		BGPID:        p.RouterID,
+		Capabilities: p.localCapabilities(),
+	}
+}
+
+// openSession は確立した TCP コネクションで OPEN を送り、受信を開始する
+// outbound は自分から開始した接続かどうか (コネクションの衝突解決で使う)
+func (p *Peer) openSession(conn net.Conn, outbound bool) error {
+	p.adoptConnection(conn, outbound)
+	if err := p.sendMessage(p.openMessage()); err != nil {
+		return fmt.Errorf("send open message: %w", err)
+	}
+	p.setState(StateOpenSent)
+	p.startHoldTimer(largeHoldTime)
+	p.startReceiving()
+	return nil
+}
+
+// adoptConnection は conn を現在のコネクションにする
+func (p *Peer) adoptConnection(conn net.Conn, outbound bool) {
+	if p.dialCancel != nil {
+		p.dialCancel()
+		p.dialCancel = nil
+	}
+	p.stopConnectRetryTimer()
+	p.session++
+	p.conn = conn
+	p.outbound = outbound
+}
+
+func (p *Peer) startReceiving() {
+	conn, session := p.conn, p.session
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := p.receiveMessages(conn, session)
+
+		var ev Event = TcpConnectionFailsEvent{err}
+		var nerr *NotificationError
+		if errors.As(err, &nerr) {
+			ev = MessageErrorEvent{nerr}
+		}
+		p.sendSessionEvent(session, ev)
+	}()
+}
+
+// startCollisionDetection は OpenSent 以降に相手から来た別の接続について、
+// OPEN を交換して BGP Identifier が分かった時点で CollidingOpenEvent を送る (RFC 4271 6.8)
+func (p *Peer) startCollisionDetection(conn net.Conn) {
+	p.collidingConns[conn] = struct{}{}
+	open := p.openMessage()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ev := CollidingOpenEvent{Conn: conn}
+		ev.Message, ev.Err = exchangeOpenMessage(conn, open)
+		p.sendEvent(ev)
+	}()
+}
+
+func exchangeOpenMessage(conn net.Conn, open OpenMessage) (OpenMessage, error) {
+	if err := writeMessage(conn, open, false); err != nil {
+		return OpenMessage{}, fmt.Errorf("send open message: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(largeHoldTime))
+	defer conn.SetReadDeadline(time.Time{})
+	m, err := ReadPacket(conn, nil)
+	if err != nil {
+		return OpenMessage{}, err
+	}
+	o, ok := m.(OpenMessage)
+	if !ok {
+		return OpenMessage{}, fmt.Errorf("unexpected message: %T", m)
+	}
+	return o, nil
+}
+
+// takeOverCollidingConn は衝突解決で残した相手からの接続を現在のコネクションにして、受け取った OPEN を処理する
+func (p *Peer) takeOverCollidingConn(conn net.Conn, m OpenMessage) error {
+	delete(p.collidingConns, conn)
+	p.adoptConnection(conn, false)
+	p.setState(StateOpenSent)
+	p.startReceiving()
+	return OpenMessageEvent{m}.Do(p)
+}
+
+// closeCollidingConn は衝突解決で負けた接続に Cease を送って閉じる
+func (p *Peer) closeCollidingConn(conn net.Conn) {
+	delete(p.collidingConns, conn)
+	n := NewNotificationError(ErrorCodeCease, ErrorSubcodeConnectionCollisionResolution, nil, "connection collision").Message()
+	if err := writeMessage(conn, n, false); err != nil {
+		p.warnf("send notification message: %v", err)
+	}
+	conn.Close()
+}
+
+// stop は相手に Cease を送ってセッションを終了し、Idle に戻る
+func (p *Peer) stop(subcode uint8, data []byte) {
+	switch p.State {
+	case StateOpenSent, StateOpenConfirm, StateEstablished:
+		p.notifyError(NewNotificationError(ErrorCodeCease, subcode, data, "stop"))
+	}
+	p.releaseSession()
+	p.setState(StateIdle)
+}
+
+// releaseSession は現在のコネクション (接続試行) に関するリソースを全て解放する
+func (p *Peer) releaseSession() {
+	p.session++
+	if p.dialCancel != nil {
+		p.dialCancel()
+		p.dialCancel = nil
+	}
+	p.stopConnectRetryTimer()
+	p.stopTimers()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+
+	p.unsubscribeLocalRIBs()
+	for af, f := range p.AddressFamilies {
+		if _, ok := p.staleAFs[af]; !ok {
+			for _, e := range p.adjRIBIn[af].Entries() {
+				f.LocalRIB.Remove(e)
+			}
+			p.adjRIBIn[af].Clear()
+		}
+		p.adjRIBOut[af].Clear()
+	}
+	p.sentPaths = make(map[string][]sentPath)
+
+	p.outbound = false
+	p.remoteCapabilities = nil
+	p.negotiated = NegotiatedCapabilities{}
+	p.readOptions.Store(nil)
+	p.negotiatedHoldTime = 0
+}
+
+func (p *Peer) localCapabilities() []Capability {
+	var caps []Capability
+	for _, af := range sortedAddressFamilies(p.AddressFamilies) {
+		caps = append(caps, MultiprotocolExtensionCapability{af})
+	}
+	caps = append(caps, RouteRefreshCapability{}, ExtendedMessageCapability{})
+	if p.GracefulRestart.Enabled {
+		caps = append(caps, p.gracefulRestartCapability())
+	}
+	caps = append(caps, FourOctetASCapability{p.MyAS})
+	if c, ok := p.addPathCapability(); ok {
+		caps = append(caps, c)
+	}
+	return append(caps, EnhancedRouteRefreshCapability{})
+}
+
 func (p *Peer) setState(s State) {
-	log.Printf("peer state changed: %v -> %v", p.State, s)
+	p.logf("peer state changed: %v -> %v", p.State, s)
 	p.State = s
+
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+	p.status.State = s
+	switch s {
+	case StateEstablished:
+		p.status.Sync = make(map[AddressFamily]SyncStatus, len(p.negotiated.AddressFamilies))
+		p.status.DroppedRoutes = make(map[AddressFamily]int, len(p.negotiated.AddressFamilies))
+		for af := range p.negotiated.AddressFamilies {
+			p.status.Sync[af] = SyncStatus{}
+			p.status.DroppedRoutes[af] = 0
+		}
+	default:
+		p.status.Sync = nil
+		p.status.DroppedRoutes = nil
+	}
+}
+
+// Status は他の goroutine から読むためのピアの状態を返す
+func (p *Peer) Status() PeerStatus {
+	p.statusMutex.RLock()
+	defer p.statusMutex.RUnlock()
+
+	s := PeerStatus{State: p.status.State}
+	if p.status.Sync != nil {
+		s.Sync = make(map[AddressFamily]SyncStatus, len(p.status.Sync))
+		for af, v := range p.status.Sync {
+			s.Sync[af] = v
+		}
+	}
+	if p.status.DroppedRoutes != nil {
+		s.DroppedRoutes = make(map[AddressFamily]int, len(p.status.DroppedRoutes))
+		for af, n := range p.status.DroppedRoutes {
+			s.DroppedRoutes[af] = n
+		}
+	}
+	return s
+}
+
+func (p *Peer) updateSyncStatus(af AddressFamily, f func(*SyncStatus)) {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+
+	if v, ok := p.status.Sync[af]; ok {
+		f(&v)
+		p.status.Sync[af] = v
+	}
 }
 
+// countDroppedRoute は af の経路を UPDATE に収まらずに広報しなかったことを Status に記録する
+func (p *Peer) countDroppedRoute(af AddressFamily) {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+
+	if _, ok := p.status.DroppedRoutes[af]; ok {
+		p.status.DroppedRoutes[af]++
+	}
+}
+
+// sendMessage は m を送る。相手と合意した最大の長さを超える場合は送らずに errMessageTooLong を返す
 func (p *Peer) sendMessage(m Message) error {
-	log.Printf("send message: %T (%+v)", m, m)
-	_, err := m.WriteTo(p.conn)
-	return err
+	p.debugf("send message: %T (%+v)", m, m)
+	return writeMessage(p.conn, m, p.negotiated.ExtendedMessage)
+}
+
+// unexpectedStateError はその状態で受け取るべきでないイベントを受け取ったときのエラーを作る
+func (p *Peer) unexpectedStateError() error {
+	var subcode uint8
+	switch p.State {
+	case StateOpenSent:
+		subcode = ErrorSubcodeUnexpectedMessageInOpenSent
+	case StateOpenConfirm:
+		subcode = ErrorSubcodeUnexpectedMessageInOpenConfirm
+	case StateEstablished:
+		subcode = ErrorSubcodeUnexpectedMessageInEstablished
+	}
+	return NewNotificationError(ErrorCodeFiniteStateMachine, subcode, nil, "unexpected state: %v", p.State)
 }
 
-func (p *Peer) receiveMessages() error {
-	log.Printf("receiving messages")
+// notifyError は err が NotificationError であれば相手に NOTIFICATION を送る
+func (p *Peer) notifyError(err error) {
+	var nerr *NotificationError
+	if p.conn == nil || !errors.As(err, &nerr) {
+		return
+	}
+	m := nerr.Message()
+	// 受け取ったメッセージをそのまま Data に入れた場合などで長すぎるときは、送れる長さに切り詰める
+	if max := maxMessageLength(MessageTypeNotification, p.negotiated.ExtendedMessage) - headerSize - 2; len(m.Data) > max {
+		m.Data = m.Data[:max]
+	}
+	if err := p.sendMessage(m); err != nil {
+		p.warnf("send notification message: %v", err)
+	}
+}
+
+func (p *Peer) receiveMessages(conn net.Conn, session uint64) error {
+	p.debugf("receiving messages")
 	for {
-		m, err := ReadPacket(p.conn)
+		m, err := ReadPacket(conn, p.loadReadOptions)
 		if err != nil {
 			return err
 		}
-		log.Printf("received message: %T (%+v)", m, m)
+		p.debugf("received message: %T (%+v)", m, m)
 
 		switch m := m.(type) { // TODO: switch なくしたい
 		case OpenMessage:
-			p.eventChan <- OpenMessageEvent{m}
+			p.sendSessionEvent(session, OpenMessageEvent{m})
 		case UpdateMessage:
-			p.eventChan <- UpdateMessageEvent{m}
+			p.sendSessionEvent(session, UpdateMessageEvent{m})
 		case NotificationMessage:
-			p.eventChan <- NotificationMessageEvent{m}
+			p.sendSessionEvent(session, NotificationMessageEvent{m})
 		case KeepaliveMessage:
-			p.eventChan <- KeepaliveMessageEvent{}
+			p.sendSessionEvent(session, KeepaliveMessageEvent{})
+		case RouteRefreshMessage:
+			p.sendSessionEvent(session, RouteRefreshMessageEvent{m})
 		default:
 		}
 	}
+}
 
+// loadReadOptions は受信する goroutine から、今のセッションで合意したメッセージの読み方を読む
+func (p *Peer) loadReadOptions() ReadOptions {
+	if opts := p.readOptions.Load(); opts != nil {
+		return *opts
+	}
+	return ReadOptions{}
 }
 
-func (p *Peer) startTimers() {
-	p.holdTimer = time.NewTicker(time.Duration(p.HoldTime) * time.Second)
-	p.keepaliveTimer = time.NewTicker(time.Duration(p.HoldTime/3) * time.Second)
-	p.wg.Add(1)
-	go func() {
-		defer p.wg.Done()
-		defer p.holdTimer.Stop()
-		defer p.keepaliveTimer.Stop()
-		for {
-			select {
-			case <-p.holdTimer.C:
-				p.eventChan <- HoldTimerExpireEvent{}
-			case <-p.keepaliveTimer.C:
-				p.eventChan <- KeepaliveTimerExpireEvent{}
-			case <-p.stopChan:
-				return
+// largeHoldTime は OpenSent で使う Hold Time (RFC 4271 8.2.2 では 4 分が推奨されている)
+const largeHoldTime = 4 * time.Minute
+
+// sendEvent はタイマーなどから eventChan にイベントを送る (Run が終了していたら捨てる)
+func (p *Peer) sendEvent(e Event) {
+	select {
+	case p.eventChan <- e:
+	case <-p.stopChan:
+	}
+}
+
+func (p *Peer) sendSessionEvent(session uint64, e Event) {
+	p.sendEvent(sessionEvent{session, e})
+}
+
+// newSessionTimer は d 経過後に現在のセッションのイベントとして e を送るタイマーを作る
+func (p *Peer) newSessionTimer(d time.Duration, e Event) *time.Timer {
+	session := p.session
+	return time.AfterFunc(d, func() {
+		p.sendSessionEvent(session, e)
+	})
+}
+
+func (p *Peer) startConnectRetryTimer() {
+	p.stopConnectRetryTimer()
+	if p.Passive {
+		return // passive の場合は自分から接続しないので不要
+	}
+	p.connectRetryTimer = p.newSessionTimer(time.Duration(p.ConnectRetryTime)*time.Second, ConnectRetryTimerExpireEvent{})
+}
+
+func (p *Peer) stopConnectRetryTimer() {
+	if p.connectRetryTimer != nil {
+		p.connectRetryTimer.Stop()
+		p.connectRetryTimer = nil
+	}
+}
+
+// startHoldTimer は HoldTimer を d で (再) 開始する。d が 0 の場合は停止する
+func (p *Peer) startHoldTimer(d time.Duration) {
+	if p.holdTimer != nil {
+		p.holdTimer.Stop()
+		p.holdTimer = nil
+	}
+	if d == 0 {
+		return
+	}
+	p.holdTimer = p.newSessionTimer(d, HoldTimerExpireEvent{})
+}
+
+// restartHoldTimer は KEEPALIVE や UPDATE を受け取ったときに、合意した Hold Time で HoldTimer を再開する
+func (p *Peer) restartHoldTimer() {
+	p.startHoldTimer(time.Duration(p.negotiatedHoldTime) * time.Second)
+}
+
+// startKeepaliveTimer は合意した Hold Time の 1/3 で KeepaliveTimer を (再) 開始する
+// Hold Time が 0 の場合は KEEPALIVE を送らない
+func (p *Peer) startKeepaliveTimer() {
+	if p.keepaliveTimer != nil {
+		p.keepaliveTimer.Stop()
+		p.keepaliveTimer = nil
+	}
+	if p.negotiatedHoldTime == 0 {
+		return
+	}
+	p.keepaliveTimer = p.newSessionTimer(time.Duration(p.negotiatedHoldTime)*time.Second/3, KeepaliveTimerExpireEvent{})
+}
+
+func (p *Peer) stopTimers() {
+	p.startHoldTimer(0)
+	if p.keepaliveTimer != nil {
+		p.keepaliveTimer.Stop()
+		p.keepaliveTimer = nil
+	}
+	for af := range p.refreshTimers {
+		p.stopRefreshTimer(af)
+	}
+}
+
+// startRefreshTimer は BoRR を受け取ったときに、af の EoRR を待つタイマーを (再) 開始する
+func (p *Peer) startRefreshTimer(af AddressFamily) {
+	p.stopRefreshTimer(af)
+	p.refreshTimers[af] = p.newSessionTimer(routeRefreshStaleTime, RouteRefreshTimerExpireEvent{af})
+}
+
+func (p *Peer) stopRefreshTimer(af AddressFamily) {
+	if t, ok := p.refreshTimers[af]; ok {
+		t.Stop()
+		delete(p.refreshTimers, af)
+	}
+}
+
+// subscribeLocalRIBs は合意した address family の Loc-RIB の変化を購読して、
+// 現在のセッションの LocalRIBUpdateEvent として Run に送る
+// (ADD-PATH で送る address family は全ての経路を購読して LocalRIBPathsUpdateEvent として送る)
+func (p *Peer) subscribeLocalRIBs() {
+	session := p.session
+	for _, af := range sortedAddressFamilies(p.negotiated.AddressFamilies) {
+		af := af
+		addPath := p.negotiated.AddPathSend(af)
+		var s *RIBSubscription
+		if addPath {
+			s = p.AddressFamilies[af].LocalRIB.SubscribeAllPaths(true)
+		} else {
+			s = p.AddressFamilies[af].LocalRIB.Subscribe(true)
+		}
+		p.ribSubscriptions = append(p.ribSubscriptions, s)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for c := range s.C() {
+				if c.EndOfReplay {
+					p.sendSessionEvent(session, LocalRIBReplayedEvent{af})
+					continue
+				}
+				if addPath {
+					p.sendSessionEvent(session, LocalRIBPathsUpdateEvent{AF: af, Prefix: c.Prefix, Paths: c.Paths})
+					continue
+				}
+				var e LocalRIBUpdateEvent
+				if c.Curr == nil {
+					e.Removed = []WithdrawnRoute{{AF: af, Prefix: c.Prefix}}
+				} else {
+					e.Updated = []*RIBEntry{c.Curr}
+				}
+				p.sendSessionEvent(session, e)
+			}
+		}()
+	}
+}
+
+func (p *Peer) unsubscribeLocalRIBs() {
+	for _, s := range p.ribSubscriptions {
+		s.Close()
+	}
+	p.ribSubscriptions = nil
+}
+
+// reapplyAdjRIBIn は受け取った経路に今の設定の Weight を付け直して Loc-RIB に入れ直す
+func (p *Peer) reapplyAdjRIBIn() {
+	for af, f := range p.AddressFamilies {
+		for _, e := range p.adjRIBIn[af].Entries() {
+			updated := *e
+			updated.Weight = p.Weight
+			p.adjRIBIn[af].Update(&updated)
+			if f.LocalRIB.FindPath(e.Prefix, p, e.PathID) != nil { // AS_PATH のループで入れなかった経路は除く
+				f.LocalRIB.Update(&updated)
 			}
 		}
-	}()
+	}
 }
 
-func (p *Peer) registerLocalRIBHandlers() {
-	for _, f := range p.AddressFamilies {
-		rib := f.LocalRIB
-		if _, ok := p.ribOnRemoveID[rib]; !ok {
-			p.ribOnRemoveID[rib] = rib.OnRemove(p.onLocalRIBRemove)
+// resendAdjRIBOut は af で広報した経路を全て送り直す。
+// Enhanced Route Refresh を使う場合は BoRR と EoRR で挟んで、相手が送り直されなかった経路を消せるようにする
+func (p *Peer) resendAdjRIBOut(af AddressFamily) error {
+	if p.negotiated.EnhancedRouteRefresh {
+		if err := p.sendMessage(RouteRefreshMessage{AF: af, Subtype: RouteRefreshSubtypeBoRR}); err != nil {
+			return fmt.Errorf("send route refresh message: %w", err)
 		}
-		if _, ok := p.ribOnUpdateID[rib]; !ok {
-			p.ribOnUpdateID[rib] = rib.OnUpdate(p.onLocalRIBUpdate)
+	}
+	for _, e := range p.adjRIBOut[af].Entries() {
+		if err := p.sendMessage(CreateUpdateMessage(e, p.negotiated.FourOctetAS, p.isInternal(), p.negotiated.AddPathSend(af))); err != nil {
+			return fmt.Errorf("send update message: %w", err)
 		}
 	}
+	if p.negotiated.EnhancedRouteRefresh {
+		if err := p.sendMessage(RouteRefreshMessage{AF: af, Subtype: RouteRefreshSubtypeEoRR}); err != nil {
+			return fmt.Errorf("send route refresh message: %w", err)
+		}
+	}
+	return nil
 }
 
-func (p *Peer) onLocalRIBRemove(e *RIBEntry) error {
-	p.eventChan <- LocalRIBUpdateEvent{
-		Removed: []*net.IPNet{e.Prefix},
+// endOfRIBReceived は相手から af の最初の経路を全て受け取ったときに、
+// Graceful Restart で残していた経路のうち送り直されなかったものを消す
+func (p *Peer) endOfRIBReceived(af AddressFamily) {
+	p.logf("received end-of-rib: %v", af)
+	p.updateSyncStatus(af, func(s *SyncStatus) { s.EndOfRIBReceived = true })
+	if _, ok := p.staleAFs[af]; ok {
+		p.removeStaleRoutes(af)
 	}
-	return nil
+	p.restartState.Synchronized(p.NeighborAddress, af)
 }
 
-func (p *Peer) onLocalRIBUpdate(prev, curr *RIBEntry) error {
-	p.eventChan <- LocalRIBUpdateEvent{
-		Updated: []*RIBEntry{curr},
+// removeStaleRoutes は af で送り直されなかった stale な経路
+// (BoRR から EoRR まで、または Graceful Restart で残してから End-of-RIB まで) を Loc-RIB から取り除く
+func (p *Peer) removeStaleRoutes(af AddressFamily) {
+	delete(p.staleAFs, af)
+	if len(p.staleAFs) == 0 && p.staleTimer != nil {
+		p.staleTimer.Stop()
 	}
+	rib := p.AddressFamilies[af].LocalRIB
+	for _, e := range p.adjRIBIn[af].RemoveStale() {
+		p.debugf("remove stale route: %v", e.Prefix)
+		if path := rib.FindPath(e.Prefix, p, e.PathID); path != nil {
+			rib.Remove(path)
+		}
+	}
+}
+
+// isInternal は相手が iBGP のピアかを返す
+func (p *Peer) isInternal() bool {
+	return p.RemoteAS == p.MyAS
+}
+
+// shouldAdvertise は e をこのピアに広報するかを返す
+func (p *Peer) shouldAdvertise(e *RIBEntry) bool {
+	if _, ok := p.AddressFamilies[e.AF]; !ok {
+		return false
+	}
+	if e.Source == p {
+		return false // 受け取った相手には送り返さない
+	}
+	if e.Source != nil && e.Source.isInternal() && p.isInternal() {
+		return false // iBGP で受け取った経路は他の iBGP ピアに広報しない (split horizon)
+	}
+	if !p.isInternal() && e.ASPath.Contains(p.RemoteAS) {
+		return false // 相手の AS を通ってきた経路は相手に捨てられるので送らない
+	}
+	return true
+}
+
+// sendUpdate は e をこのピア向けに書き換えて UPDATE で送り、Adj-RIB-Out に記録する
+// pathID は ADD-PATH で送る場合に付ける Path Identifier (使っていなければ 0)
+func (p *Peer) sendUpdate(e *RIBEntry, pathID uint32) error {
+	out := p.exportEntry(e)
+	out.PathID = pathID
+	if err := p.sendMessage(CreateUpdateMessage(out, p.negotiated.FourOctetAS, p.isInternal(), p.negotiated.AddPathSend(e.AF))); err != nil {
+		if errors.Is(err, errMessageTooLong) {
+			// 属性が大きすぎて 1 つの UPDATE に収まらない経路は広報しない (前に広報していたものは取り消す)。
+			// 1 つの UPDATE には 1 つの経路しか入れていないので、分けて送ることもできない
+			p.warnf("cannot advertise %v: %v", e.Prefix, err)
+			p.countDroppedRoute(e.AF)
+			return p.sendWithdrawn(WithdrawnRoute{AF: e.AF, Prefix: e.Prefix, PathID: pathID})
+		}
+		return err
+	}
+	p.adjRIBOut[e.AF].Update(out)
 	return nil
 }
+
+// sendWithdrawn は広報済みの経路を取り消す (広報していなければ何もしない)
+func (p *Peer) sendWithdrawn(r WithdrawnRoute) error {
+	if !p.adjRIBOut[r.AF].Remove(r.Prefix, r.PathID) {
+		return nil
+	}
+	return p.sendMessage(CreateWithdrawnMessage(r, p.negotiated.AddPathSend(r.AF)))
+}
+
+// exportEntry はこのピアに広報するために e の属性を書き換えたエントリを返す
+func (p *Peer) exportEntry(e *RIBEntry) *RIBEntry {
+	out := *e
+	out.OtherAttributes = nil
+	if p.isInternal() {
+		// iBGP では NEXT_HOP を変えずに LOCAL_PREF を付けて送る
+		if out.NextHop == nil {
+			out.NextHop = p.AddressFamilies[e.AF].SelfNextHop
+		}
+	} else {
+		// MED は隣の AS にだけ意味があるので、他の AS には送らない
+		out.ASPath = e.ASPath.Prepend(p.MyAS)
+		out.NextHop = p.AddressFamilies[e.AF].SelfNextHop
+		out.MED = nil
+	}
+	for _, a := range e.OtherAttributes {
+		if a.Flags.Optional() && !a.Flags.Transitive() {
+			continue // 解釈していない optional non-transitive な属性は送らない
+		} else if a.Flags.Optional() {
+			// 解釈していない optional transitive な属性には Partial を付ける
+			a.Flags |= 0b00100000
+		}
+		out.OtherAttributes = append(out.OtherAttributes, a)
+	}
+	return &out
+}
+
+// logf はどのピアのログか分かるように相手のアドレスを付けてログを出す
+func (p *Peer) logf(format string, a ...interface{}) {
+	infof("[%s] "+format, append([]interface{}{p.NeighborAddress}, a...)...)
+}
+
+// debugf は送受信したメッセージやイベントなどの詳しいログを出す
+func (p *Peer) debugf(format string, a ...interface{}) {
+	debugf("[%s] "+format, append([]interface{}{p.NeighborAddress}, a...)...)
+}
+
+func (p *Peer) warnf(format string, a ...interface{}) {
+	warnf("[%s] "+format, append([]interface{}{p.NeighborAddress}, a...)...)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPeer は Established のピアと、相手としてそのピアが送ったメッセージを受け取る channel
+type testPeer struct {
+	*Peer
+	received chan Message
+}
+
+// newTestPeer は negotiated を合意して Established になったピアを作る (AddressFamilies は negotiated と同じもの)
+func newTestPeer(t *testing.T, addr string, remoteAS uint32, rib *RIB, negotiated NegotiatedCapabilities) *testPeer {
+	t.Helper()
+	afs := make(map[AddressFamily]AddressFamilyConfig, len(negotiated.AddressFamilies))
+	for af := range negotiated.AddressFamilies {
+		afs[af] = AddressFamilyConfig{SelfNextHop: net.ParseIP("10.0.0.1").To4(), LocalRIB: rib}
+	}
+	p := &testPeer{
+		Peer: NewPeer(PeerConfig{
+			MyAS:            65001,
+			RouterID:        [4]byte{10, 0, 0, 1},
+			NeighborAddress: addr,
+			RemoteAS:        remoteAS,
+			AddressFamilies: afs,
+			HoldTime:        90,
+		}),
+		received: make(chan Message, 100),
+	}
+	p.negotiated = negotiated
+	p.negotiatedHoldTime = 90
+	conn, remote := net.Pipe()
+	p.conn = conn
+	p.setState(StateEstablished)
+
+	// 相手は自分が送ったときと同じ読み方をする
+	opts := ReadOptions{AddPath: make(map[AddressFamily]bool)}
+	for af := range negotiated.AddressFamilies {
+		opts.AddPath[af] = negotiated.AddPathSend(af)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			m, err := ReadPacket(remote, func() ReadOptions { return opts })
+			if err != nil {
+				return
+			}
+			p.received <- m
+		}
+	}()
+	t.Cleanup(func() {
+		close(p.stopChan)
+		p.releaseSession()
+		remote.Close()
+		p.wg.Wait()
+		<-done
+	})
+	return p
+}
+
+// handleNext は次に届いたイベントを処理して返す
+func (p *testPeer) handleNext(t *testing.T) Event {
+	t.Helper()
+	select {
+	case e := <-p.eventChan:
+		p.handleEvent(e)
+		if se, ok := e.(sessionEvent); ok {
+			return se.Event
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("no event")
+		return nil
+	}
+}
+
+// receive は相手が次に受け取ったメッセージを返す
+func (p *testPeer) receive(t *testing.T) Message {
+	t.Helper()
+	select {
+	case m := <-p.received:
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("no message")
+		return nil
+	}
+}
+
+// receiveUpdate は UPDATE を自分が送ったときの形にして返す
+func (p *testPeer) receiveUpdate(t *testing.T) UpdateMessage {
+	t.Helper()
+	m, ok := p.receive(t).(UpdateMessage)
+	if !ok {
+		t.Fatalf("received %T, want UpdateMessage", m)
+	}
+	return m
+}
+
+// parseTestUpdate は m を送って受け取った形にする
+func parseTestUpdate(t *testing.T, m UpdateMessage, addPath bool) UpdateMessage {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if _, err := m.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	v, err := ParseUpdateMessage(b.Bytes()[headerSize:], addPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.(UpdateMessage)
+}
+
+var ipv4Only = NegotiatedCapabilities{
+	AddressFamilies: map[AddressFamily]struct{}{IPv4Unicast: {}},
+	FourOctetAS:     true,
+}
+
+func TestHostBitsWithdrawn(t *testing.T) {
+	rib := NewRIB()
+	a := newTestPeer(t, "10.0.0.2", 65002, rib, ipv4Only)
+	b := newTestPeer(t, "10.0.0.3", 65003, rib, ipv4Only)
+	b.subscribeLocalRIBs()
+	if _, ok := b.handleNext(t).(LocalRIBReplayedEvent); !ok {
+		t.Fatal("want LocalRIBReplayedEvent")
+	}
+	b.receiveUpdate(t) // End-of-RIB
+
+	// ホスト部のビットが残っている prefix (10.0.16.0/20) を受け取る
+	hostBits := &net.IPNet{IP: net.IP{10, 0, 31, 0}, Mask: net.CIDRMask(20, 32)}
+	_, prefix, _ := net.ParseCIDR("10.0.16.0/20")
+	update := parseTestUpdate(t, UpdateMessage{
+		PathAttributes: []PathAttribute{
+			OriginAttributeIGP.ToPathAttribute(),
+			NewASPath(65002).ToPathAttribute(true),
+			NextHop(net.IP{10, 0, 0, 2}).ToPathAttribute(),
+		},
+		NLRI: []*net.IPNet{hostBits},
+	}, false)
+	if err := (UpdateMessageEvent{update}).Do(a.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if a.adjRIBIn[IPv4Unicast].Find(prefix, 0) == nil {
+		t.Errorf("Adj-RIB-In does not have %v", prefix)
+	}
+	b.handleNext(t)
+	if m := b.receiveUpdate(t); len(m.NLRI) != 1 || m.NLRI[0].String() != prefix.String() {
+		t.Errorf("advertised %v, want %v", m.NLRI, prefix)
+	}
+
+	// 同じようにホスト部のビットが残った prefix で取り消す
+	withdrawn := parseTestUpdate(t, UpdateMessage{WirhdrawnRoutes: []*net.IPNet{hostBits}}, false)
+	if err := (UpdateMessageEvent{withdrawn}).Do(a.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.adjRIBIn[IPv4Unicast].Entries()); n != 0 {
+		t.Errorf("Adj-RIB-In has %d routes", n)
+	}
+	b.handleNext(t)
+	if m := b.receiveUpdate(t); len(m.WirhdrawnRoutes) != 1 || m.WirhdrawnRoutes[0].String() != prefix.String() {
+		t.Errorf("withdrawn %v, want %v", m.WirhdrawnRoutes, prefix)
+	}
+	if n := len(b.adjRIBOut[IPv4Unicast].Entries()); n != 0 {
+		t.Errorf("Adj-RIB-Out has %d routes", n)
+	}
+}
+
+func TestConfigUpdatePassive(t *testing.T) {
+	cfg := PeerConfig{
+		MyAS:            65001,
+		RouterID:        [4]byte{10, 0, 0, 1},
+		NeighborAddress: "10.0.0.2",
+		RemoteAS:        65002,
+		AddressFamilies: map[AddressFamily]AddressFamilyConfig{
+			IPv4Unicast: {SelfNextHop: net.ParseIP("10.0.0.1").To4(), LocalRIB: NewRIB()},
+		},
+		Passive:          true,
+		ConnectRetryTime: 120,
+	}
+	p := NewPeer(cfg)
+	defer p.stopConnectRetryTimer()
+	p.setState(StateActive)
+
+	// passive をやめたら、ConnectRetryTimer が切れたときに自分から接続する
+	cfg.Passive = false
+	if err := (ConfigUpdateEvent{cfg}).Do(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.connectRetryTimer == nil {
+		t.Errorf("ConnectRetryTimer is not started")
+	}
+
+	// passive にしたら、接続試行をやめて相手からの接続を待つ
+	cfg.Passive = true
+	if err := (ConfigUpdateEvent{cfg}).Do(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.connectRetryTimer != nil {
+		t.Errorf("ConnectRetryTimer is not stopped")
+	}
+
+	cfg.Passive = false
+	if err := (ConfigUpdateEvent{cfg}).Do(p); err != nil {
+		t.Fatal(err)
+	}
+	p.setState(StateConnect)
+	canceled := false
+	p.dialCancel = func() { canceled = true }
+	cfg.Passive = true
+	if err := (ConfigUpdateEvent{cfg}).Do(p); err != nil {
+		t.Fatal(err)
+	}
+	if !canceled {
+		t.Errorf("connection attempt is not canceled")
+	}
+	if p.connectRetryTimer != nil {
+		t.Errorf("ConnectRetryTimer is not stopped")
+	}
+	if p.State != StateActive {
+		t.Errorf("State = %v, want %v", p.State, StateActive)
+	}
+}
+
+func TestRouteRefreshStaleTimer(t *testing.T) {
+	rib := NewRIB()
+	p := newTestPeer(t, "10.0.0.2", 65002, rib, NegotiatedCapabilities{
+		AddressFamilies:      ipv4Only.AddressFamilies,
+		FourOctetAS:          true,
+		RouteRefresh:         true,
+		EnhancedRouteRefresh: true,
+	})
+	e := &RIBEntry{
+		AF:      IPv4Unicast,
+		Prefix:  mustParseCIDR(t, "10.2.0.0/16"),
+		Origin:  OriginAttributeIGP,
+		ASPath:  NewASPath(65002),
+		NextHop: net.ParseIP("10.0.0.2").To4(),
+		Source:  p.Peer,
+	}
+	p.adjRIBIn[IPv4Unicast].Update(e)
+	rib.Update(e)
+
+	if err := (RouteRefreshMessageEvent{RouteRefreshMessage{AF: IPv4Unicast, Subtype: RouteRefreshSubtypeBoRR}}).Do(p.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.refreshTimers[IPv4Unicast]; !ok {
+		t.Fatalf("timer for end-of-route-refresh is not started")
+	}
+
+	// EoRR が届かないまま時間が過ぎたら、送り直されなかった経路を消す
+	if err := (RouteRefreshTimerExpireEvent{IPv4Unicast}).Do(p.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if p.adjRIBIn[IPv4Unicast].Find(e.Prefix, 0) != nil {
+		t.Errorf("stale route is left in Adj-RIB-In")
+	}
+	if rib.FindPath(e.Prefix, p.Peer, 0) != nil {
+		t.Errorf("stale route is left in Loc-RIB")
+	}
+	if _, ok := p.refreshTimers[IPv4Unicast]; ok {
+		t.Errorf("timer is left after expiration")
+	}
+
+	// EoRR が届いたらタイマーを止める
+	if err := (RouteRefreshMessageEvent{RouteRefreshMessage{AF: IPv4Unicast, Subtype: RouteRefreshSubtypeBoRR}}).Do(p.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if err := (RouteRefreshMessageEvent{RouteRefreshMessage{AF: IPv4Unicast, Subtype: RouteRefreshSubtypeEoRR}}).Do(p.Peer); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.refreshTimers[IPv4Unicast]; ok {
+		t.Errorf("timer is not stopped by end-of-route-refresh")
+	}
+}
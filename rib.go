@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -15,143 +15,240 @@ type RIBEntry struct {
 	ASPath  ASPath
 	NextHop net.IP
 
+	MED        *MultiExitDisc
+	LocalPref  LocalPref
+	Aggregator *Aggregator
+
 	OtherAttributes []PathAttribute
 
-	Source *Peer
+	// Weight は受け取ったピアの設定から付ける、このルーター内だけで使う優先度
+	Weight uint32
+	// PeerRouterID は受け取ったセッションでの相手の BGP Identifier
+	PeerRouterID [4]byte
+
+	Source *Peer // nil の場合は自分で広報しているネットワーク
+	// PathID は ADD-PATH の Path Identifier。Adj-RIB-In と Loc-RIB では Source が付けたもの
+	// (同じ Source からの同じ prefix の経路を見分ける)、Adj-RIB-Out では相手に送るときに自分が付けたもの
+	PathID uint32
+}
+
+// localWeight は自分で広報するネットワークの Weight
+const localWeight = 32768
+
+// NewLocalRIBEntry は自分で広報するネットワークのエントリを作る
+func NewLocalRIBEntry(af AddressFamily, prefix *net.IPNet) *RIBEntry {
+	return &RIBEntry{
+		AF:        af,
+		Prefix:    prefix,
+		Origin:    OriginAttributeIGP,
+		ASPath:    ASPath{},
+		LocalPref: DefaultLocalPref,
+		Weight:    localWeight,
+	}
+}
+
+// ribDestination は 1 つの prefix について、受け取った全ての経路と選ばれた最適経路を持つ
+type ribDestination struct {
+	paths []*RIBEntry // 相手のアドレス順 (自分で広報している経路が先頭、同じ相手からは Path Identifier 順)
+	best  *RIBEntry
 }
 
+// RIB は Loc-RIB。prefix ごとに送信元 (ピアと Path Identifier) ごとの経路を持ち、最適経路が変わったときに購読者に通知する
 type RIB struct {
 	mutex         *sync.RWMutex
-	entries       map[*RIBEntry]struct{}
-	onRemoveFuncs []func(*RIBEntry) error
-	onUpdateFuncs []func(prev, curr *RIBEntry) error
+	destinations  *prefixTrie[*ribDestination]
+	subscriptions map[*RIBSubscription]struct{}
 }
 
 func NewRIB() *RIB {
 	return &RIB{
-		mutex:   new(sync.RWMutex),
-		entries: make(map[*RIBEntry]struct{}),
+		mutex:         new(sync.RWMutex),
+		destinations:  newPrefixTrie[*ribDestination](),
+		subscriptions: make(map[*RIBSubscription]struct{}),
 	}
 }
 
-func (rib *RIB) OnRemove(fn func(*RIBEntry) error) int {
-	rib.mutex.Lock()
-	defer rib.mutex.Unlock()
+// Find は prefix の最適経路を返す
+func (rib *RIB) Find(prefix *net.IPNet) *RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
 
-	for i, f := range rib.onRemoveFuncs {
-		if f == nil {
-			rib.onRemoveFuncs[i] = fn
-			return i
-		}
+	d, ok := rib.destinations.Get(prefix)
+	if !ok {
+		return nil
 	}
-
-	rib.onRemoveFuncs = append(rib.onRemoveFuncs, fn)
-	return len(rib.onRemoveFuncs) - 1
+	return d.best
 }
 
-func (rib *RIB) UnregisterOnRemove(id int) {
-	rib.mutex.Lock()
-	defer rib.mutex.Unlock()
+// LongestMatch は ip を含む最も長い prefix の最適経路を返す
+func (rib *RIB) LongestMatch(ip net.IP) *RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
 
-	rib.onRemoveFuncs[id] = nil
+	_, d, ok := rib.destinations.LongestMatch(ip)
+	if !ok {
+		return nil
+	}
+	return d.best
 }
 
-func (rib *RIB) OnUpdate(fn func(prev, curr *RIBEntry) error) int {
-	rib.mutex.Lock()
-	defer rib.mutex.Unlock()
-
-	for i, f := range rib.onUpdateFuncs {
-		if f == nil {
-			rib.onUpdateFuncs[i] = fn
-			return i
-		}
-	}
+// Covering は prefix を含む (prefix 自身とそれより短い) prefix の最適経路を短い順に返す
+func (rib *RIB) Covering(prefix *net.IPNet) []*RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
 
-	rib.onUpdateFuncs = append(rib.onUpdateFuncs, fn)
-	return len(rib.onUpdateFuncs) - 1
+	var s []*RIBEntry
+	rib.destinations.WalkCovering(prefix, func(_ *net.IPNet, d *ribDestination) bool {
+		s = append(s, d.best)
+		return true
+	})
+	return s
 }
 
-func (rib *RIB) UnregisterOnUpdate(id int) {
-	rib.mutex.Lock()
-	defer rib.mutex.Unlock()
+// Covered は prefix に含まれる (prefix 自身とそれより長い) prefix の最適経路を返す
+func (rib *RIB) Covered(prefix *net.IPNet) []*RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
 
-	rib.onUpdateFuncs[id] = nil
+	var s []*RIBEntry
+	rib.destinations.WalkCovered(prefix, func(_ *net.IPNet, d *ribDestination) bool {
+		s = append(s, d.best)
+		return true
+	})
+	return s
 }
 
-func (rib *RIB) Find(prefix *net.IPNet) *RIBEntry {
+// FindPath は prefix について source から pathID で受け取った経路を返す (source が nil なら自分で広報している経路)
+func (rib *RIB) FindPath(prefix *net.IPNet, source *Peer, pathID uint32) *RIBEntry {
 	rib.mutex.RLock()
 	defer rib.mutex.RUnlock()
-	return rib.find(prefix)
+
+	d, ok := rib.destinations.Get(prefix)
+	if !ok {
+		return nil
+	}
+	if i, ok := d.findPath(source, pathID); ok {
+		return d.paths[i]
+	}
+	return nil
 }
 
-func (rib *RIB) find(prefix *net.IPNet) *RIBEntry {
-	for e := range rib.entries {
-		if e.Prefix.IP.Equal(prefix.IP) && bytes.Equal([]byte(prefix.Mask), []byte(e.Prefix.Mask)) {
-			return e
+func (d *ribDestination) findPath(source *Peer, pathID uint32) (int, bool) {
+	for i, e := range d.paths {
+		if e.Source == source && e.PathID == pathID {
+			return i, true
 		}
 	}
-	return nil
+	return 0, false
 }
 
-func (rib *RIB) Remove(e *RIBEntry) error {
+// Remove は e と同じ送信元 (と Path Identifier) からの e.Prefix の経路を取り除く
+func (rib *RIB) Remove(e *RIBEntry) {
 	rib.mutex.Lock()
 	defer rib.mutex.Unlock()
 
-	delete(rib.entries, e)
-
-	// XXX: ロック取った状態で呼ぶので、こいつらが更に RIB 操作しようとするとデッドロックする
-	for _, onRemove := range rib.onRemoveFuncs {
-		if onRemove == nil {
-			continue
-		}
-		if err := onRemove(e); err != nil {
-			return err
-		}
+	d, ok := rib.destinations.Get(e.Prefix)
+	if !ok {
+		return
 	}
-	return nil
+	i, ok := d.findPath(e.Source, e.PathID)
+	if !ok {
+		return
+	}
+	d.paths = append(d.paths[:i], d.paths[i+1:]...)
+	if len(d.paths) == 0 {
+		rib.destinations.Delete(e.Prefix)
+	}
+	rib.updateBest(e.Prefix, d)
 }
 
-func (rib *RIB) Update(e *RIBEntry) error {
+// Update は e.Source から e.PathID で受け取った e.Prefix の経路を追加 (または置き換え) する
+func (rib *RIB) Update(e *RIBEntry) {
 	rib.mutex.Lock()
 	defer rib.mutex.Unlock()
 
-	prev := rib.find(e.Prefix)
-	if prev != nil {
-		delete(rib.entries, prev)
+	d, ok := rib.destinations.Get(e.Prefix)
+	if !ok {
+		d = &ribDestination{}
+		rib.destinations.Insert(e.Prefix, d)
+	}
+	if i, ok := d.findPath(e.Source, e.PathID); ok {
+		d.paths[i] = e
+	} else {
+		i := sort.Search(len(d.paths), func(i int) bool {
+			return comparePathSource(e, d.paths[i]) < 0
+		})
+		d.paths = append(d.paths, nil)
+		copy(d.paths[i+1:], d.paths[i:])
+		d.paths[i] = e
 	}
-	rib.entries[e] = struct{}{}
+	rib.updateBest(e.Prefix, d)
+}
 
-	// XXX: ロック取った状態で呼ぶので、こいつらが更に RIB 操作しようとするとデッドロックする
-	for _, onUpdate := range rib.onUpdateFuncs {
-		if onUpdate == nil {
-			continue
-		}
-		if err := onUpdate(prev, e); err != nil {
-			return err
+// updateBest は最適経路を選び直して、変わった場合は購読者に通知する
+// (全ての経路を購読している場合は、最適経路が変わらなくても通知する)
+func (rib *RIB) updateBest(prefix *net.IPNet, d *ribDestination) {
+	prev := d.best
+	d.best = selectBestPath(d.paths)
+	var paths []*RIBEntry
+	for s := range rib.subscriptions {
+		switch {
+		case s.allPaths:
+			if paths == nil {
+				paths = rankPaths(d.paths, d.best)
+			}
+			s.push(RIBChange{Prefix: prefix, Prev: prev, Curr: d.best, Paths: paths})
+		case d.best != prev:
+			s.push(RIBChange{Prefix: prefix, Prev: prev, Curr: d.best})
 		}
 	}
-	return nil
 }
 
+// Entries は全ての prefix の最適経路を返す
 func (rib *RIB) Entries() []*RIBEntry {
 	rib.mutex.RLock()
 	defer rib.mutex.RUnlock()
 
-	s := make([]*RIBEntry, 0, len(rib.entries))
-	for e := range rib.entries {
-		s = append(s, e)
-	}
+	s := make([]*RIBEntry, 0, rib.destinations.Len())
+	rib.destinations.Walk(func(_ *net.IPNet, d *ribDestination) bool {
+		s = append(s, d.best)
+		return true
+	})
 	return s
 }
 
+// Paths は最適経路以外も含めて全ての経路を返す
+func (rib *RIB) Paths() []*RIBEntry {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
+
+	var s []*RIBEntry
+	rib.destinations.Walk(func(_ *net.IPNet, d *ribDestination) bool {
+		s = append(s, d.paths...)
+		return true
+	})
+	return s
+}
+
+// IsBest は e が最適経路として選ばれているかを返す
+func (rib *RIB) IsBest(e *RIBEntry) bool {
+	rib.mutex.RLock()
+	defer rib.mutex.RUnlock()
+
+	d, ok := rib.destinations.Get(e.Prefix)
+	return ok && d.best == e
+}
+
 func (rib *RIB) Print(w io.Writer) {
 	rib.mutex.RLock()
 	defer rib.mutex.RUnlock()
 
-	for e := range rib.entries {
+	rib.destinations.Walk(func(_ *net.IPNet, d *ribDestination) bool {
+		e := d.best
 		fmt.Fprintf(w,
 			"- %v (ORIGIN: %v, AS_PATH: %v, NEXTHOP: %v)\n",
-			e.Prefix, e.Origin, e.ASPath.Segments, net.IP(e.NextHop),
+			e.Prefix, e.Origin, e.ASPath, net.IP(e.NextHop),
 		)
-	}
+		return true
+	})
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// RIBChange は RIB のある prefix の最適経路の変化
+type RIBChange struct {
+	Prefix *net.IPNet
+	Prev   *RIBEntry // nil の場合は新しく追加された
+	Curr   *RIBEntry // nil の場合は取り除かれた
+	// Paths は SubscribeAllPaths で購読した場合の、prefix の全ての経路 (最適経路から良い順、変更しないこと)
+	Paths []*RIBEntry
+
+	// EndOfReplay は replay で購読を開始したときに、開始時点の経路を全て届けた後に 1 度だけ届く印
+	// (この場合 Prefix などは空)
+	EndOfReplay bool
+}
+
+// RIBSubscription は RIB の最適経路の変化を順番に受け取る購読
+//
+// 変化は RIB のロックの外から C で届くので、受け取った側で RIB を操作してもよい。
+// 受け取る側が遅れている間は prefix ごとにまとめる (届く前に同じ prefix が再び変わったら、
+// Prev はそのままで Curr だけ新しいものにする) ので、溜まる量は prefix の数までになる
+type RIBSubscription struct {
+	rib      *RIB
+	allPaths bool
+
+	mutex   *sync.Mutex
+	queue   []*RIBChange
+	pending map[string]*RIBChange // key: prefix (queue にあってまだ届けていないもの)
+	notify  chan struct{}
+
+	c    chan RIBChange
+	done chan struct{}
+	once *sync.Once
+}
+
+// Subscribe は RIB の変化の購読を開始する。
+// replay の場合は、購読を開始した時点の全ての最適経路を追加として最初に届ける
+func (rib *RIB) Subscribe(replay bool) *RIBSubscription {
+	return rib.subscribe(replay, false)
+}
+
+// SubscribeAllPaths は最適経路以外の経路の変化も購読する (ADD-PATH で複数の経路を送るときに使う)。
+// 変化は最適経路と同じく prefix ごとに届き、その時点の全ての経路が Paths に入っている
+func (rib *RIB) SubscribeAllPaths(replay bool) *RIBSubscription {
+	return rib.subscribe(replay, true)
+}
+
+func (rib *RIB) subscribe(replay, allPaths bool) *RIBSubscription {
+	s := &RIBSubscription{
+		rib:      rib,
+		allPaths: allPaths,
+		mutex:    new(sync.Mutex),
+		pending:  make(map[string]*RIBChange),
+		notify:   make(chan struct{}, 1),
+		c:        make(chan RIBChange),
+		done:     make(chan struct{}),
+		once:     new(sync.Once),
+	}
+
+	rib.mutex.Lock()
+	if replay {
+		rib.destinations.Walk(func(prefix *net.IPNet, d *ribDestination) bool {
+			c := RIBChange{Prefix: prefix, Curr: d.best}
+			if allPaths {
+				c.Paths = rankPaths(d.paths, d.best)
+			}
+			s.push(c)
+			return true
+		})
+		s.push(RIBChange{EndOfReplay: true})
+	}
+	rib.subscriptions[s] = struct{}{}
+	rib.mutex.Unlock()
+
+	go s.run()
+	return s
+}
+
+// C は変化を届けるチャンネルを返す (Close すると閉じる)
+func (s *RIBSubscription) C() <-chan RIBChange {
+	return s.c
+}
+
+// Close は購読を終了する。まだ届けていない変化は捨てる
+func (s *RIBSubscription) Close() {
+	s.once.Do(func() {
+		s.rib.mutex.Lock()
+		delete(s.rib.subscriptions, s)
+		s.rib.mutex.Unlock()
+		close(s.done)
+	})
+}
+
+// push は変化を溜める (RIB のロックを取ったまま呼ばれるのでブロックしない)
+func (s *RIBSubscription) push(c RIBChange) {
+	s.mutex.Lock()
+	if c.EndOfReplay {
+		s.queue = append(s.queue, &c)
+	} else if p, ok := s.pending[c.Prefix.String()]; ok {
+		p.Curr = c.Curr
+		p.Paths = c.Paths
+	} else {
+		s.queue = append(s.queue, &c)
+		s.pending[c.Prefix.String()] = &c
+	}
+	s.mutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default: // 既に通知済み
+	}
+}
+
+func (s *RIBSubscription) pop() (RIBChange, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.queue) > 0 {
+		c := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		if c.EndOfReplay {
+			return *c, true
+		}
+		delete(s.pending, c.Prefix.String())
+		if c.Prev == c.Curr && !s.allPaths {
+			continue // まとめた結果、元に戻ったので何も変わっていない
+		}
+		return *c, true
+	}
+	return RIBChange{}, false
+}
+
+func (s *RIBSubscription) run() {
+	defer close(s.c)
+	for {
+		c, ok := s.pop()
+		if !ok {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case s.c <- c:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Router は設定から動かしているピアと自分で広報しているネットワークを持ち、
+// 新しい設定との差分だけを反映する
+type Router struct {
+	ctx        context.Context
+	ribs       map[AddressFamily]*RIB
+	listener   *Listener
+	restart    *restartState // 自分が再起動した直後なら最初の設定のピアに渡す
+	forwarding bool          // FIB に経路を入れているか (Graceful Restart で転送を続けられるか)
+
+	mutex   *sync.Mutex
+	applied bool // 最初の設定を反映したか
+	cfg     Config
+	peers   map[string]*peerSupervisor // key: 正規化した相手のアドレス
+}
+
+// ReloadResult は設定の反映で変わったもの
+type ReloadResult struct {
+	AddedPeers   []string `json:"added_peers"`
+	RemovedPeers []string `json:"removed_peers"`
+	ResetPeers   []string `json:"reset_peers"`   // セッションを張り直したピア
+	UpdatedPeers []string `json:"updated_peers"` // セッションを張ったまま設定を変えたピア
+
+	AnnouncedNetworks []string `json:"announced_networks"`
+	WithdrawnNetworks []string `json:"withdrawn_networks"`
+}
+
+// NewRouter は ctx が終了するまでピアを動かす Router を作る。最初の設定も Apply で反映する。
+// restart は Graceful Restart で再起動した場合に、最初の経路を受け取り終わるのを待つためのもの (それ以外は nil)。
+// forwarding は FIB に経路を入れているかで、偽なら Graceful Restart capability で転送を続けていると広報しない
+func NewRouter(ctx context.Context, ribs map[AddressFamily]*RIB, listener *Listener, restart *restartState, forwarding bool) *Router {
+	return &Router{
+		ctx:        ctx,
+		ribs:       ribs,
+		listener:   listener,
+		restart:    restart,
+		forwarding: forwarding,
+		mutex:      new(sync.Mutex),
+		peers:      make(map[string]*peerSupervisor),
+	}
+}
+
+// Apply は今の設定と cfg の差分を反映する。
+// セッションに関わる設定 (AS 番号や address family など) が変わったピアだけセッションを張り直す
+func (r *Router) Apply(cfg Config) ReloadResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := ReloadResult{
+		AddedPeers:        []string{},
+		RemovedPeers:      []string{},
+		ResetPeers:        []string{},
+		UpdatedPeers:      []string{},
+		AnnouncedNetworks: []string{},
+		WithdrawnNetworks: []string{},
+	}
+
+	if r.applied && cfg.ListenAddress != r.cfg.ListenAddress {
+		warnf("config: listen_address change is not applied until restart")
+		cfg.ListenAddress = r.cfg.ListenAddress
+	}
+
+	// ネットワーク
+	oldNetworks := make(map[string]*net.IPNet, len(r.cfg.Networks))
+	for _, n := range r.cfg.Networks {
+		oldNetworks[n.String()] = n
+	}
+	newNetworks := make(map[string]*net.IPNet, len(cfg.Networks))
+	for _, n := range cfg.Networks {
+		newNetworks[n.String()] = n
+	}
+	for key, n := range oldNetworks {
+		if _, ok := newNetworks[key]; ok {
+			continue
+		}
+		rib := r.ribs[networkAddressFamily(n)]
+		if e := rib.FindPath(n, nil, 0); e != nil {
+			rib.Remove(e)
+		}
+		result.WithdrawnNetworks = append(result.WithdrawnNetworks, key)
+	}
+	for key, n := range newNetworks {
+		if _, ok := oldNetworks[key]; ok {
+			continue
+		}
+		af := networkAddressFamily(n)
+		if r.ribs[af].FindPath(n, nil, 0) == nil { // API で追加済みなら何もしない
+			r.ribs[af].Update(NewLocalRIBEntry(af, n))
+		}
+		result.AnnouncedNetworks = append(result.AnnouncedNetworks, key)
+	}
+
+	// ピア
+	oldPeers := make(map[string]PeerConfig, len(r.cfg.Peers))
+	for _, pc := range r.cfg.Peers {
+		oldPeers[normalizeAddress(pc.NeighborAddress)] = pc
+	}
+	// 設定ファイルではなく起動オプションで決まるもの
+	cfg.Peers = append([]PeerConfig(nil), cfg.Peers...)
+	for i := range cfg.Peers {
+		cfg.Peers[i].GracefulRestart.ForwardingPreserved = r.forwarding
+	}
+	newPeers := make(map[string]PeerConfig, len(cfg.Peers))
+	for _, pc := range cfg.Peers {
+		newPeers[normalizeAddress(pc.NeighborAddress)] = pc
+	}
+	for key := range oldPeers {
+		if _, ok := newPeers[key]; ok {
+			continue
+		}
+		r.peers[key].Stop(ManualStopEvent{Subcode: ErrorSubcodePeerDeconfigured})
+		delete(r.peers, key)
+		r.restart.RemovePeer(key)
+		result.RemovedPeers = append(result.RemovedPeers, key)
+	}
+	var restart *restartState
+	if !r.applied {
+		restart = r.restart
+	}
+	for key, pc := range newPeers {
+		old, ok := oldPeers[key]
+		switch {
+		case !ok:
+			r.peers[key] = startPeerSupervisor(r.ctx, pc, r.listener, restart)
+			result.AddedPeers = append(result.AddedPeers, key)
+		case sessionConfigChanged(old, pc):
+			r.peers[key].Stop(ManualStopEvent{Subcode: ErrorSubcodeOtherConfigurationChange})
+			r.peers[key] = startPeerSupervisor(r.ctx, pc, r.listener, nil)
+			result.ResetPeers = append(result.ResetPeers, key)
+		case peerConfigChanged(old, pc):
+			r.peers[key].UpdateConfig(pc)
+			result.UpdatedPeers = append(result.UpdatedPeers, key)
+		}
+	}
+
+	r.cfg = cfg
+	r.applied = true
+
+	for _, s := range [][]string{
+		result.AddedPeers, result.RemovedPeers, result.ResetPeers, result.UpdatedPeers,
+		result.AnnouncedNetworks, result.WithdrawnNetworks,
+	} {
+		sort.Strings(s)
+	}
+	infof(
+		"config: applied (peers: %d added, %d removed, %d reset, %d updated; networks: %d announced, %d withdrawn)",
+		len(result.AddedPeers), len(result.RemovedPeers), len(result.ResetPeers), len(result.UpdatedPeers),
+		len(result.AnnouncedNetworks), len(result.WithdrawnNetworks),
+	)
+	return result
+}
+
+// Config は反映している設定を返す
+func (r *Router) Config() Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.cfg
+}
+
+// Stop は全てのピアを e で止めて、終了するまで待つ
+func (r *Router) Stop(e ManualStopEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, s := range r.peers {
+		s.Stop(e)
+	}
+}
+
+// Wait は ctx が終了した後、全てのピアが止まるまで待つ
+func (r *Router) Wait() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, s := range r.peers {
+		<-s.done
+	}
+}
+
+// networkAddressFamily は自分で広報するネットワークの address family を返す
+func networkAddressFamily(n *net.IPNet) AddressFamily {
+	if len(n.IP) == net.IPv4len {
+		return IPv4Unicast
+	}
+	return IPv6Unicast
+}
+
+// sessionConfigChanged は a から b に変えるとセッションを張り直す必要があるか (OPEN で送る内容が変わるか) を返す
+func sessionConfigChanged(a, b PeerConfig) bool {
+	if a.MyAS != b.MyAS || a.RouterID != b.RouterID || a.RemoteAS != b.RemoteAS || a.HoldTime != b.HoldTime {
+		return true
+	}
+	if a.GracefulRestart.Enabled != b.GracefulRestart.Enabled || a.GracefulRestart.RestartTime != b.GracefulRestart.RestartTime {
+		return true
+	}
+	if len(a.AddressFamilies) != len(b.AddressFamilies) {
+		return true
+	}
+	for af, f := range a.AddressFamilies {
+		// ADD-PATH の設定は capability で伝えるので、変わったら張り直す
+		if g, ok := b.AddressFamilies[af]; !ok || f.AddPath != g.AddPath {
+			return true
+		}
+	}
+	return false
+}
+
+// peerConfigChanged はセッションを張ったまま反映できる設定が変わったかを返す
+func peerConfigChanged(a, b PeerConfig) bool {
+	return a.Passive != b.Passive || a.Weight != b.Weight || a.ConnectRetryTime != b.ConnectRetryTime ||
+		a.GracefulRestart.StaleRoutesTime != b.GracefulRestart.StaleRoutesTime ||
+		!sameSelfNextHops(a.AddressFamilies, b.AddressFamilies)
+}
+
+func sameSelfNextHops(a, b map[AddressFamily]AddressFamilyConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for af, f := range a {
+		g, ok := b[af]
+		if !ok || !f.SelfNextHop.Equal(g.SelfNextHop) {
+			return false
+		}
+	}
+	return true
+}
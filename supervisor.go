@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ピアの goroutine が異常終了してから作り直すまでの時間
+// 続けて異常終了するたびに倍にする
+const (
+	minPeerRestartDelay = time.Second
+	maxPeerRestartDelay = 5 * time.Minute
+
+	// これより長く動いていたら、次に異常終了したときの待ち時間を最初に戻す
+	peerRestartResetAfter = 10 * time.Minute
+)
+
+// peerSupervisor は 1 つのピアを動かし続ける。
+// FSM の再接続で回復できないエラー (panic など) で Run が終了した場合は、待ち時間を空けてピアを作り直す
+type peerSupervisor struct {
+	listener *Listener
+	// 自分が再起動した直後に最初に作るピアで使う (再起動していなければ nil)
+	restart *restartState
+
+	mutex   *sync.Mutex
+	cfg     PeerConfig
+	peer    *Peer // 動いているピア (作り直すのを待っている間は nil)
+	stopped bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startPeerSupervisor は cfg のピアを動かし始める。ctx が終了するか Stop すると止まる
+func startPeerSupervisor(ctx context.Context, cfg PeerConfig, listener *Listener, restart *restartState) *peerSupervisor {
+	s := &peerSupervisor{
+		listener: listener,
+		restart:  restart,
+		mutex:    new(sync.Mutex),
+		cfg:      cfg,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run(ctx)
+	return s
+}
+
+func (s *peerSupervisor) run(ctx context.Context) {
+	var prev *Peer // 異常終了したピア
+	defer func() {
+		if prev != nil {
+			// 引き継ぐピアがいないので、残した経路を消す
+			prev.purgeStaleRoutes()
+		}
+		close(s.done)
+	}()
+	delay := minPeerRestartDelay
+	for {
+		s.mutex.Lock()
+		if s.stopped {
+			s.mutex.Unlock()
+			return
+		}
+		p := NewPeer(s.cfg)
+		p.restarting = s.restart != nil
+		p.restartState = s.restart
+		if prev != nil {
+			// 自分の再起動として、相手に Graceful Restart で残してもらった経路を送り直す
+			p.restarting = true
+			p.inheritStaleRoutes(prev)
+			prev = nil
+		}
+		s.peer = p
+		s.mutex.Unlock()
+
+		s.listener.AddPeer(p)
+		started := time.Now()
+		err := runPeer(ctx, p)
+		s.listener.RemovePeer(p)
+
+		s.mutex.Lock()
+		s.peer = nil
+		stopped := s.stopped
+		s.mutex.Unlock()
+		if ctx.Err() != nil || stopped {
+			return
+		}
+
+		if time.Since(started) > peerRestartResetAfter {
+			delay = minPeerRestartDelay
+		}
+		errorf("peer %v stopped: %v (restart after %v)", p.NeighborAddress, err, delay)
+		prev = p
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		}
+		delay *= 2
+		if delay > maxPeerRestartDelay {
+			delay = maxPeerRestartDelay
+		}
+	}
+}
+
+// Stop は e でピアのセッションを止めて、終了するまで待つ
+func (s *peerSupervisor) Stop(e ManualStopEvent) {
+	s.mutex.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+		if s.peer != nil {
+			s.peer.Stop(e)
+		}
+	}
+	s.mutex.Unlock()
+	<-s.done
+}
+
+// UpdateConfig はセッションを張り直さずに反映できる設定の変更を動いているピアに反映する
+// (作り直すときにも新しい設定を使う)
+func (s *peerSupervisor) UpdateConfig(cfg PeerConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cfg = cfg
+	if s.peer != nil {
+		s.peer.UpdateConfig(cfg)
+	}
+}
+
+// runPeer は p.Run を呼び、panic した場合もエラーとして返す
+func runPeer(ctx context.Context, p *Peer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if err := p.Run(ctx); err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpectedly returned")
+}
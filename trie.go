@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net"
+)
+
+// prefixTrie は prefix をキーにした Patricia trie (分岐のないノードを圧縮した二分木)
+// IPv4 と IPv6 の prefix は別の木に入れる (同じ長さのアドレスどうしでしか比較しない)
+type prefixTrie[V any] struct {
+	roots [2]*trieNode[V] // IPv4, IPv6
+	size  int
+}
+
+type trieNode[V any] struct {
+	key    []byte // length より後ろのビットは 0
+	length int
+
+	value    V
+	hasValue bool // false の場合は分岐のためだけのノード
+
+	children [2]*trieNode[V]
+}
+
+func newPrefixTrie[V any]() *prefixTrie[V] {
+	return &prefixTrie[V]{}
+}
+
+// prefixKey は prefix をキーのバイト列と長さに変換する
+// 比較は長さまでしか行わないので、探索のときは後ろのビットを 0 にしなくてよい (コピーも作らない)
+func prefixKey(prefix *net.IPNet) ([]byte, int) {
+	length, bits := prefix.Mask.Size()
+	if bits == 32 {
+		return prefix.IP.To4(), length
+	}
+	return prefix.IP.To16(), length
+}
+
+// addressKey はアドレスを長さが全ビットのキーに変換する
+func addressKey(ip net.IP) ([]byte, int) {
+	if v4 := ip.To4(); v4 != nil {
+		return v4, 32
+	}
+	return ip.To16(), 128
+}
+
+func maskKey(b []byte, length int) []byte {
+	key := make([]byte, len(b))
+	copy(key, b)
+	for i := range key {
+		switch {
+		case length >= (i+1)*8:
+		case length <= i*8:
+			key[i] = 0
+		default:
+			key[i] &= ^byte(0xFF >> (length - i*8))
+		}
+	}
+	return key
+}
+
+// keyBit は key の i ビット目 (先頭が 0) を返す
+func keyBit(key []byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// commonPrefixLength は a と b の先頭から一致するビット数を max を上限として返す
+func commonPrefixLength(a, b []byte, max int) int {
+	n := 0
+	for i := 0; n < max && i < len(a) && i < len(b); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+// contains は n の prefix が key の先頭 length ビットを含むかを返す
+func (n *trieNode[V]) contains(key []byte, length int) bool {
+	return n.length <= length && len(n.key) == len(key) && commonPrefixLength(n.key, key, n.length) == n.length
+}
+
+// root は key と同じ長さのアドレスの木の根を返す
+func (t *prefixTrie[V]) root(key []byte) **trieNode[V] {
+	if len(key) == net.IPv4len {
+		return &t.roots[0]
+	}
+	return &t.roots[1]
+}
+
+func (n *trieNode[V]) prefix() *net.IPNet {
+	ip := make(net.IP, len(n.key))
+	copy(ip, n.key)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(n.length, len(n.key)*8)}
+}
+
+func (t *prefixTrie[V]) Len() int {
+	return t.size
+}
+
+// Get は prefix と完全に一致するエントリを返す
+func (t *prefixTrie[V]) Get(prefix *net.IPNet) (V, bool) {
+	key, length := prefixKey(prefix)
+	n := *t.root(key)
+	for n != nil && n.contains(key, length) {
+		if n.length == length {
+			return n.value, n.hasValue
+		}
+		n = n.children[keyBit(key, n.length)]
+	}
+	var zero V
+	return zero, false
+}
+
+// Insert は prefix のエントリを追加 (または置き換え) する
+func (t *prefixTrie[V]) Insert(prefix *net.IPNet, v V) {
+	key, length := prefixKey(prefix)
+	key = maskKey(key, length)
+	leaf := &trieNode[V]{key: key, length: length, value: v, hasValue: true}
+
+	link := t.root(key)
+	for {
+		n := *link
+		if n == nil {
+			*link = leaf
+			t.size++
+			return
+		}
+
+		max := n.length
+		if length < max {
+			max = length
+		}
+		common := commonPrefixLength(n.key, key, max)
+		switch {
+		case common == n.length && n.length == length:
+			// 同じ prefix
+			if !n.hasValue {
+				t.size++
+			}
+			n.value, n.hasValue = v, true
+			return
+		case common == n.length:
+			// n の下に入れる
+			link = &n.children[keyBit(key, n.length)]
+		case common == length:
+			// 新しい prefix が n を含むので n の上に入れる
+			leaf.children[keyBit(n.key, length)] = n
+			*link = leaf
+			t.size++
+			return
+		default:
+			// common ビット目で分岐するノードを作る
+			branch := &trieNode[V]{key: maskKey(key, common), length: common}
+			branch.children[keyBit(key, common)] = leaf
+			branch.children[keyBit(n.key, common)] = n
+			*link = branch
+			t.size++
+			return
+		}
+	}
+}
+
+// Delete は prefix のエントリを取り除き、入っていたかを返す
+func (t *prefixTrie[V]) Delete(prefix *net.IPNet) bool {
+	key, length := prefixKey(prefix)
+
+	var parent **trieNode[V]
+	link := t.root(key)
+	for {
+		n := *link
+		if n == nil || !n.contains(key, length) {
+			return false
+		}
+		if n.length == length {
+			break
+		}
+		parent = link
+		link = &n.children[keyBit(key, n.length)]
+	}
+
+	n := *link
+	if !n.hasValue {
+		return false
+	}
+	var zero V
+	n.value, n.hasValue = zero, false
+	t.size--
+
+	// 値のないノードは子が 2 つある場合だけ残す
+	compact(link)
+	if parent != nil {
+		compact(parent)
+	}
+	return true
+}
+
+func compact[V any](link **trieNode[V]) {
+	n := *link
+	if n.hasValue {
+		return
+	}
+	switch {
+	case n.children[0] == nil:
+		*link = n.children[1]
+	case n.children[1] == nil:
+		*link = n.children[0]
+	}
+}
+
+// LongestMatch は ip を含む最も長い prefix のエントリを返す
+func (t *prefixTrie[V]) LongestMatch(ip net.IP) (*net.IPNet, V, bool) {
+	key, length := addressKey(ip)
+	var found *trieNode[V]
+	for n := *t.root(key); n != nil && n.contains(key, length); {
+		if n.hasValue {
+			found = n
+		}
+		if n.length == length {
+			break
+		}
+		n = n.children[keyBit(key, n.length)]
+	}
+	if found == nil {
+		var zero V
+		return nil, zero, false
+	}
+	return found.prefix(), found.value, true
+}
+
+// WalkCovering は prefix を含む (prefix 自身を含めてそれより短い) エントリを短い順に fn に渡す
+// fn が false を返したら止める
+func (t *prefixTrie[V]) WalkCovering(prefix *net.IPNet, fn func(*net.IPNet, V) bool) {
+	key, length := prefixKey(prefix)
+	for n := *t.root(key); n != nil && n.contains(key, length); {
+		if n.hasValue && !fn(n.prefix(), n.value) {
+			return
+		}
+		if n.length == length {
+			return
+		}
+		n = n.children[keyBit(key, n.length)]
+	}
+}
+
+// WalkCovered は prefix に含まれる (prefix 自身を含めてそれより長い) エントリを prefix の順に fn に渡す
+// fn が false を返したら止める
+func (t *prefixTrie[V]) WalkCovered(prefix *net.IPNet, fn func(*net.IPNet, V) bool) {
+	key, length := prefixKey(prefix)
+	n := *t.root(key)
+	for n != nil && n.length < length {
+		if !n.contains(key, length) {
+			return
+		}
+		n = n.children[keyBit(key, n.length)]
+	}
+	if n == nil || len(n.key) != len(key) || commonPrefixLength(n.key, key, length) != length {
+		return
+	}
+	n.walk(fn)
+}
+
+// Walk は全てのエントリを prefix の順 (IPv4 が先) に fn に渡す
+func (t *prefixTrie[V]) Walk(fn func(*net.IPNet, V) bool) {
+	for _, root := range t.roots {
+		if root != nil && !root.walk(fn) {
+			return
+		}
+	}
+}
+
+func (n *trieNode[V]) walk(fn func(*net.IPNet, V) bool) bool {
+	if n.hasValue && !fn(n.prefix(), n.value) {
+		return false
+	}
+	for _, c := range n.children {
+		if c != nil && !c.walk(fn) {
+			return false
+		}
+	}
+	return true
+}
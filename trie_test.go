@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(t testing.TB, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// checkTrie は木の形が正しいか (子が親の prefix に含まれ、値のないノードは子を 2 つ持つ) を確かめ、値の数を返す
+func checkTrie[V any](t *testing.T, n *trieNode[V]) int {
+	t.Helper()
+	if n == nil {
+		return 0
+	}
+	count := 0
+	if n.hasValue {
+		count++
+	} else if n.children[0] == nil || n.children[1] == nil {
+		t.Errorf("node %v has no value and less than 2 children", n.prefix())
+	}
+	for i, c := range n.children {
+		if c == nil {
+			continue
+		}
+		if c.length <= n.length || !n.contains(c.key, c.length) || keyBit(c.key, n.length) != i {
+			t.Errorf("node %v is misplaced under %v", c.prefix(), n.prefix())
+		}
+		count += checkTrie(t, c)
+	}
+	return count
+}
+
+func checkTrieSize[V any](t *testing.T, trie *prefixTrie[V]) {
+	t.Helper()
+	count := 0
+	for _, root := range trie.roots {
+		count += checkTrie(t, root)
+	}
+	if count != trie.Len() {
+		t.Errorf("Len() = %d, but %d values in the trie", trie.Len(), count)
+	}
+}
+
+func TestPrefixTrieLongestMatch(t *testing.T) {
+	trie := newPrefixTrie[string]()
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.128/25", "192.168.0.0/16"} {
+		trie.Insert(mustParseCIDR(t, s), s)
+	}
+	checkTrieSize(t, trie)
+
+	tests := []struct {
+		ip   string
+		want string // 空の場合は見つからない
+	}{
+		{"10.0.0.1", "10.0.0.0/8"},
+		{"10.1.0.1", "10.1.0.0/16"},
+		{"10.1.2.1", "10.1.2.0/24"},
+		{"10.1.2.129", "10.1.2.128/25"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"192.168.255.255", "192.168.0.0/16"},
+		{"192.169.0.1", ""},
+		{"11.0.0.1", ""},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		prefix, v, ok := trie.LongestMatch(net.ParseIP(tt.ip))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("LongestMatch(%s) = %v, want none", tt.ip, prefix)
+			}
+			continue
+		}
+		if !ok || v != tt.want || prefix.String() != tt.want {
+			t.Errorf("LongestMatch(%s) = %v (%q, %v), want %s", tt.ip, prefix, v, ok, tt.want)
+		}
+	}
+}
+
+func TestPrefixTrieGet(t *testing.T) {
+	trie := newPrefixTrie[int]()
+	trie.Insert(mustParseCIDR(t, "10.1.0.0/16"), 1)
+	trie.Insert(mustParseCIDR(t, "10.1.0.0/24"), 2)
+	trie.Insert(mustParseCIDR(t, "10.1.0.0/16"), 3) // 置き換え
+
+	tests := []struct {
+		prefix string
+		want   int
+		ok     bool
+	}{
+		{"10.1.0.0/16", 3, true},
+		{"10.1.0.0/24", 2, true},
+		{"10.1.0.0/20", 0, false},
+		{"10.0.0.0/8", 0, false},
+		{"10.1.0.0/25", 0, false},
+	}
+	for _, tt := range tests {
+		v, ok := trie.Get(mustParseCIDR(t, tt.prefix))
+		if v != tt.want || ok != tt.ok {
+			t.Errorf("Get(%s) = %d, %v, want %d, %v", tt.prefix, v, ok, tt.want, tt.ok)
+		}
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", trie.Len())
+	}
+	checkTrieSize(t, trie)
+}
+
+func TestPrefixTrieDelete(t *testing.T) {
+	prefixes := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.128.0.0/9", "172.16.0.0/12"}
+	tests := []struct {
+		name   string
+		delete []string
+		want   []string // 残る prefix (順番通り)
+	}{
+		{"leaf", []string{"10.1.2.0/24"}, []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.3.0/24", "10.128.0.0/9", "172.16.0.0/12"}},
+		{"node with children", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8", "10.1.2.0/24", "10.1.3.0/24", "10.128.0.0/9", "172.16.0.0/12"}},
+		{"branch collapses", []string{"10.1.2.0/24", "10.1.3.0/24", "10.1.0.0/16"}, []string{"10.0.0.0/8", "10.128.0.0/9", "172.16.0.0/12"}},
+		{"root", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.128.0.0/9", "172.16.0.0/12"}},
+		{"all", prefixes, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trie := newPrefixTrie[string]()
+			for _, s := range prefixes {
+				trie.Insert(mustParseCIDR(t, s), s)
+			}
+			for _, s := range tt.delete {
+				if !trie.Delete(mustParseCIDR(t, s)) {
+					t.Errorf("Delete(%s) = false", s)
+				}
+				if trie.Delete(mustParseCIDR(t, s)) {
+					t.Errorf("Delete(%s) twice = true", s)
+				}
+			}
+			checkTrieSize(t, trie)
+
+			var got []string
+			trie.Walk(func(prefix *net.IPNet, v string) bool {
+				got = append(got, v)
+				return true
+			})
+			if len(got) != len(tt.want) {
+				t.Fatalf("Walk() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Walk() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// 分岐のためだけのノードは消せない
+	trie := newPrefixTrie[string]()
+	trie.Insert(mustParseCIDR(t, "10.1.2.0/24"), "a")
+	trie.Insert(mustParseCIDR(t, "10.1.3.0/24"), "b")
+	if trie.Delete(mustParseCIDR(t, "10.1.2.0/23")) {
+		t.Error("Delete(branch) = true")
+	}
+	if trie.Delete(mustParseCIDR(t, "10.1.2.0/25")) {
+		t.Error("Delete(not inserted) = true")
+	}
+	checkTrieSize(t, trie)
+}
+
+func TestPrefixTrieBoundaryLengths(t *testing.T) {
+	tests := []struct {
+		prefix string
+		match  string // prefix に含まれるアドレス
+		other  string // prefix に含まれないアドレス (空の場合は無い)
+	}{
+		{"0.0.0.0/0", "203.0.113.1", ""},
+		{"203.0.113.1/32", "203.0.113.1", "203.0.113.2"},
+		{"::/0", "2001:db8::1", ""},
+		{"2001:db8::1/128", "2001:db8::1", "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			trie := newPrefixTrie[string]()
+			prefix := mustParseCIDR(t, tt.prefix)
+			trie.Insert(prefix, tt.prefix)
+			if v, ok := trie.Get(prefix); !ok || v != tt.prefix {
+				t.Errorf("Get() = %q, %v", v, ok)
+			}
+			if p, _, ok := trie.LongestMatch(net.ParseIP(tt.match)); !ok || p.String() != tt.prefix {
+				t.Errorf("LongestMatch(%s) = %v, %v", tt.match, p, ok)
+			}
+			if tt.other != "" {
+				if p, _, ok := trie.LongestMatch(net.ParseIP(tt.other)); ok {
+					t.Errorf("LongestMatch(%s) = %v", tt.other, p)
+				}
+			}
+			if !trie.Delete(prefix) || trie.Len() != 0 {
+				t.Errorf("Delete() failed (Len() = %d)", trie.Len())
+			}
+		})
+	}
+}
+
+func TestPrefixTrieMixedFamilies(t *testing.T) {
+	trie := newPrefixTrie[string]()
+	for _, s := range []string{"0.0.0.0/0", "::/0", "10.0.0.0/8", "2001:db8::/32", "::ffff:0:0/96", "2001:db8:1::/48"} {
+		trie.Insert(mustParseCIDR(t, s), s)
+	}
+	if trie.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", trie.Len())
+	}
+	checkTrieSize(t, trie)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.0.0.1", "10.0.0.0/8"},
+		{"192.0.2.1", "0.0.0.0/0"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db9::1", "::/0"},
+	}
+	for _, tt := range tests {
+		if _, v, ok := trie.LongestMatch(net.ParseIP(tt.ip)); !ok || v != tt.want {
+			t.Errorf("LongestMatch(%s) = %q, %v, want %s", tt.ip, v, ok, tt.want)
+		}
+	}
+
+	// 片方の /0 を消してももう片方は残る
+	trie.Delete(mustParseCIDR(t, "0.0.0.0/0"))
+	if _, _, ok := trie.LongestMatch(net.ParseIP("192.0.2.1")); ok {
+		t.Error("LongestMatch(192.0.2.1) found after deleting 0.0.0.0/0")
+	}
+	if _, v, ok := trie.LongestMatch(net.ParseIP("2001:db9::1")); !ok || v != "::/0" {
+		t.Errorf("LongestMatch(2001:db9::1) = %q, %v", v, ok)
+	}
+
+	var got []string
+	trie.Walk(func(_ *net.IPNet, v string) bool {
+		got = append(got, v)
+		return true
+	})
+	want := []string{"10.0.0.0/8", "::/0", "::ffff:0:0/96", "2001:db8::/32", "2001:db8:1::/48"}
+	if len(got) != len(want) {
+		t.Fatalf("Walk() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Walk() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPrefixTrieWalkCoveringAndCovered(t *testing.T) {
+	trie := newPrefixTrie[string]()
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/16"} {
+		trie.Insert(mustParseCIDR(t, s), s)
+	}
+	collect := func(walk func(*net.IPNet, func(*net.IPNet, string) bool), prefix string) []string {
+		var s []string
+		walk(mustParseCIDR(t, prefix), func(_ *net.IPNet, v string) bool {
+			s = append(s, v)
+			return true
+		})
+		return s
+	}
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"covering /24", collect(trie.WalkCovering, "10.1.2.0/24"), []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"}},
+		{"covering /25", collect(trie.WalkCovering, "10.1.3.128/25"), []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.3.0/24"}},
+		{"covered /16", collect(trie.WalkCovered, "10.1.0.0/16"), []string{"10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24"}},
+		{"covered /12", collect(trie.WalkCovered, "10.0.0.0/12"), []string{"10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/16"}},
+		{"covered branch", collect(trie.WalkCovered, "10.0.0.0/14"), []string{"10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "10.2.0.0/16"}},
+		{"covered /15", collect(trie.WalkCovered, "10.2.0.0/15"), []string{"10.2.0.0/16"}},
+		{"covered none", collect(trie.WalkCovered, "11.0.0.0/8"), nil},
+	}
+	for _, tt := range tests {
+		if len(tt.got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+			continue
+		}
+		for i := range tt.got {
+			if tt.got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// benchmarkTableSize はベンチマークで使うフルルートの経路数
+const benchmarkTableSize = 1000000
+
+var (
+	benchmarkPrefixesOnce sync.Once
+	benchmarkPrefixes     []*net.IPNet
+)
+
+// fullTablePrefixes はフルルートに近い長さの分布 (大半が /24) の IPv4 の prefix を重複なしで作る
+func fullTablePrefixes() []*net.IPNet {
+	benchmarkPrefixesOnce.Do(func() {
+		r := rand.New(rand.NewSource(1))
+		seen := make(map[[5]byte]bool, benchmarkTableSize)
+		for len(benchmarkPrefixes) < benchmarkTableSize {
+			length := 24
+			switch n := r.Intn(100); {
+			case n < 10:
+				length = 16 + r.Intn(4)
+			case n < 40:
+				length = 20 + r.Intn(4)
+			}
+			var key [5]byte
+			binary.BigEndian.PutUint32(key[:4], r.Uint32()&^(0xFFFFFFFF>>length))
+			key[4] = byte(length)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			benchmarkPrefixes = append(benchmarkPrefixes, &net.IPNet{IP: net.IP(key[:4]), Mask: net.CIDRMask(length, 32)})
+		}
+	})
+	return benchmarkPrefixes
+}
+
+func BenchmarkInsert(b *testing.B) {
+	prefixes := fullTablePrefixes()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		trie := newPrefixTrie[int]()
+		for j, prefix := range prefixes {
+			trie.Insert(prefix, j)
+		}
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*len(prefixes)), "ns/prefix")
+}
+
+func BenchmarkLookup(b *testing.B) {
+	prefixes := fullTablePrefixes()
+	trie := newPrefixTrie[int]()
+	for j, prefix := range prefixes {
+		trie.Insert(prefix, j)
+	}
+	r := rand.New(rand.NewSource(2))
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ips[i], r.Uint32())
+	}
+
+	b.Run("Exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			trie.Get(prefixes[i%len(prefixes)])
+		}
+	})
+	b.Run("LongestMatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			trie.LongestMatch(ips[i%len(ips)])
+		}
+	})
+}
@@ -8,33 +8,73 @@ import (
 type WithdrawnRoute struct {
 	AF     AddressFamily
 	Prefix *net.IPNet
+	PathID uint32 // ADD-PATH を使っていなければ 0
 }
 
 func UpdateMessageToRIBEntries(m UpdateMessage, source *Peer) ([]WithdrawnRoute, []*RIBEntry, error) {
 	var (
-		origin  Origin
-		asPath  ASPath
-		nextHop NextHop
-		others  []PathAttribute
+		origin     Origin
+		asPath     ASPath
+		as4Path    *ASPath
+		nextHop    NextHop
+		med        *MultiExitDisc
+		localPref  = DefaultLocalPref
+		aggregator *Aggregator
+		as4Agg     *Aggregator
+		others     []PathAttribute
 
 		mpReach   MPReachNLRI
 		mpUnreach MPUnreachNLRI
 
 		err error
 	)
+	opts := source.negotiated.ReadOptions()
 
+	seen := make(map[AttributeTypeCode]struct{}, len(m.PathAttributes))
 	for _, a := range m.PathAttributes {
+		if _, ok := seen[a.TypeCode]; ok {
+			return nil, nil, updateMessageError(ErrorSubcodeMalformedAttributeList, nil, "duplicated path attribute: type = %d", a.TypeCode)
+		}
+		seen[a.TypeCode] = struct{}{}
+
 		switch a.TypeCode {
 		case AttributeTypeOrigin:
 			origin, err = OriginFromPathAttribute(a)
 		case AttributeTypeASPath:
-			asPath, err = ASPathFromPathAttribute(a)
+			asPath, err = ASPathFromPathAttribute(a, source.negotiated.FourOctetAS)
+		case AttributeTypeAS4Path:
+			if source.negotiated.FourOctetAS {
+				continue // NEW BGP speaker からの AS4_PATH は無視する
+			}
+			var v ASPath
+			v, err = AS4PathFromPathAttribute(a)
+			as4Path = &v
+		case AttributeTypeAggregator:
+			var v Aggregator
+			v, err = AggregatorFromPathAttribute(a, source.negotiated.FourOctetAS)
+			aggregator = &v
+		case AttributeTypeAS4Aggregator:
+			if source.negotiated.FourOctetAS {
+				continue // NEW BGP speaker からの AS4_AGGREGATOR は無視する
+			}
+			var v Aggregator
+			v, err = AS4AggregatorFromPathAttribute(a)
+			as4Agg = &v
 		case AttributeTypeNextHop:
 			nextHop, err = NextHopFromPathAttribute(a)
+		case AttributeTypeMultiExitDisc:
+			var v MultiExitDisc
+			v, err = MultiExitDiscFromPathAttribute(a)
+			med = &v
+		case AttributeTypeLocalPref:
+			if !source.isInternal() {
+				continue // eBGP で受け取った LOCAL_PREF は無視する
+			}
+			localPref, err = LocalPrefFromPathAttribute(a)
 		case AttributeTypeMPReachNLRI:
-			mpReach, err = MPReachNLRIFromPathAttribute(a)
+			mpReach, err = MPReachNLRIFromPathAttribute(a, opts)
 		case AttributeTypeMPUnreachNLRI:
-			mpUnreach, err = MPUnreachNLRIFromPathAttribute(a)
+			mpUnreach, err = MPUnreachNLRIFromPathAttribute(a, opts)
 		default:
 			others = append(others, a)
 		}
@@ -43,40 +83,79 @@ func UpdateMessageToRIBEntries(m UpdateMessage, source *Peer) ([]WithdrawnRoute,
 		}
 	}
 
+	// NLRI がある場合は well-known mandatory な属性が必要
+	var mandatory []AttributeTypeCode
+	if len(m.NLRI) > 0 {
+		mandatory = []AttributeTypeCode{AttributeTypeOrigin, AttributeTypeASPath, AttributeTypeNextHop}
+	} else if len(mpReach.NLRI) > 0 {
+		mandatory = []AttributeTypeCode{AttributeTypeOrigin, AttributeTypeASPath}
+	}
+	for _, t := range mandatory {
+		if _, ok := seen[t]; !ok {
+			return nil, nil, updateMessageError(ErrorSubcodeMissingWellKnownAttribute, []byte{uint8(t)}, "missing well-known attribute: type = %d", t)
+		}
+	}
+
+	// RFC 6793 4.2.3
+	if aggregator != nil && aggregator.AS != ASTrans {
+		// AGGREGATOR が AS_TRANS でなければ AS4_AGGREGATOR と AS4_PATH は無視する
+		as4Agg, as4Path = nil, nil
+	}
+	if as4Agg != nil {
+		aggregator = as4Agg
+	}
+	if as4Path != nil {
+		asPath = mergeAS4Path(asPath, *as4Path)
+	}
+
 	withdrawns := make([]WithdrawnRoute, 0, len(m.WirhdrawnRoutes)+len(mpUnreach.WithdrawnRoutes))
-	for _, r := range m.WirhdrawnRoutes {
+	for i, r := range m.WirhdrawnRoutes {
 		withdrawns = append(withdrawns, WithdrawnRoute{
 			AF:     IPv4Unicast,
 			Prefix: r,
+			PathID: pathIDAt(m.WithdrawnPathIDs, i),
 		})
 	}
-	for _, r := range mpUnreach.WithdrawnRoutes {
+	for i, r := range mpUnreach.WithdrawnRoutes {
 		withdrawns = append(withdrawns, WithdrawnRoute{
 			AF:     mpUnreach.AF,
 			Prefix: r,
+			PathID: pathIDAt(mpUnreach.PathIDs, i),
 		})
 	}
 
 	entries := make([]*RIBEntry, 0, len(mpReach.NLRI)+len(m.NLRI))
-	for _, r := range mpReach.NLRI {
+	for i, r := range mpReach.NLRI {
 		entries = append(entries, &RIBEntry{
 			AF:              mpReach.AF,
 			Prefix:          r,
+			PathID:          pathIDAt(mpReach.PathIDs, i),
 			Origin:          origin,
 			ASPath:          asPath,
+			MED:             med,
+			LocalPref:       localPref,
+			Aggregator:      aggregator,
 			NextHop:         mpReach.NextHop[0], // TODO: Select best
 			OtherAttributes: others,
+			Weight:          source.Weight,
+			PeerRouterID:    source.RemoteRouterID,
 			Source:          source,
 		})
 	}
-	for _, r := range m.NLRI {
+	for i, r := range m.NLRI {
 		entries = append(entries, &RIBEntry{
 			AF:              IPv4Unicast,
 			Prefix:          r,
+			PathID:          pathIDAt(m.NLRIPathIDs, i),
 			Origin:          origin,
 			ASPath:          asPath,
+			MED:             med,
+			LocalPref:       localPref,
+			Aggregator:      aggregator,
 			NextHop:         net.IP(nextHop),
 			OtherAttributes: others, // TODO: Copy other attributes?
+			Weight:          source.Weight,
+			PeerRouterID:    source.RemoteRouterID,
 			Source:          source,
 		})
 	}
@@ -84,62 +163,116 @@ func UpdateMessageToRIBEntries(m UpdateMessage, source *Peer) ([]WithdrawnRoute,
 	return withdrawns, entries, nil
 }
 
-func CreateWithdrawnMessage(r *net.IPNet) UpdateMessage {
-	switch len(r.IP) {
+// CreateWithdrawnMessage は r を取り消す UPDATE メッセージを作る。addPath の場合は r.PathID を付ける
+func CreateWithdrawnMessage(r WithdrawnRoute, addPath bool) UpdateMessage {
+	var pathIDs []uint32
+	if addPath {
+		pathIDs = []uint32{r.PathID}
+	}
+	switch len(r.Prefix.IP) {
 	case 4: // IPv4
 		return UpdateMessage{
-			WirhdrawnRoutes: []*net.IPNet{r},
+			WirhdrawnRoutes:  []*net.IPNet{r.Prefix},
+			WithdrawnPathIDs: pathIDs,
 		}
 	case 16: // IPv6
 		return UpdateMessage{
 			PathAttributes: []PathAttribute{
 				MPUnreachNLRI{
 					AF:              IPv6Unicast,
-					WithdrawnRoutes: []*net.IPNet{r},
+					WithdrawnRoutes: []*net.IPNet{r.Prefix},
+					PathIDs:         pathIDs,
 				}.ToPathAttribute(),
 			},
 		}
 	default:
-		panic(fmt.Errorf("unexpected withdrawn prefix: %v", r))
+		panic(fmt.Errorf("unexpected withdrawn prefix: %v", r.Prefix))
 	}
 }
 
-func CreateUpdateMessage(e *RIBEntry, prependAS uint16, selfNextHop net.IP) UpdateMessage {
+// CreateEndOfRIBMessage は af の最初の経路を全て送り終わったことを示す End-of-RIB を作る (RFC 4724 2)
+func CreateEndOfRIBMessage(af AddressFamily) UpdateMessage {
+	if af == IPv4Unicast {
+		return UpdateMessage{}
+	}
+	return UpdateMessage{
+		PathAttributes: []PathAttribute{MPUnreachNLRI{AF: af}.ToPathAttribute()},
+	}
+}
+
+// EndOfRIB は m が End-of-RIB ならその address family を返す
+// (IPv4 Unicast は空の UPDATE、それ以外は中身の無い MP_UNREACH_NLRI だけの UPDATE)
+func (m UpdateMessage) EndOfRIB() (AddressFamily, bool) {
+	if len(m.WirhdrawnRoutes) > 0 || len(m.NLRI) > 0 || len(m.PathAttributes) > 1 {
+		return AddressFamily{}, false
+	}
+	if len(m.PathAttributes) == 0 {
+		return IPv4Unicast, true
+	}
+	if m.PathAttributes[0].TypeCode != AttributeTypeMPUnreachNLRI {
+		return AddressFamily{}, false
+	}
+	// 中身があるかだけ見るので、Path Identifier が付いているかは気にしない
+	v, err := MPUnreachNLRIFromPathAttribute(m.PathAttributes[0], ReadOptions{})
+	if err != nil || len(v.WithdrawnRoutes) > 0 {
+		return AddressFamily{}, false
+	}
+	return v.AF, true
+}
+
+// CreateUpdateMessage は相手に送るために書き換えた RIB のエントリから UPDATE メッセージを作る。
+// fourOctetAS は相手と 4-octet AS を合意しているか (していなければ AS4_PATH, AS4_AGGREGATOR を付ける)
+// internal は iBGP の相手か (LOCAL_PREF を付ける)
+// addPath は ADD-PATH で送るか (e.PathID を付ける)
+func CreateUpdateMessage(e *RIBEntry, fourOctetAS, internal, addPath bool) UpdateMessage {
 	nextHop := e.NextHop
-	if nextHop == nil {
-		nextHop = selfNextHop
+	asPath := e.ASPath
+	pathAttributes := []PathAttribute{
+		e.Origin.ToPathAttribute(),
+		asPath.ToPathAttribute(fourOctetAS),
 	}
+	var pathIDs []uint32
+	if addPath {
+		pathIDs = []uint32{e.PathID}
+	}
+	var nlri []*net.IPNet
+	var nlriPathIDs []uint32
 	switch len(e.Prefix.IP) {
 	case 4:
-		pathAttributes := []PathAttribute{
-			e.Origin.ToPathAttribute(),
-			ASPath{
-				Sequence: e.ASPath.Sequence,
-				Segments: append([]uint16{prependAS}, e.ASPath.Segments...),
-			}.ToPathAttribute(),
-			NextHop(nextHop).ToPathAttribute(),
-		}
-		return UpdateMessage{
-			PathAttributes: append(pathAttributes, e.OtherAttributes...),
-			NLRI:           []*net.IPNet{e.Prefix},
-		}
+		pathAttributes = append(pathAttributes, NextHop(nextHop).ToPathAttribute())
+		nlri = []*net.IPNet{e.Prefix}
+		nlriPathIDs = pathIDs
 	case 16:
-		pathAttributes := []PathAttribute{
-			e.Origin.ToPathAttribute(),
-			ASPath{
-				Sequence: e.ASPath.Sequence,
-				Segments: append([]uint16{prependAS}, e.ASPath.Segments...),
-			}.ToPathAttribute(),
-			MPReachNLRI{
-				AF:      IPv6Unicast,
-				NextHop: []net.IP{nextHop},
-				NLRI:    []*net.IPNet{e.Prefix},
-			}.ToPathAttribute(),
-		}
-		return UpdateMessage{
-			PathAttributes: append(pathAttributes, e.OtherAttributes...),
-		}
+		pathAttributes = append(pathAttributes, MPReachNLRI{
+			AF:      IPv6Unicast,
+			NextHop: []net.IP{nextHop},
+			NLRI:    []*net.IPNet{e.Prefix},
+			PathIDs: pathIDs,
+		}.ToPathAttribute())
 	default:
 		panic(fmt.Errorf("unexpected rib entry: %v", e))
 	}
+	if e.MED != nil {
+		pathAttributes = append(pathAttributes, e.MED.ToPathAttribute())
+	}
+	if internal {
+		pathAttributes = append(pathAttributes, e.LocalPref.ToPathAttribute())
+	}
+	if e.Aggregator != nil {
+		pathAttributes = append(pathAttributes, e.Aggregator.ToPathAttribute(fourOctetAS))
+	}
+	if !fourOctetAS {
+		// 2-octet AS の相手には本来の値を AS4_PATH, AS4_AGGREGATOR で送る
+		if asPath.HasFourOctetAS() {
+			pathAttributes = append(pathAttributes, asPath.ToAS4PathAttribute())
+		}
+		if e.Aggregator != nil && e.Aggregator.AS > 0xFFFF {
+			pathAttributes = append(pathAttributes, e.Aggregator.ToAS4AggregatorPathAttribute())
+		}
+	}
+	return UpdateMessage{
+		PathAttributes: append(pathAttributes, e.OtherAttributes...),
+		NLRI:           nlri,
+		NLRIPathIDs:    nlriPathIDs,
+	}
 }